@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+// capacityUpdate is the part of core.Capacity staff can change. Members
+// missing from the merge patch are nil.
+type capacityUpdate struct {
+	Total     *int `json:"total,omitempty"`
+	Available *int `json:"available,omitempty"`
+}
+
+// PatchCapacityHandler updates the capacity of a service at an organization
+// with a JSON merge patch, e.g. {"available": 3} once beds are taken. The
+// first update must set the total too. The patch is applied by the store so
+// that concurrent updates are not lost.
+func PatchCapacityHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		serviceID := chi.URLParam(r, "service_id")
+
+		var patch interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		members, ok := patch.(map[string]interface{})
+		if !ok {
+			http.Error(w, "merge patch must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		// Removing a count sets it to zero
+		for _, name := range []string{"total", "available"} {
+			if v, ok := members[name]; ok && v == nil {
+				members[name] = 0
+			}
+		}
+
+		update, err := applyMergePatch(capacityUpdate{}, patch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		capacity, err := store.UpdateCapacity(orgID, serviceID, storage.CapacityUpdate{Total: update.Total, Available: update.Available})
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrInvalidCapacity):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, storage.ErrNotFound):
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(capacity)
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	core "github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+// PostServiceHandler adds a service type to the catalog, e.g.
+// {"id": "3", "name": "Shower"} or {"id": "4", "name": "Family beds", "parent_id": "1"}.
+func PostServiceHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var svc core.Service
+		if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if svc.ID == "" || svc.Name == "" {
+			http.Error(w, "id and name are required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.CreateService(svc)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrServiceExists):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, storage.ErrUnknownService), errors.Is(err, storage.ErrServiceCycle):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(svc)
+	}
+}
+
+// PatchServiceHandler applies a JSON merge patch to a catalog service, to
+// rename it ({"name": "Shelter bed"}), deprecate it ({"deprecated": true}) or
+// move it to another category ({"parent_id": "1"}, null for top level).
+func PatchServiceHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceID := chi.URLParam(r, "service_id")
+
+		var patch interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			http.Error(w, "merge patch must be a JSON object", http.StatusBadRequest)
+			return
+		}
+
+		services, err := store.GetServicesByID([]string{serviceID})
+		if err != nil {
+			if errors.Is(err, storage.ErrUnknownService) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		patched, err := applyMergePatch(services[0], patch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if patched.ID != serviceID {
+			http.Error(w, "id cannot be changed", http.StatusBadRequest)
+			return
+		}
+		if patched.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		err = store.UpdateService(patched)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrNotFound):
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			case errors.Is(err, storage.ErrUnknownService), errors.Is(err, storage.ErrServiceCycle):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(patched)
+	}
+}
+
+// DeleteServiceHandler removes a service from the catalog. It answers 409
+// while organizations still offer the service or it has subcategories.
+func DeleteServiceHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceID := chi.URLParam(r, "service_id")
+
+		err := store.DeleteService(serviceID)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrNotFound):
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			case errors.Is(err, storage.ErrServiceInUse), errors.Is(err, storage.ErrServiceHasChildren):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// checkNotDeprecated rejects deprecated services that the organization does
+// not offer yet, so deprecation stops new associations without touching
+// existing ones. It writes the error response and returns false on failure.
+func checkNotDeprecated(w http.ResponseWriter, store storage.Store, orgID string, services []core.Service) bool {
+	offered, err := store.GetServicesByOrganizationID(orgID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	current := make(map[string]bool, len(offered))
+	for _, svc := range offered {
+		current[svc.ID] = true
+	}
+
+	for _, svc := range services {
+		if svc.Deprecated && !current[svc.ID] {
+			http.Error(w, "service "+svc.ID+" is deprecated", http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
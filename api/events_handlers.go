@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+)
+
+// eventKeepAlive is how often an idle event stream sends a comment, so
+// proxies do not close the connection.
+const eventKeepAlive = 15 * time.Second
+
+// eventOrganizationRemoved is sent instead of an update when the organization
+// matched a stream's filter before the update but no longer does.
+const eventOrganizationRemoved storage.EventType = "organization.removed"
+
+// eventFilter selects the events a stream receives.
+type eventFilter struct {
+	serviceIDs map[string]bool
+	box        *storage.BoundingBox
+}
+
+// parseEventFilter reads the event stream query parameters:
+//
+//	services  comma separated service IDs; only changes to organizations
+//	          offering any of them, or to their capacity
+//	bbox      west,south,east,north in degrees; only organizations inside
+func parseEventFilter(query url.Values) (eventFilter, error) {
+	var filter eventFilter
+	for _, ids := range query["services"] {
+		for _, id := range strings.Split(ids, ",") {
+			if id == "" {
+				continue
+			}
+			if filter.serviceIDs == nil {
+				filter.serviceIDs = make(map[string]bool)
+			}
+			filter.serviceIDs[id] = true
+		}
+	}
+
+	if v := query.Get("bbox"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return filter, errors.New("bbox must be west,south,east,north")
+		}
+		var edges [4]float64
+		for i, part := range parts {
+			n, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return filter, errors.New("bbox must be west,south,east,north")
+			}
+			edges[i] = n
+		}
+		box := storage.BoundingBox{MinLongitude: edges[0], MinLatitude: edges[1], MaxLongitude: edges[2], MaxLatitude: edges[3]}
+		if box.MinLatitude < -90 || box.MaxLatitude > 90 || box.MinLatitude > box.MaxLatitude {
+			return filter, errors.New("bbox latitudes must be between -90 and 90, south first")
+		}
+		if box.MinLongitude < -180 || box.MinLongitude > 180 || box.MaxLongitude < -180 || box.MaxLongitude > 180 {
+			return filter, errors.New("bbox longitudes must be between -180 and 180")
+		}
+		filter.box = &box
+	}
+	return filter, nil
+}
+
+// matches reports whether org, and serviceID for capacity changes, is
+// selected by the filter.
+func (f eventFilter) matches(org core.Organization, serviceID string) bool {
+	if f.box != nil && !f.box.Contains(org.Location) {
+		return false
+	}
+	if f.serviceIDs == nil {
+		return true
+	}
+	if serviceID != "" {
+		return f.serviceIDs[serviceID]
+	}
+	for _, svc := range org.Services {
+		if f.serviceIDs[svc.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns what a stream with the filter is sent for e, if anything.
+// An update is checked against the organization before and after it, so
+// that clients drop organizations leaving the filter.
+func (f eventFilter) route(e storage.Event) (storage.Event, bool) {
+	if f.matches(e.Organization, e.ServiceID) {
+		return e, true
+	}
+	if e.Type == storage.EventOrganizationUpdated && e.Previous != nil && f.matches(*e.Previous, "") {
+		e.Type = eventOrganizationRemoved
+		return e, true
+	}
+	return e, false
+}
+
+// StreamEventsHandler streams organization created, updated and deleted
+// events and capacity changes as Server-Sent Events, optionally filtered by
+// services and a bounding box. An organization updated out of the filter is
+// sent as organization.removed. Events come in the order of the changes. The
+// stream ends if the client falls too far behind; it should reconnect and
+// reload what it shows.
+func StreamEventsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseEventFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := store.Events().Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				e, ok = filter.route(e)
+				if !ok {
+					continue
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+				flusher.Flush()
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,929 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	mw "github.com/CTRL-Impact-Team4/khair-backend/api/middleware"
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRouter wires the handlers against a MemoryStore seeded with the default services
+func newTestRouter(t *testing.T) (*chi.Mux, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.InsertPredefinedServices([]core.Service{
+		{ID: "1", Name: "Bed"},
+		{ID: "2", Name: "Food"},
+	}))
+
+	r := chi.NewRouter()
+	// Requests not sent with doRequestAs are made with an administrator key
+	r.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if _, ok := key.FromContext(req.Context()); !ok {
+				req = req.WithContext(key.NewContext(req.Context(), testAdminKey))
+			}
+			h.ServeHTTP(w, req)
+		})
+	})
+	// Routes mounted on orgStaff in main.go are too, to test the organization checks
+	orgStaff := r.With(mw.RequireOrganization("org_id"))
+	r.Get("/orgs", ListOrgsHandler(store))
+	r.Post("/orgs", PostOrgsHandler(store))
+	r.Get("/orgs/{org_id}", GetOrgByID(store))
+	orgStaff.Put("/orgs/{org_id}", PutOrgByID(store))
+	orgStaff.Patch("/orgs/{org_id}", PatchOrgByID(store))
+	orgStaff.Delete("/orgs/{org_id}", DeleteOrgByID(store))
+	r.Get("/orgs/{org_id}/translations", GetOrgTranslationsHandler(store))
+	orgStaff.Put("/orgs/{org_id}/translations/{lang}", PutOrgTranslationHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/translations/{lang}", DeleteOrgTranslationHandler(store))
+	r.Get("/admin/orgs/archived", ListArchivedOrgsHandler(store))
+	r.Post("/admin/orgs/{org_id}/restore", RestoreOrgByID(store))
+	r.Get("/services", GetServices(store))
+	r.Post("/services", PostServiceHandler(store))
+	r.Patch("/services/{service_id}", PatchServiceHandler(store))
+	r.Delete("/services/{service_id}", DeleteServiceHandler(store))
+	r.Get("/services/{service_id}/translations", GetServiceTranslationsHandler(store))
+	r.Put("/services/{service_id}/translations/{lang}", PutServiceTranslationHandler(store))
+	r.Delete("/services/{service_id}/translations/{lang}", DeleteServiceTranslationHandler(store))
+	orgStaff.Post("/orgs/{org_id}/services", PostServicesByOrgIDHandler(store))
+	orgStaff.Put("/orgs/{org_id}/services", PutServicesByOrgIDHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/services/{service_id}", DeleteServiceByOrgIDHandler(store))
+	r.Get("/orgs/{org_id}/services", GetServicesByOrgIDHandler(store))
+	orgStaff.Put("/orgs/{org_id}/hours", PutOpeningHoursHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/hours", DeleteOpeningHoursHandler(store))
+	orgStaff.Put("/orgs/{org_id}/services/{service_id}/hours", PutOpeningHoursHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/services/{service_id}/hours", DeleteOpeningHoursHandler(store))
+	orgStaff.Patch("/orgs/{org_id}/services/{service_id}/capacity", PatchCapacityHandler(store))
+	r.Post("/orgs/{org_id}/services/{service_id}/holds", PostHoldHandler(store))
+	r.Get("/holds/{hold_id}", GetHoldHandler(store))
+	orgStaff.Get("/orgs/{org_id}/holds", ListOrgHoldsHandler(store))
+	orgStaff.Post("/orgs/{org_id}/holds/{hold_id}/confirm", ConfirmHoldHandler(store))
+	r.Post("/holds/{hold_id}/release", ReleaseHoldHandler(store))
+	orgStaff.Post("/orgs/{org_id}/referrals", PostReferralHandler(store))
+	orgStaff.Get("/orgs/{org_id}/referrals", ListOrgReferralsHandler(store))
+	orgStaff.Get("/orgs/{org_id}/referrals/{referral_id}", GetReferralHandler(store))
+	orgStaff.Patch("/orgs/{org_id}/referrals/{referral_id}", PatchReferralHandler(store))
+	r.Get("/services/nearest", GetNearestOrganizationHandler(store))
+	r.Post("/search", GetNearestOrganizationHandler(store))
+	r.Get("/events", StreamEventsHandler(store))
+	return r, store
+}
+
+func doRequest(r http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// capacitySetTo is the update setting both the total and available units.
+func capacitySetTo(total, available int) storage.CapacityUpdate {
+	return storage.CapacityUpdate{Total: &total, Available: &available}
+}
+
+// testAdminKey authenticates the requests of doRequest.
+var testAdminKey = key.Key{ID: "key_admin", Scopes: key.AllScopes}
+
+// doRequestAs is doRequest authenticated with k.
+func doRequestAs(r http.Handler, k key.Key, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(key.NewContext(req.Context(), k))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOrganizationLifecycle(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	rec := doRequest(r, http.MethodPost, "/orgs", `{"id":"org1","name":"Org One","location":{"latitude":1,"longitude":2}}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = doRequest(r, http.MethodPost, "/orgs/org1/services", `["1","2"]`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(r, http.MethodGet, "/orgs/org1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var org core.Organization
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &org))
+	assert.Equal(t, "Org One", org.Name)
+	assert.Len(t, org.Services, 2)
+
+	rec = doRequest(r, http.MethodDelete, "/orgs/org1", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = doRequest(r, http.MethodGet, "/orgs/org1", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGetNearestOrganization(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "near", Location: core.Location{Latitude: 40.7, Longitude: -74.0}}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "far", Location: core.Location{Latitude: 34.0, Longitude: -118.2}}))
+	require.NoError(t, store.AddServicesToOrganization("near", []string{"1"}))
+	require.NoError(t, store.AddServicesToOrganization("far", []string{"1"}))
+
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "middle", Location: core.Location{Latitude: 41.9, Longitude: -87.6}}))
+	require.NoError(t, store.AddServicesToOrganization("middle", []string{"1"}))
+
+	rec := doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":40.0,"longitude":-75.0}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := decodeNearestPage(t, rec)
+	assert.Equal(t, []string{"near", "middle", "far"}, page.ids)
+	assert.Empty(t, page.NextCursor)
+
+	// Page through the results two at a time
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":40.0,"longitude":-75.0,"limit":2}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page = decodeNearestPage(t, rec)
+	assert.Equal(t, []string{"near", "middle"}, page.ids)
+	require.NotEmpty(t, page.NextCursor)
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":40.0,"longitude":-75.0,"limit":2,"cursor":"`+page.NextCursor+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page = decodeNearestPage(t, rec)
+	assert.Equal(t, []string{"far"}, page.ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":40.0,"longitude":-75.0,"radius_km":1500}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"near", "middle"}, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":40.0,"longitude":-75.0,"radius_km":1}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"cursor":"nope"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["9"],"latitude":40.0,"longitude":-75.0}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestNearestQueryString(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "near", Location: core.Location{Latitude: 40.7, Longitude: -74.0}}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "far", Location: core.Location{Latitude: 34.0, Longitude: -118.2}}))
+	require.NoError(t, store.AddServicesToOrganization("near", []string{"1", "2"}))
+	require.NoError(t, store.AddServicesToOrganization("far", []string{"1"}))
+
+	rec := doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"near", "far"}, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1,2", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"near"}, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1,2&match=any&limit=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := decodeNearestPage(t, rec)
+	assert.Equal(t, []string{"near"}, page.ids)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1,2&match=any&limit=1&cursor="+page.NextCursor, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"far"}, decodeNearestPage(t, rec).ids)
+
+	for _, target := range []string{
+		"/services/nearest?lat=91&lon=0&services=1",
+		"/services/nearest?lat=0&lon=-180.5&services=1",
+		"/services/nearest?lat=abc&lon=0&services=1",
+		"/services/nearest?lat=NaN&lon=0&services=1",
+		"/services/nearest?lon=0&services=1",
+		"/services/nearest?lat=0&lon=0",
+		"/services/nearest?lat=0&lon=0&services=1&limit=x",
+	} {
+		rec = doRequest(r, http.MethodGet, target, "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":-90.5,"longitude":0}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// POST /search takes the same search as a JSON body
+	rec = doRequest(r, http.MethodPost, "/search", `{"services":["1","2"],"latitude":40.0,"longitude":-75.0,"match":"at_least","min_matches":1}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"near", "far"}, decodeNearestPage(t, rec).ids)
+}
+
+type decodedNearestPage struct {
+	Organizations []organizationWithDistance `json:"organizations"`
+	NextCursor    string                     `json:"next_cursor"`
+	ids           []string
+}
+
+func decodeNearestPage(t *testing.T, rec *httptest.ResponseRecorder) decodedNearestPage {
+	var page decodedNearestPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	for _, org := range page.Organizations {
+		page.ids = append(page.ids, org.ID)
+	}
+	return page
+}
+
+func TestUpdateOrganization(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org1", Name: "Org One", Phone: "123", Location: core.Location{Latitude: 1, Longitude: 2}}))
+	require.NoError(t, store.AddServicesToOrganization("org1", []string{"1"}))
+
+	rec := doRequest(r, http.MethodPut, "/orgs/missing", `{"name":"Nobody"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(r, http.MethodPut, "/orgs/org1", `{"id":"org2","name":"Org Two"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(r, http.MethodPut, "/orgs/org1", `{"name":"Renamed","location":{"latitude":3,"longitude":4}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var org core.Organization
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &org))
+	assert.Equal(t, core.Organization{
+		ID: "org1", Name: "Renamed",
+		Location: core.Location{Latitude: 3, Longitude: 4},
+		Services: []core.Service{{ID: "1", Name: "Bed"}},
+	}, org)
+
+	rec = doRequest(r, http.MethodPatch, "/orgs/org1", `{"phone":"555","location":{"longitude":5}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	org, err := store.GetOrganizationByID("org1")
+	require.NoError(t, err)
+	assert.Equal(t, core.Organization{
+		ID: "org1", Name: "Renamed", Phone: "555",
+		Location: core.Location{Latitude: 3, Longitude: 5},
+	}, org)
+
+	rec = doRequest(r, http.MethodPatch, "/orgs/org1", `{"phone":null}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	org, _ = store.GetOrganizationByID("org1")
+	assert.Equal(t, "", org.Phone)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPatch, "/orgs/org1", `{"id":"org2"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPatch, "/orgs/org1", `["name"]`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPatch, "/orgs/missing", `{}`).Code)
+}
+
+func TestListOrganizations(t *testing.T) {
+	r, store := newTestRouter(t)
+	for _, name := range []string{"Delta Shelter", "alpha Kitchen", "Charlie Shelter", "Bravo Pantry"} {
+		id := strings.ToLower(strings.Fields(name)[0])
+		require.NoError(t, store.CreateOrganization(core.Organization{ID: id, Name: name}))
+	}
+	require.NoError(t, store.AddServicesToOrganization("charlie", []string{"1"}))
+	require.NoError(t, store.AddServicesToOrganization("delta", []string{"1", "2"}))
+
+	list := func(target string) storage.OrganizationPage {
+		rec := doRequest(r, http.MethodGet, target, "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var page storage.OrganizationPage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		return page
+	}
+	ids := func(page storage.OrganizationPage) []string {
+		var ids []string
+		for _, org := range page.Organizations {
+			ids = append(ids, org.ID)
+		}
+		return ids
+	}
+
+	page := list("/orgs?limit=3")
+	assert.Equal(t, []string{"alpha", "bravo", "charlie"}, ids(page), "names sort ignoring case")
+	require.NotEmpty(t, page.NextCursor)
+	page = list("/orgs?limit=3&cursor=" + page.NextCursor)
+	assert.Equal(t, []string{"delta"}, ids(page))
+	assert.Empty(t, page.NextCursor)
+
+	page = list("/orgs?sort=-name&name=shelter")
+	assert.Equal(t, []string{"delta", "charlie"}, ids(page))
+	assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}, {ID: "2", Name: "Food"}}, page.Organizations[0].Services)
+
+	page = list("/orgs?service_id=1,2")
+	assert.Equal(t, []string{"delta"}, ids(page))
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/orgs?sort=phone", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/orgs?cursor=bogus", "").Code)
+}
+
+func TestArchiveAndRestoreOrganization(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org1", Name: "Org One"}))
+	require.NoError(t, store.AddServicesToOrganization("org1", []string{"1"}))
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodDelete, "/orgs/org1?mode=shred", "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/orgs/org1?mode=archive", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/orgs/org1", "").Code)
+
+	rec := doRequest(r, http.MethodGet, "/admin/orgs/archived", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"id":"org1"`)
+
+	rec = doRequest(r, http.MethodPost, "/admin/orgs/org1/restore", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var org core.Organization
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &org))
+	assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}}, org.Services)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/admin/orgs/org1/restore", "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/orgs/org1", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/admin/orgs/org1/restore", "").Code)
+}
+
+func TestManageOrganizationServices(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org1", Name: "Org One"}))
+
+	// Re-adding an associated service is not an error
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPost, "/orgs/org1/services", `["1"]`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPost, "/orgs/org1/services", `["1","2"]`).Code)
+	services, _ := store.GetServicesByOrganizationID("org1")
+	assert.Len(t, services, 2)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/orgs/org1/services/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/orgs/org1/services/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/orgs/missing/services/2", "").Code)
+
+	// A failed replace leaves the current set untouched
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPut, "/orgs/org1/services", `["1","9"]`).Code)
+	services, _ = store.GetServicesByOrganizationID("org1")
+	assert.Equal(t, []core.Service{{ID: "2", Name: "Food"}}, services)
+
+	rec := doRequest(r, http.MethodPut, "/orgs/org1/services", `["1"]`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	services, _ = store.GetServicesByOrganizationID("org1")
+	assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}}, services)
+
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPut, "/orgs/org1/services", `[]`).Code)
+	services, _ = store.GetServicesByOrganizationID("org1")
+	assert.Empty(t, services)
+}
+
+func TestServiceCatalogAdmin(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org1", Name: "Org One"}))
+
+	assert.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/services", `{"id":"3","name":"Shower"}`).Code)
+	assert.Equal(t, http.StatusConflict, doRequest(r, http.MethodPost, "/services", `{"id":"3","name":"Shower"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/services", `{"id":"4"}`).Code)
+
+	rec := doRequest(r, http.MethodPatch, "/services/3", `{"name":"Showers"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id":"3","name":"Showers"}`, rec.Body.String())
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPatch, "/services/9", `{"name":"x"}`).Code)
+
+	// Deleting is blocked while an organization offers the service
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodPost, "/orgs/org1/services", `["3"]`).Code)
+	assert.Equal(t, http.StatusConflict, doRequest(r, http.MethodDelete, "/services/3", "").Code)
+
+	// Deprecated services are kept where offered but cannot be newly added
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodPatch, "/services/3", `{"deprecated":true}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPut, "/orgs/org1/services", `["1","3"]`).Code)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org2", Name: "Org Two"}))
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/orgs/org2/services", `["3"]`).Code)
+
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodPut, "/orgs/org1/services", `["1"]`).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/services/3", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/services/3", "").Code)
+}
+
+func TestServiceTree(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateService(core.Service{ID: "3", Name: "Family beds", ParentID: "1"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org1", Name: "Org One"}))
+	require.NoError(t, store.AddServicesToOrganization("org1", []string{"3"}))
+
+	rec := doRequest(r, http.MethodGet, "/services?tree=true", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[
+		{"id":"1","name":"Bed","children":[{"id":"3","name":"Family beds","parent_id":"1"}]},
+		{"id":"2","name":"Food"}
+	]`, rec.Body.String())
+
+	// The flat list stays the default for existing clients
+	rec = doRequest(r, http.MethodGet, "/services", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var services []core.Service
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &services))
+	assert.Len(t, services, 3)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, decodeNearestPage(t, rec).ids)
+
+	// Only the services under the requested category are listed
+	require.NoError(t, store.AddServicesToOrganization("org1", []string{"2"}))
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"include_subcategories":true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := decodeNearestPage(t, rec)
+	require.Equal(t, []string{"org1"}, page.ids)
+	assert.Equal(t, []core.Service{{ID: "3", Name: "Family beds", ParentID: "1"}}, page.Organizations[0].Services)
+}
+
+func TestTranslations(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "org1", Name: "Shelter", Description: "Beds for the night"}))
+	require.NoError(t, store.AddServicesToOrganization("org1", []string{"1"}))
+
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPut, "/services/1/translations/fr", `{"name":"Lit"}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPut, "/services/9/translations/fr", `{"name":"Lit"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPut, "/services/1/translations/f_r", `{"name":"Lit"}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPut, "/orgs/org1/translations/FR", `{"description":"Des lits pour la nuit"}`).Code)
+
+	rec := doRequest(r, http.MethodGet, "/orgs/org1/translations", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"fr":{"description":"Des lits pour la nuit"}}`, rec.Body.String())
+
+	get := func(target, acceptLanguage string) core.Organization {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var org core.Organization
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &org))
+		return org
+	}
+
+	// Regional tags fall back to their language; the name has no translation
+	org := get("/orgs/org1", "fr-CA, en;q=0.8")
+	assert.Equal(t, "Shelter", org.Name)
+	assert.Equal(t, "Des lits pour la nuit", org.Description)
+	assert.Equal(t, "Lit", org.Services[0].Name)
+
+	// The default language ranked first wins over translations
+	org = get("/orgs/org1", "en, fr;q=0.5")
+	assert.Equal(t, "Beds for the night", org.Description)
+
+	// lang overrides the header; unknown languages fall back to the default
+	org = get("/orgs/org1?lang=ar", "fr")
+	assert.Equal(t, "Beds for the night", org.Description)
+	assert.Equal(t, "Bed", org.Services[0].Name)
+
+	rec = doRequest(r, http.MethodGet, "/services?lang=fr", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"id":"1","name":"Lit"},{"id":"2","name":"Food"}]`, rec.Body.String())
+
+	// Nearest results are translated too
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=0&lon=0&services=1&lang=fr", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description":"Des lits pour la nuit"`)
+	assert.Contains(t, rec.Body.String(), `"name":"Lit"`)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/services/1/translations/fr", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/services/1/translations/fr", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodDelete, "/services/1/translations/f_r", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodDelete, "/orgs/org1/translations/f_r", "").Code)
+}
+
+func TestNearestMatchModes(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "beds", Location: core.Location{Latitude: 40.1, Longitude: -75.0}}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "both", Location: core.Location{Latitude: 41.0, Longitude: -75.0}}))
+	require.NoError(t, store.AddServicesToOrganization("beds", []string{"1"}))
+	require.NoError(t, store.AddServicesToOrganization("both", []string{"1", "2"}))
+
+	rec := doRequest(r, http.MethodGet, "/services/nearest", `{"services":["2","1"],"latitude":40.0,"longitude":-75.0}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := decodeNearestPage(t, rec)
+	require.Equal(t, []string{"both"}, page.ids)
+	assert.Equal(t, []string{"2", "1"}, page.Organizations[0].MatchedServices)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["2","1"],"latitude":40.0,"longitude":-75.0,"match":"any"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page = decodeNearestPage(t, rec)
+	require.Equal(t, []string{"beds", "both"}, page.ids)
+	assert.Equal(t, []string{"1"}, page.Organizations[0].MatchedServices)
+	assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}}, page.Organizations[0].Services)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["2","1"],"latitude":40.0,"longitude":-75.0,"match":"at_least","min_matches":2}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"both"}, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["2","1"],"match":"at_least","min_matches":3}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["2","1"],"match":"some"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestOpeningHours(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "shelter", Location: core.Location{Latitude: 40.1, Longitude: -75.0}}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "pantry", Location: core.Location{Latitude: 40.2, Longitude: -75.0}}))
+	require.NoError(t, store.AddServicesToOrganization("shelter", []string{"1", "2"}))
+	require.NoError(t, store.AddServicesToOrganization("pantry", []string{"2"}))
+
+	rec := doRequest(r, http.MethodPut, "/orgs/shelter/hours", `{
+		"time_zone": "America/New_York",
+		"weekly": [{"day": "friday", "opens": "18:00", "closes": "08:00"}],
+		"exceptions": [{"date": "2024-12-27", "description": "Closed for the holidays"}]
+	}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(r, http.MethodPut, "/orgs/shelter/services/2/hours", `{"time_zone": "America/New_York", "weekly": [{"day": "friday", "opens": "18:00", "closes": "19:00"}]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(r, http.MethodPut, "/orgs/pantry/hours", `{"time_zone": "America/New_York", "weekly": [{"day": "friday", "opens": "09:00", "closes": "17:00"}]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(r, http.MethodPut, "/orgs/shelter/hours", `{"time_zone": "America/New_York", "weekly": [{"day": "fri", "opens": "18:00", "closes": "08:00"}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodPut, "/orgs/pantry/services/1/hours", `{"time_zone": "UTC"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doRequest(r, http.MethodGet, "/orgs/shelter", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var org core.Organization
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &org))
+	require.NotNil(t, org.Hours)
+	assert.Equal(t, "America/New_York", org.Hours.TimeZone)
+	assert.Equal(t, []core.OpeningException{{Date: "2024-12-27", Description: "Closed for the holidays"}}, org.Hours.Exceptions)
+	assert.Equal(t, "19:00", org.ServiceHours["2"].Weekly[0].Closes)
+
+	// Friday 2024-12-20 at 18:30 and 20:00 in New York
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1,2&match=any&open_at=2024-12-20T18:30:00-05:00", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := decodeNearestPage(t, rec)
+	require.Equal(t, []string{"shelter"}, page.ids)
+	assert.Equal(t, []string{"1", "2"}, page.Organizations[0].MatchedServices)
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1","2"],"latitude":40,"longitude":-75,"match":"any","open_at":"2024-12-21T01:00:00Z"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page = decodeNearestPage(t, rec)
+	require.Equal(t, []string{"shelter"}, page.ids)
+	assert.Equal(t, []string{"1"}, page.Organizations[0].MatchedServices)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=2&open_at=2024-12-20T10:00:00-05:00", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"pantry"}, decodeNearestPage(t, rec).ids)
+	// The holiday exception
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&open_at=2024-12-27T20:00:00-05:00", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&open_at=tonight", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&open_now=true&open_at=2024-12-20T10:00:00Z", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&open_now=true", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// Open searches say how far they reached unless the radius was asked for
+	assert.Contains(t, rec.Body.String(), `"radius_km":1000`)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&open_now=true&radius_km=50", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), `"radius_km"`)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&open_now=true&radius_km=5000", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/orgs/shelter/services/2/hours", "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/orgs/shelter/hours", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/orgs/shelter/hours", "").Code)
+}
+
+func TestCapacity(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "full", Location: core.Location{Latitude: 40.1, Longitude: -75.0}}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "free", Location: core.Location{Latitude: 40.2, Longitude: -75.0}}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "unknown", Location: core.Location{Latitude: 40.0, Longitude: -75.0}}))
+	require.NoError(t, store.AddServicesToOrganization("full", []string{"1"}))
+	require.NoError(t, store.AddServicesToOrganization("free", []string{"1", "2"}))
+	require.NoError(t, store.AddServicesToOrganization("unknown", []string{"1"}))
+
+	// The first update needs the total
+	rec := doRequest(r, http.MethodPatch, "/orgs/free/services/1/capacity", `{"available": 3}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodPatch, "/orgs/free/services/1/capacity", `{}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodPatch, "/orgs/free/services/1/capacity", `{"total": 20, "available": 3}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(r, http.MethodPatch, "/orgs/full/services/1/capacity", `{"total": 10, "available": 1}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(r, http.MethodPatch, "/orgs/full/services/1/capacity", `{"available": 0}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var capacity core.Capacity
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &capacity))
+	assert.Equal(t, 10, capacity.Total)
+	assert.Equal(t, 0, capacity.Available)
+	assert.WithinDuration(t, time.Now(), capacity.UpdatedAt, time.Minute)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPatch, "/orgs/full/services/1/capacity", `{"available": 11}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPatch, "/orgs/full/services/1/capacity", `[]`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPatch, "/orgs/full/services/2/capacity", `{"total": 1}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPatch, "/orgs/missing/services/1/capacity", `{"total": 1}`).Code)
+
+	// Only the organization's staff update its capacity
+	fullStaff := key.Key{ID: "key_full", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "full"}
+	assert.Equal(t, http.StatusForbidden, doRequestAs(r, fullStaff, http.MethodPatch, "/orgs/free/services/1/capacity", `{"available": 0}`).Code)
+	assert.Equal(t, http.StatusOK, doRequestAs(r, fullStaff, http.MethodPatch, "/orgs/full/services/1/capacity", `{"available": 0}`).Code)
+
+	rec = doRequest(r, http.MethodGet, "/orgs/free", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var org core.Organization
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &org))
+	require.NotNil(t, org.Services[0].Capacity)
+	assert.Equal(t, 3, org.Services[0].Capacity.Available)
+	assert.Nil(t, org.Services[1].Capacity)
+
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"unknown", "full", "free"}, decodeNearestPage(t, rec).ids)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&available=true", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := decodeNearestPage(t, rec)
+	require.Equal(t, []string{"free"}, page.ids)
+	require.NotNil(t, page.Organizations[0].Services[0].Capacity)
+	assert.Equal(t, 3, page.Organizations[0].Services[0].Capacity.Available)
+	rec = doRequest(r, http.MethodGet, "/services/nearest", `{"services":["1"],"latitude":40,"longitude":-75,"available":true,"updated_within":"1ns"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, decodeNearestPage(t, rec).ids)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=40&lon=-75&services=1&available=true&updated_within=soon", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHolds(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "shelter"}))
+	require.NoError(t, store.AddServicesToOrganization("shelter", []string{"1", "2"}))
+	_, err := store.UpdateCapacity("shelter", "1", capacitySetTo(5, 1))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/orgs/shelter/services/1/holds", `{"duration":"12h"}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/orgs/missing/services/1/holds", "").Code)
+	assert.Equal(t, http.StatusConflict, doRequest(r, http.MethodPost, "/orgs/shelter/services/2/holds", "").Code)
+
+	rec := doRequest(r, http.MethodPost, "/orgs/shelter/services/1/holds", `{"duration":"45m","reference":"case-7"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var hold core.Hold
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hold))
+	assert.Equal(t, core.HoldHeld, hold.Status)
+	assert.WithinDuration(t, time.Now().Add(45*time.Minute), hold.ExpiresAt, time.Minute)
+
+	// The last bed is taken
+	rec = doRequest(r, http.MethodPost, "/orgs/shelter/services/1/holds", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doRequest(r, http.MethodGet, "/services/nearest?lat=0&lon=0&services=1&available=true", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, decodeNearestPage(t, rec).ids)
+
+	rec = doRequest(r, http.MethodGet, "/holds/"+hold.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"reference":"case-7"`)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/holds/hold_missing", "").Code)
+
+	rec = doRequest(r, http.MethodGet, "/orgs/shelter/holds?status=held", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var holds []core.Hold
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &holds))
+	require.Len(t, holds, 1)
+	assert.Equal(t, hold.ID, holds[0].ID)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/orgs/shelter/holds?status=gone", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/orgs/missing/holds", "").Code)
+
+	rec = doRequest(r, http.MethodPost, "/holds/"+hold.ID+"/release", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"released"`)
+	assert.Equal(t, http.StatusConflict, doRequest(r, http.MethodPost, "/orgs/shelter/holds/"+hold.ID+"/confirm", "").Code)
+
+	rec = doRequest(r, http.MethodPost, "/orgs/shelter/services/1/holds", "")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hold))
+	rec = doRequest(r, http.MethodPost, "/orgs/shelter/holds/"+hold.ID+"/confirm", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"confirmed"`)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/holds/hold_missing/release", "").Code)
+}
+
+func TestOrganizationWriteAccess(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "shelter", Name: "Shelter"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "pantry", Name: "Pantry"}))
+
+	pantryStaff := key.Key{ID: "key_pantry", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "pantry"}
+	unbound := key.Key{ID: "key_intake", Scopes: []string{key.ScopeOrgsWrite}}
+
+	for _, k := range []key.Key{pantryStaff, unbound} {
+		for _, req := range []struct{ method, target, body string }{
+			{http.MethodPut, "/orgs/shelter", `{"name":"Taken"}`},
+			{http.MethodPatch, "/orgs/shelter", `{"name":"Taken"}`},
+			{http.MethodDelete, "/orgs/shelter", ""},
+			{http.MethodPut, "/orgs/shelter/translations/fr", `{"name":"Pris"}`},
+			{http.MethodPost, "/orgs/shelter/services", `["1"]`},
+			{http.MethodPut, "/orgs/shelter/services", `["1"]`},
+			{http.MethodPut, "/orgs/shelter/hours", `{"time_zone":"UTC"}`},
+		} {
+			assert.Equal(t, http.StatusForbidden, doRequestAs(r, k, req.method, req.target, req.body).Code, "%s %s %s", k.ID, req.method, req.target)
+		}
+	}
+
+	// Keys without an organization may still create organizations
+	assert.Equal(t, http.StatusCreated, doRequestAs(r, unbound, http.MethodPost, "/orgs", `{"id":"clinic","name":"Clinic"}`).Code)
+	rec := doRequestAs(r, pantryStaff, http.MethodPatch, "/orgs/pantry", `{"name":"Food Pantry"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	org, err := store.GetOrganizationByID("shelter")
+	require.NoError(t, err)
+	assert.Equal(t, "Shelter", org.Name)
+}
+
+func TestHoldAccess(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "shelter"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "pantry"}))
+	require.NoError(t, store.AddServicesToOrganization("shelter", []string{"1"}))
+	_, err := store.UpdateCapacity("shelter", "1", capacitySetTo(5, 5))
+	require.NoError(t, err)
+
+	placer := key.Key{ID: "key_placer", Scopes: []string{key.ScopeHoldsWrite}}
+	otherPlacer := key.Key{ID: "key_other", Scopes: []string{key.ScopeHoldsWrite}}
+	shelterStaff := key.Key{ID: "key_shelter", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "shelter"}
+	pantryStaff := key.Key{ID: "key_pantry", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "pantry"}
+
+	place := func() core.Hold {
+		rec := doRequestAs(r, placer, http.MethodPost, "/orgs/shelter/services/1/holds", `{"reference":"case-7"}`)
+		require.Equal(t, http.StatusCreated, rec.Code)
+		var hold core.Hold
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hold))
+		return hold
+	}
+
+	// Other callers cannot tell the hold exists
+	hold := place()
+	for _, k := range []key.Key{otherPlacer, pantryStaff} {
+		assert.Equal(t, http.StatusNotFound, doRequestAs(r, k, http.MethodGet, "/holds/"+hold.ID, "").Code, k.ID)
+		assert.Equal(t, http.StatusForbidden, doRequestAs(r, k, http.MethodPost, "/orgs/shelter/holds/"+hold.ID+"/confirm", "").Code, k.ID)
+		assert.Equal(t, http.StatusNotFound, doRequestAs(r, k, http.MethodPost, "/holds/"+hold.ID+"/release", "").Code, k.ID)
+	}
+	assert.Equal(t, http.StatusNotFound, doRequestAs(r, pantryStaff, http.MethodPost, "/orgs/pantry/holds/"+hold.ID+"/confirm", "").Code)
+
+	// The placer sees and releases its hold but only staff confirm it
+	rec := doRequestAs(r, placer, http.MethodGet, "/holds/"+hold.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"reference":"case-7"`)
+	assert.Equal(t, http.StatusForbidden, doRequestAs(r, placer, http.MethodPost, "/orgs/shelter/holds/"+hold.ID+"/confirm", "").Code)
+	rec = doRequestAs(r, placer, http.MethodPost, "/holds/"+hold.ID+"/release", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"released"`)
+
+	hold = place()
+	assert.Equal(t, http.StatusOK, doRequestAs(r, shelterStaff, http.MethodGet, "/holds/"+hold.ID, "").Code)
+	rec = doRequestAs(r, shelterStaff, http.MethodPost, "/orgs/shelter/holds/"+hold.ID+"/confirm", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"confirmed"`)
+
+	// The placer loses access with holds:write
+	hold = place()
+	placer.Scopes = nil
+	assert.Equal(t, http.StatusNotFound, doRequestAs(r, placer, http.MethodGet, "/holds/"+hold.ID, "").Code)
+	assert.Equal(t, http.StatusOK, doRequestAs(r, shelterStaff, http.MethodPost, "/holds/"+hold.ID+"/release", "").Code)
+}
+
+func TestReferrals(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "clinic"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "shelter"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "pantry"}))
+	require.NoError(t, store.AddServicesToOrganization("shelter", []string{"1"}))
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/orgs/clinic/referrals", `{"service_id":"1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/orgs/clinic/referrals", `{"to_organization_id":"pantry","service_id":"1"}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/orgs/missing/referrals", `{"to_organization_id":"shelter","service_id":"1"}`).Code)
+
+	rec := doRequest(r, http.MethodPost, "/orgs/clinic/referrals", `{"to_organization_id":"shelter","service_id":"1","notes":"discharged today"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var referral core.Referral
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &referral))
+	assert.Equal(t, "clinic", referral.FromOrganizationID)
+	assert.Equal(t, core.ReferralPending, referral.Status)
+
+	list := func(target string) []core.Referral {
+		rec := doRequest(r, http.MethodGet, target, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var referrals []core.Referral
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &referrals))
+		return referrals
+	}
+	assert.Len(t, list("/orgs/shelter/referrals?direction=received&status=pending"), 1)
+	assert.Empty(t, list("/orgs/shelter/referrals?direction=sent"))
+	assert.Empty(t, list("/orgs/pantry/referrals"))
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/orgs/shelter/referrals?direction=up", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/orgs/shelter/referrals?status=lost", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/orgs/missing/referrals", "").Code)
+
+	target := "/orgs/shelter/referrals/" + referral.ID
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodGet, target, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/orgs/pantry/referrals/"+referral.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPatch, "/orgs/pantry/referrals/"+referral.ID, `{"status":"declined"}`).Code)
+
+	// The referring side cannot accept its own referral
+	assert.Equal(t, http.StatusConflict, doRequest(r, http.MethodPatch, "/orgs/clinic/referrals/"+referral.ID, `{"status":"accepted"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPatch, target, `{"status":"lost"}`).Code)
+
+	rec = doRequest(r, http.MethodPatch, target, `{"status":"accepted","notes":"bed 4"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &referral))
+	assert.Equal(t, core.ReferralAccepted, referral.Status)
+	assert.Equal(t, "discharged today", referral.Notes)
+	assert.Equal(t, "bed 4", referral.ResponseNotes)
+
+	rec = doRequest(r, http.MethodPatch, "/orgs/clinic/referrals/"+referral.ID, `{"status":"completed"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"completed"`)
+	assert.Equal(t, http.StatusConflict, doRequest(r, http.MethodPatch, target, `{"status":"declined"}`).Code)
+}
+
+func TestReferralAccess(t *testing.T) {
+	r, store := newTestRouter(t)
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "clinic"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "shelter"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "pantry"}))
+	require.NoError(t, store.AddServicesToOrganization("shelter", []string{"1"}))
+
+	clinicStaff := key.Key{ID: "key_clinic", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "clinic"}
+	shelterStaff := key.Key{ID: "key_shelter", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "shelter"}
+	pantryStaff := key.Key{ID: "key_pantry", Scopes: []string{key.ScopeOrgsWrite}, OrganizationID: "pantry"}
+	unbound := key.Key{ID: "key_unbound", Scopes: []string{key.ScopeOrgsWrite}}
+
+	rec := doRequestAs(r, clinicStaff, http.MethodPost, "/orgs/clinic/referrals", `{"to_organization_id":"shelter","service_id":"1","notes":"discharged today"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var referral core.Referral
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &referral))
+
+	// Keys of other organizations cannot act for either side
+	target := "/orgs/shelter/referrals/" + referral.ID
+	for _, k := range []key.Key{pantryStaff, unbound, clinicStaff} {
+		assert.Equal(t, http.StatusForbidden, doRequestAs(r, k, http.MethodGet, "/orgs/shelter/referrals", "").Code, k.ID)
+		assert.Equal(t, http.StatusForbidden, doRequestAs(r, k, http.MethodGet, target, "").Code, k.ID)
+		assert.Equal(t, http.StatusForbidden, doRequestAs(r, k, http.MethodPatch, target, `{"status":"accepted","notes":"bed 4"}`).Code, k.ID)
+	}
+	assert.Equal(t, http.StatusForbidden, doRequestAs(r, pantryStaff, http.MethodPost, "/orgs/clinic/referrals", `{"to_organization_id":"shelter","service_id":"1"}`).Code)
+
+	// The referring organization cannot accept its own referral
+	assert.Equal(t, http.StatusConflict, doRequestAs(r, clinicStaff, http.MethodPatch, "/orgs/clinic/referrals/"+referral.ID, `{"status":"accepted"}`).Code)
+	rec = doRequestAs(r, shelterStaff, http.MethodPatch, target, `{"status":"accepted","notes":"bed 4"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"response_notes":"bed 4"`)
+}
+
+func TestStreamEvents(t *testing.T) {
+	r, store := newTestRouter(t)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events?services=1&bbox=-80,35,-70,45", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "inside", Location: core.Location{Latitude: 40.0, Longitude: -75.0}}))
+	require.NoError(t, store.AddServicesToOrganization("inside", []string{"1", "2"}))
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "outside", Location: core.Location{Latitude: 10.0, Longitude: 10.0}}))
+	require.NoError(t, store.AddServicesToOrganization("outside", []string{"1"}))
+	_, err = store.UpdateCapacity("inside", "2", capacitySetTo(10, 5))
+	require.NoError(t, err)
+	_, err = store.UpdateCapacity("inside", "1", capacitySetTo(10, 5))
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteOrganizationByID("inside"))
+	// Organizations updated out of the filter are removed
+	require.NoError(t, store.CreateOrganization(core.Organization{ID: "mover", Location: core.Location{Latitude: 40.0, Longitude: -75.0}}))
+	require.NoError(t, store.AddServicesToOrganization("mover", []string{"1"}))
+	require.NoError(t, store.ReplaceOrganizationServices("mover", []string{"2"}))
+	require.NoError(t, store.AddServicesToOrganization("mover", []string{"1"}))
+	require.NoError(t, store.UpdateOrganization(core.Organization{ID: "mover", Location: core.Location{Latitude: 10.0, Longitude: 10.0}}))
+
+	var types []string
+	var events []storage.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 7 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			types = append(types, strings.TrimPrefix(line, "event: "))
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var e storage.Event
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e))
+			events = append(events, e)
+		}
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, []string{
+		"organization.updated", "capacity.changed", "organization.deleted",
+		"organization.updated", "organization.removed", "organization.updated", "organization.removed",
+	}, types)
+	require.Len(t, events, 7)
+	assert.Equal(t, "inside", events[0].Organization.ID)
+	assert.Equal(t, "1", events[1].ServiceID)
+	assert.Equal(t, 5, events[1].Capacity.Available)
+	assert.Less(t, events[1].ID, events[2].ID)
+	assert.Equal(t, "mover", events[4].Organization.ID)
+	assert.Equal(t, "mover", events[6].Organization.ID)
+
+	rec := doRequest(r, http.MethodGet, "/events?bbox=1,2,3", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(r, http.MethodGet, "/events?bbox=-80,45,-70,35", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
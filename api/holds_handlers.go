@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// DefaultHoldDuration is how long a hold lasts when the request does not say.
+	DefaultHoldDuration = 30 * time.Minute
+	// MaxHoldDuration keeps units from being held out of availability for long.
+	MaxHoldDuration = 4 * time.Hour
+)
+
+// holdRequest is the body of a new hold; both fields are optional.
+type holdRequest struct {
+	// Duration is how long the unit is held, e.g. "45m".
+	Duration  string `json:"duration"`
+	Reference string `json:"reference"`
+}
+
+// writeHold encodes a hold with status, mapping hold errors to responses.
+func writeHold(w http.ResponseWriter, hold core.Hold, err error, status int) {
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case errors.Is(err, storage.ErrNoCapacity), errors.Is(err, storage.ErrHoldNotActive):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(hold)
+}
+
+// canManageHold reports whether the caller may see and release hold: the
+// key that placed it, if still allowed to place holds, or staff of its
+// organization with orgs:write.
+func canManageHold(r *http.Request, hold core.Hold) bool {
+	k, ok := key.FromContext(r.Context())
+	if !ok {
+		return false
+	}
+	if hold.PlacedBy != "" && hold.PlacedBy == k.ID && k.HasScope(key.ScopeHoldsWrite) {
+		return true
+	}
+	return k.HasScope(key.ScopeOrgsWrite) && k.ActsFor(hold.OrganizationID)
+}
+
+// PostHoldHandler holds one available unit of a capacity tracked service at
+// an organization, e.g. a bed for someone on their way. The unit is taken out
+// of the available capacity until the organization confirms or releases the
+// hold, or it expires. It answers 409 when nothing is available.
+func PostHoldHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req holdRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		duration := DefaultHoldDuration
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 || d > MaxHoldDuration {
+				http.Error(w, "duration must be a positive duration of at most "+MaxHoldDuration.String(), http.StatusBadRequest)
+				return
+			}
+			duration = d
+		}
+
+		hold := core.Hold{
+			OrganizationID: chi.URLParam(r, "org_id"),
+			ServiceID:      chi.URLParam(r, "service_id"),
+			Reference:      req.Reference,
+			ExpiresAt:      time.Now().Add(duration),
+		}
+		if k, ok := key.FromContext(r.Context()); ok {
+			hold.PlacedBy = k.ID
+		}
+		hold, err := store.PlaceHold(hold)
+		writeHold(w, hold, err, http.StatusCreated)
+	}
+}
+
+// GetHoldHandler returns a hold, so its caller can see whether it is still
+// held. Only the key that placed it and the organization's staff see it;
+// anyone else's is reported as missing.
+func GetHoldHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hold, err := store.GetHold(chi.URLParam(r, "hold_id"))
+		if err == nil && !canManageHold(r, hold) {
+			err = storage.ErrNotFound
+		}
+		writeHold(w, hold, err, http.StatusOK)
+	}
+}
+
+// ListOrgHoldsHandler lists the holds at an organization, newest first. The
+// status query parameter keeps only held, confirmed, released or expired ones.
+func ListOrgHoldsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := core.HoldStatus(r.URL.Query().Get("status"))
+		switch status {
+		case "", core.HoldHeld, core.HoldConfirmed, core.HoldReleased, core.HoldExpired:
+		default:
+			http.Error(w, "status must be held, confirmed, released or expired", http.StatusBadRequest)
+			return
+		}
+
+		orgID := chi.URLParam(r, "org_id")
+		if _, err := store.GetOrganizationByID(orgID); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		holds, err := store.ListHolds(orgID, status)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(holds)
+	}
+}
+
+// ConfirmHoldHandler records that the organization in the URL handed out
+// the held unit; holds at other organizations are reported as missing. It
+// answers 409 once the hold has expired or ended.
+func ConfirmHoldHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		holdID := chi.URLParam(r, "hold_id")
+		hold, err := store.GetHold(holdID)
+		if err == nil && hold.OrganizationID != chi.URLParam(r, "org_id") {
+			err = storage.ErrNotFound
+		}
+		if err == nil {
+			hold, err = store.ConfirmHold(holdID)
+		}
+		writeHold(w, hold, err, http.StatusOK)
+	}
+}
+
+// ReleaseHoldHandler ends a hold and makes its unit available again, for the
+// key that placed it or the organization's staff.
+func ReleaseHoldHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		holdID := chi.URLParam(r, "hold_id")
+		hold, err := store.GetHold(holdID)
+		if err == nil && !canManageHold(r, hold) {
+			err = storage.ErrNotFound
+		}
+		if err == nil {
+			hold, err = store.ReleaseHold(holdID)
+		}
+		writeHold(w, hold, err, http.StatusOK)
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	core "github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+// PutOpeningHoursHandler sets the weekly hours and exceptions of an
+// organization, or of one of its services when the route has a service_id.
+func PutOpeningHoursHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		serviceID := chi.URLParam(r, "service_id")
+
+		var hours core.OpeningHours
+		if err := json.NewDecoder(r.Body).Decode(&hours); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := store.SetOpeningHours(orgID, serviceID, hours)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrInvalidOpeningHours):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, storage.ErrNotFound):
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(hours)
+	}
+}
+
+// DeleteOpeningHoursHandler removes the hours of an organization, or of one
+// of its services, leaving them unknown.
+func DeleteOpeningHoursHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		serviceID := chi.URLParam(r, "service_id")
+
+		err := store.DeleteOpeningHours(orgID, serviceID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// addOpeningHours fills in the hours of org and of its services.
+func addOpeningHours(store storage.Store, org *core.Organization) error {
+	hours, err := store.GetOpeningHours(org.ID)
+	if err != nil {
+		return err
+	}
+
+	for serviceID, h := range hours {
+		if serviceID == "" {
+			h := h
+			org.Hours = &h
+			continue
+		}
+		if org.ServiceHours == nil {
+			org.ServiceHours = make(map[string]core.OpeningHours)
+		}
+		org.ServiceHours[serviceID] = h
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	core "github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+)
+
+// defaultLanguage is the language of the untranslated names and descriptions
+// stored on services and organizations.
+const defaultLanguage = "en"
+
+// languageTag matches BCP 47 style tags such as "ar", "fr-CA" or "zh-Hant-TW".
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// normalizeLanguage lowercases a language tag so lookups ignore case. It
+// returns false if tag is not a valid language tag.
+func normalizeLanguage(tag string) (string, bool) {
+	tag = strings.TrimSpace(tag)
+	if !languageTag.MatchString(tag) {
+		return "", false
+	}
+	return strings.ToLower(tag), true
+}
+
+// primaryLanguage returns the language part of a normalized tag, "fr" for "fr-ca".
+func primaryLanguage(tag string) string {
+	lang, _, _ := strings.Cut(tag, "-")
+	return lang
+}
+
+// requestLanguages returns the languages preferred by the client, most
+// preferred first: the lang query parameter, then the Accept-Language header
+// ordered by quality. Invalid tags and wildcards are skipped.
+func requestLanguages(r *http.Request) []string {
+	if tag, ok := normalizeLanguage(r.URL.Query().Get("lang")); ok {
+		return []string{tag}
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		normalized, ok := normalizeLanguage(tag)
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{normalized, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+
+	languages := make([]string, len(accepted))
+	for i, a := range accepted {
+		languages[i] = a.tag
+	}
+	return languages
+}
+
+// pickTranslation returns the translation for the most preferred language
+// that has one, trying the primary language of regional tags too. It returns
+// false when the default language comes first or nothing matches, meaning
+// the untranslated value should be used.
+func pickTranslation(languages []string, translations map[string]string) (string, bool) {
+	for _, lang := range languages {
+		if lang == defaultLanguage || primaryLanguage(lang) == defaultLanguage {
+			return "", false
+		}
+		if t, ok := translations[lang]; ok {
+			return t, true
+		}
+		if t, ok := translations[primaryLanguage(lang)]; ok {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// localizeServices replaces the service names with their translation in the
+// preferred languages, where one exists.
+func localizeServices(store storage.Store, languages []string, services []core.Service) error {
+	if len(languages) == 0 || len(services) == 0 {
+		return nil
+	}
+
+	translations, err := store.GetServiceTranslations()
+	if err != nil {
+		return err
+	}
+	translateServices(languages, services, translations)
+	return nil
+}
+
+// translateServices is localizeServices with the translations of every
+// service loaded, see storage.Store.GetServiceTranslations.
+func translateServices(languages []string, services []core.Service, translations map[string]map[string]string) {
+	for i := range services {
+		if name, ok := pickTranslation(languages, translations[services[i].ID]); ok {
+			services[i].Name = name
+		}
+	}
+}
+
+// localizeOrganization translates the name, description and services of org
+// into the preferred languages. Name and description fall back separately.
+func localizeOrganization(store storage.Store, languages []string, org *core.Organization) error {
+	if len(languages) == 0 {
+		return nil
+	}
+
+	translations, err := store.GetOrganizationTranslations(org.ID)
+	if err != nil {
+		return err
+	}
+	translateOrganization(languages, org, translations)
+	return localizeServices(store, languages, org.Services)
+}
+
+// translateOrganization translates the name and description of org with
+// its loaded translations, keyed by language tag.
+func translateOrganization(languages []string, org *core.Organization, translations map[string]core.OrganizationTranslation) {
+	names := make(map[string]string)
+	descriptions := make(map[string]string)
+	for lang, t := range translations {
+		if t.Name != "" {
+			names[lang] = t.Name
+		}
+		if t.Description != "" {
+			descriptions[lang] = t.Description
+		}
+	}
+	if name, ok := pickTranslation(languages, names); ok {
+		org.Name = name
+	}
+	if description, ok := pickTranslation(languages, descriptions); ok {
+		org.Description = description
+	}
+}
@@ -0,0 +1,16 @@
+package key
+
+import "context"
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the authenticated key.
+func NewContext(ctx context.Context, k Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, k)
+}
+
+// FromContext returns the key stored by NewContext, if any.
+func FromContext(ctx context.Context) (Key, bool) {
+	k, ok := ctx.Value(contextKey{}).(Key)
+	return k, ok
+}
@@ -0,0 +1,149 @@
+package key
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// createKeyResponse is the only response that ever contains the raw key.
+type createKeyResponse struct {
+	Key
+	APIKey string `json:"api_key"`
+}
+
+// HandleCreateKey issues a new key. A caller authenticating with a key gets
+// another key of its own owner; with the keys:admin scope it may instead name
+// any owner in the body as a UserInfo. Without a key, the UserInfo in the
+// body must be a new owner, which the issued key then claims; more keys for
+// an existing owner require authenticating as it, and AdminOwnerID cannot be
+// claimed. Self-served keys are created with opts.
+func HandleCreateKey(store Store, opts Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var info UserInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		var caller *Key
+		if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			apiKey, ok := strings.CutPrefix(authHeader, "Bearer ")
+			if !ok {
+				http.Error(w, "Authorization header must be in 'Bearer {token}' format", http.StatusBadRequest)
+				return
+			}
+			k, valid, err := ValidateKey(store, apiKey)
+			if err != nil {
+				http.Error(w, "Error validating CAMLL API key", http.StatusInternalServerError)
+				return
+			}
+			if !valid {
+				http.Error(w, "Invalid CAMLL API key", http.StatusUnauthorized)
+				return
+			}
+			caller = &k
+		}
+
+		switch {
+		case caller != nil && (info.ID == "" || info.ID == caller.Owner.ID):
+			info = caller.Owner
+		case caller != nil && !caller.HasScope(ScopeKeysAdmin):
+			http.Error(w, "issuing keys for another owner requires the keys:admin scope", http.StatusForbidden)
+			return
+		case caller == nil && info.ID == AdminOwnerID:
+			http.Error(w, "owner id is reserved", http.StatusForbidden)
+			return
+		}
+		if info.ID == "" || info.Email == "" {
+			http.Error(w, "id and email are required", http.StatusBadRequest)
+			return
+		}
+
+		var apiKey string
+		var k Key
+		var err error
+		if caller != nil {
+			apiKey, k, err = GenKey(store, info, opts)
+		} else {
+			apiKey, k, err = GenFirstKey(store, info, opts)
+		}
+		if errors.Is(err, ErrOwnerExists) {
+			http.Error(w, "owner already has keys, authenticate with one of them to issue more", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to create API key for %s: %v", info.ID, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(createKeyResponse{Key: k, APIKey: apiKey})
+	}
+}
+
+// HandleListKeys lists the keys belonging to the owner of the calling key.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleListKeys(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := FromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		keys, err := store.ListKeysByOwner(caller.Owner.ID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(keys)
+	}
+}
+
+// HandleRevokeKey revokes the key named by the key_id URL parameter. Callers
+// may only revoke keys with the same owner as the key they authenticated with.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleRevokeKey(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := FromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		k, err := store.GetKeyByID(chi.URLParam(r, "key_id"))
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Report someone else's key as missing rather than leaking that it exists
+		if k.Owner.ID != caller.Owner.ID {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		if err := store.RevokeKey(k.ID); err != nil {
+			log.Printf("Failed to revoke API key: %s, error: %v", k.ID, err)
+			http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,167 @@
+package key
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authenticated mimics the ValidateApiKey middleware without importing it
+func authenticated(store Store, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, valid, err := ValidateKey(store, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil || !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(NewContext(r.Context(), k)))
+	}
+}
+
+func TestKeyEndpoints(t *testing.T) {
+	store := setupTestStore(t)
+	r := chi.NewRouter()
+	r.Post("/keys", HandleCreateKey(store, Options{}))
+	r.Delete("/keys", HandleDeleteKey(store))
+	r.Get("/keys", authenticated(store, HandleListKeys(store)))
+	r.Delete("/keys/{key_id}", authenticated(store, HandleRevokeKey(store)))
+
+	create := func(body, apiKey string) (*httptest.ResponseRecorder, createKeyResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/keys", strings.NewReader(body))
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var resp createKeyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	call := func(method, target, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec, _ := create(`{"email":"no-id@example.org"}`, "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec, first := create(`{"id":"u1","email":"a@example.org"}`, "")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	_, other := create(`{"id":"u2","email":"b@example.org"}`, "")
+
+	// More keys for an owner need one of its keys, and only ever go to it
+	rec, _ = create(`{"id":"u1","email":"mallory@example.org"}`, "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec, _ = create(`{"id":"u2","email":"b@example.org"}`, first.APIKey)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec, _ = create(`{}`, "cml-00000000000000000000")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec, _ = create(`{"id":"admin","email":"mallory@example.org"}`, "")
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the bootstrap owner cannot be claimed")
+	rec, second := create("", first.APIKey)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, first.Owner, second.Owner)
+
+	rec = call(http.MethodGet, "/keys", first.APIKey)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), first.APIKey)
+	var listed []Key
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+	assert.Len(t, listed, 2)
+
+	// Another owner's key cannot be revoked
+	rec = call(http.MethodDelete, "/keys/"+other.ID, first.APIKey)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = call(http.MethodDelete, "/keys/"+second.ID, first.APIKey)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = call(http.MethodGet, "/keys", second.APIKey)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = call(http.MethodDelete, "/keys", first.APIKey)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = call(http.MethodGet, "/keys", first.APIKey)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCreateKeyForOtherOwner(t *testing.T) {
+	store := setupTestStore(t)
+	adminKey, _, err := GenKey(store, UserInfo{ID: "ops", Email: "ops@example.org"}, Options{Scopes: []string{ScopeKeysAdmin}})
+	require.NoError(t, err)
+	_, existing, err := GenKey(store, UserInfo{ID: "u1", Email: "a@example.org"}, Options{})
+	require.NoError(t, err)
+
+	handler := HandleCreateKey(store, Options{Scopes: []string{ScopeOrgsRead}})
+	req := httptest.NewRequest(http.MethodPost, "/keys", strings.NewReader(`{"id":"u1","email":"a@example.org"}`))
+	req.Header.Set("Authorization", "Bearer "+adminKey)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	keys, err := store.ListKeysByOwner("u1")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, existing.ID, keys[0].ID)
+	assert.Equal(t, []string{ScopeOrgsRead}, keys[1].Scopes)
+}
+
+func TestHandleUpdateKey(t *testing.T) {
+	store := setupTestStore(t)
+	_, k, err := GenKey(store, UserInfo{ID: "u1", Email: "a@example.org"}, Options{Scopes: []string{ScopeOrgsRead}})
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Patch("/keys/{key_id}", HandleUpdateKey(store, UpdateOptions{
+		Tiers: []string{DefaultTier, "partner"},
+		OrganizationExists: func(orgID string) (bool, error) {
+			return orgID == "org1", nil
+		},
+	}))
+	patch := func(target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, target, strings.NewReader(body)))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, patch("/keys/key_missing", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("/keys/"+k.ID, `{"scopes":["orgs:delete"]}`).Code)
+
+	rec := patch("/keys/"+k.ID, `{"scopes":["orgs:read","orgs:write"],"monthly_cap":100}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	got, err := store.GetKeyByID(k.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeOrgsRead, ScopeOrgsWrite}, got.Scopes)
+	assert.Equal(t, 100, got.MonthlyCap)
+	assert.Equal(t, DefaultTier, got.Tier)
+	assert.False(t, got.ActsFor("org1"))
+
+	assert.Equal(t, http.StatusBadRequest, patch("/keys/"+k.ID, `{"tier":"platinum"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("/keys/"+k.ID, `{"tier":""}`).Code)
+	require.Equal(t, http.StatusOK, patch("/keys/"+k.ID, `{"tier":"partner"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("/keys/"+k.ID, `{"organization_id":"org2"}`).Code)
+
+	require.Equal(t, http.StatusOK, patch("/keys/"+k.ID, `{"organization_id":"org1"}`).Code)
+	got, err = store.GetKeyByID(k.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "org1", got.OrganizationID)
+	assert.True(t, got.ActsFor("org1"))
+	assert.False(t, got.ActsFor("org2"))
+	assert.False(t, got.ActsFor(""))
+
+	require.Equal(t, http.StatusOK, patch("/keys/"+k.ID, `{"organization_id":""}`).Code)
+	got, err = store.GetKeyByID(k.ID)
+	require.NoError(t, err)
+	assert.False(t, got.ActsFor("org1"))
+	got.Scopes = append(got.Scopes, ScopeOrgsAdmin)
+	assert.True(t, got.ActsFor("org2"), "administrators act for every organization")
+}
@@ -2,10 +2,13 @@ package key
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type UserInfo struct {
@@ -24,60 +27,219 @@ func generateAPIKey() (string, error) {
 	return "cml-" + hex.EncodeToString(bytes), nil
 }
 
-func GenKey(info UserInfo) (string, error) {
-	key, _ := generateAPIKey()
-	// TODO: add to db with userinfo
-	return key, nil
+// hashKey returns the hex SHA-256 digest stored in place of a raw key.
+func hashKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
 }
 
-func ValidateKey(api_key string) (bool, error) {
-	// TODO: check db that key exists and is valid
-	// (not deleted by user and below usage cap)
-	// -> probably needs usage cap func
-	return true, nil
+func generateKeyID() (string, error) {
+	bytes := make([]byte, 8)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return "key_" + hex.EncodeToString(bytes), nil
 }
 
-func InvalidateKey(api_key string) error {
-	// TODO: in db invalidate (delete from user perspective )
-	return nil
+const (
+	// DefaultTier is the rate limiting tier of keys issued without one.
+	DefaultTier = "standard"
+	// AdminOwnerID owns the administrator key bootstrapped from
+	// configuration. It is reserved: keys for it are never self-served.
+	AdminOwnerID = "admin"
+)
+
+// Options are the settings a new key is issued with.
+type Options struct {
+	// MonthlyCap is the number of requests allowed per calendar month (UTC).
+	// Zero means unlimited.
+	MonthlyCap int
+	// Tier selects the rate limit applied to the key. Empty means DefaultTier.
+	Tier string
+	// Scopes are the permissions granted to the key, see ScopeOrgsRead and friends.
+	Scopes []string
 }
 
-func HandleDeleteKey(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header is required", http.StatusBadRequest)
-		return
+// GenKey creates and persists a new API key owned by info. The raw key is
+// returned once and cannot be recovered later.
+func GenKey(store Store, info UserInfo, opts Options) (string, Key, error) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return "", Key{}, err
 	}
 
-	parts := strings.SplitN(authHeader, " ", 2)
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		http.Error(w, "Authorization header must be in 'Bearer {token}' format", http.StatusBadRequest)
-		return
+	k, err := insertKey(store.InsertKey, apiKey, info, opts)
+	if err != nil {
+		return "", Key{}, err
 	}
+	return apiKey, k, nil
+}
 
-	apiKey := parts[1]
+// GenFirstKey is GenKey for an owner that has no keys yet. It returns
+// ErrOwnerExists otherwise, so that unauthenticated clients can claim new
+// owners but never add keys to someone else's.
+func GenFirstKey(store Store, info UserInfo, opts Options) (string, Key, error) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return "", Key{}, err
+	}
 
-	v, err := ValidateKey(apiKey)
+	k, err := insertKey(store.InsertFirstKey, apiKey, info, opts)
+	if err != nil {
+		return "", Key{}, err
+	}
+	return apiKey, k, nil
+}
+
+// EnsureKey makes sure the given raw key exists, creating it with info and
+// opts if needed. It is used to bootstrap a known admin key from
+// configuration. An existing key is granted the scopes of opts it lacks, so
+// scopes added in later releases reach it; nothing else about it changes.
+func EnsureKey(store Store, apiKey string, info UserInfo, opts Options) (Key, error) {
+	if !strings.HasPrefix(apiKey, "cml-") {
+		return Key{}, errors.New(`api key must start with "cml-"`)
+	}
 
+	k, err := store.GetKeyByHash(hashKey(apiKey))
+	if errors.Is(err, ErrKeyNotFound) {
+		return insertKey(store.InsertKey, apiKey, info, opts)
+	}
 	if err != nil {
-		http.Error(w, "Error validating CAMLL API key", http.StatusUnauthorized)
-		return
+		return Key{}, err
 	}
 
-	if !v {
-		http.Error(w, "Invalid CAMLL API key", http.StatusUnauthorized)
-		return
+	granted := false
+	for _, scope := range opts.Scopes {
+		if !k.HasScope(scope) {
+			k.Scopes = append(k.Scopes, scope)
+			granted = true
+		}
 	}
+	if granted {
+		if err := store.UpdateKey(k); err != nil {
+			return Key{}, err
+		}
+	}
+	return k, nil
+}
 
-	err = InvalidateKey(apiKey)
+func insertKey(insert func(Key) error, apiKey string, info UserInfo, opts Options) (Key, error) {
+	id, err := generateKeyID()
 	if err != nil {
-		log.Printf("Failed to invalidate API key: %s, error: %v", apiKey, err)
-		http.Error(w, "Failed to invalidate API key", http.StatusInternalServerError)
-		return
+		return Key{}, err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("API key invalidated successfully"))
+	k := Key{
+		ID:         id,
+		Hash:       hashKey(apiKey),
+		Owner:      info,
+		CreatedAt:  time.Now().UTC(),
+		MonthlyCap: opts.MonthlyCap,
+		Tier:       opts.Tier,
+		Scopes:     opts.Scopes,
+	}
+	if k.Tier == "" {
+		k.Tier = DefaultTier
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	if err := insert(k); err != nil {
+		return Key{}, err
+	}
+	return k, nil
 }
 
-// TODO: billing info and usage endpoints
+// ValidateKey reports whether apiKey exists and has not been revoked. A
+// valid key has its last-used time updated and its record returned.
+func ValidateKey(store Store, apiKey string) (Key, bool, error) {
+	k, valid, err := LookupKey(store, apiKey)
+	if err != nil || !valid {
+		return Key{}, valid, err
+	}
+	if err := Touch(store, &k, time.Now()); err != nil {
+		return Key{}, false, err
+	}
+	return k, true, nil
+}
+
+// LookupKey is ValidateKey without updating the last-used time, so that
+// requests can be authenticated before anything is written for them.
+func LookupKey(store Store, apiKey string) (Key, bool, error) {
+	if !strings.HasPrefix(apiKey, "cml-") {
+		return Key{}, false, nil
+	}
+
+	k, err := store.GetKeyByHash(hashKey(apiKey))
+	if errors.Is(err, ErrKeyNotFound) {
+		return Key{}, false, nil
+	}
+	if err != nil {
+		return Key{}, false, err
+	}
+	if k.Revoked {
+		return Key{}, false, nil
+	}
+	return k, true, nil
+}
+
+// Touch records that k was used at.
+func Touch(store Store, k *Key, at time.Time) error {
+	at = at.UTC()
+	if err := store.TouchKey(k.ID, at); err != nil {
+		return err
+	}
+	k.LastUsedAt = &at
+	return nil
+}
+
+// InvalidateKey revokes apiKey. Revoked keys stay in the database so their
+// history is kept, but never validate again.
+func InvalidateKey(store Store, apiKey string) error {
+	k, err := store.GetKeyByHash(hashKey(apiKey))
+	if err != nil {
+		return err
+	}
+	return store.RevokeKey(k.ID)
+}
+
+func HandleDeleteKey(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			http.Error(w, "Authorization header is required", http.StatusBadRequest)
+			return
+		}
+
+		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			http.Error(w, "Authorization header must be in 'Bearer {token}' format", http.StatusBadRequest)
+			return
+		}
+
+		apiKey := parts[1]
+
+		k, v, err := ValidateKey(store, apiKey)
+
+		if err != nil {
+			http.Error(w, "Error validating CAMLL API key", http.StatusUnauthorized)
+			return
+		}
+
+		if !v {
+			http.Error(w, "Invalid CAMLL API key", http.StatusUnauthorized)
+			return
+		}
+
+		err = InvalidateKey(store, apiKey)
+		if err != nil {
+			log.Printf("Failed to invalidate API key: %s, error: %v", k.ID, err)
+			http.Error(w, "Failed to invalidate API key", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("API key invalidated successfully"))
+	}
+}
@@ -0,0 +1,145 @@
+package key
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestStore(t *testing.T) *SQLStore {
+	db, err := storage.SetupInMemoryDatabase()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewSQLStore(db)
+}
+
+func TestKeyLifecycle(t *testing.T) {
+	store := setupTestStore(t)
+	owner := UserInfo{ID: "u1", Email: "intake@example.org", VerifiedEmail: true}
+
+	apiKey, k, err := GenKey(store, owner, Options{})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(apiKey, "cml-"))
+	assert.NotEqual(t, apiKey, k.Hash, "raw key must not be stored")
+
+	got, valid, err := ValidateKey(store, apiKey)
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, k.ID, got.ID)
+	assert.Equal(t, owner, got.Owner)
+	assert.NotNil(t, got.LastUsedAt)
+
+	require.NoError(t, InvalidateKey(store, apiKey))
+
+	_, valid, err = ValidateKey(store, apiKey)
+	require.NoError(t, err)
+	assert.False(t, valid)
+}
+
+func TestValidateUnknownKey(t *testing.T) {
+	store := setupTestStore(t)
+
+	_, valid, err := ValidateKey(store, "cml-00000000000000000000")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	_, valid, err = ValidateKey(store, "not-a-key")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	assert.ErrorIs(t, InvalidateKey(store, "cml-00000000000000000000"), ErrKeyNotFound)
+}
+
+func TestMonthlyUsage(t *testing.T) {
+	store := setupTestStore(t)
+	_, k, err := GenKey(store, UserInfo{ID: "u1", Email: "a@example.org"}, Options{MonthlyCap: 3})
+	require.NoError(t, err)
+
+	may := time.Date(2024, time.May, 31, 23, 0, 0, 0, time.UTC)
+	june := may.Add(2 * time.Hour)
+	for _, endpoint := range []string{"GET /orgs/{org_id}", "GET /orgs/{org_id}", "GET /services"} {
+		reserved, err := ReserveUsage(store, k, may)
+		require.NoError(t, err)
+		require.True(t, reserved)
+		require.NoError(t, RecordUsage(store, k, endpoint, may))
+	}
+	require.NoError(t, RecordUsage(store, k, "GET /services", june))
+
+	usage, err := MonthlyUsage(store, k, may)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-05", usage.Month)
+	assert.Equal(t, 3, usage.Used)
+	assert.Equal(t, 0, *usage.Remaining)
+	assert.Equal(t, []UsageRecord{
+		{Day: "2024-05-31", Endpoint: "GET /orgs/{org_id}", Count: 2},
+		{Day: "2024-05-31", Endpoint: "GET /services", Count: 1},
+	}, usage.Days)
+
+	reserved, err := ReserveUsage(store, k, may)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+
+	reserved, err = ReserveUsage(store, k, june)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func TestMonthlyCapPerOwner(t *testing.T) {
+	store := setupTestStore(t)
+	owner := UserInfo{ID: "u1", Email: "a@example.org"}
+	_, first, err := GenKey(store, owner, Options{MonthlyCap: 2})
+	require.NoError(t, err)
+	_, second, err := GenKey(store, owner, Options{MonthlyCap: 2})
+	require.NoError(t, err)
+	_, other, err := GenKey(store, UserInfo{ID: "u2", Email: "b@example.org"}, Options{MonthlyCap: 2})
+	require.NoError(t, err)
+
+	now := time.Now()
+	reserve := func(k Key) bool {
+		reserved, err := ReserveUsage(store, k, now)
+		require.NoError(t, err)
+		return reserved
+	}
+	assert.True(t, reserve(first))
+	assert.True(t, reserve(second))
+	assert.False(t, reserve(second), "a new key of the same owner does not reset the cap")
+	assert.True(t, reserve(other))
+
+	usage, err := MonthlyUsage(store, first, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, usage.OwnerUsed)
+	assert.Equal(t, 0, *usage.Remaining)
+}
+
+func TestEnsureKey(t *testing.T) {
+	store := setupTestStore(t)
+	admin := UserInfo{ID: AdminOwnerID, Email: "admin@localhost"}
+
+	_, err := EnsureKey(store, "not-a-key", admin, Options{})
+	assert.Error(t, err)
+
+	created, err := EnsureKey(store, "cml-bootstrap", admin, Options{Scopes: AllScopes})
+	require.NoError(t, err)
+	assert.True(t, created.HasScope(ScopeKeysAdmin))
+
+	again, err := EnsureKey(store, "cml-bootstrap", admin, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, again.ID)
+	assert.Equal(t, AllScopes, again.Scopes)
+
+	// Scopes added since the key was created are granted to it
+	old, err := EnsureKey(store, "cml-older", admin, Options{Scopes: []string{ScopeOrgsRead}, MonthlyCap: 5})
+	require.NoError(t, err)
+	upgraded, err := EnsureKey(store, "cml-older", admin, Options{Scopes: AllScopes})
+	require.NoError(t, err)
+	assert.Equal(t, old.ID, upgraded.ID)
+	assert.Equal(t, AllScopes, upgraded.Scopes)
+	stored, err := store.GetKeyByID(old.ID)
+	require.NoError(t, err)
+	assert.Equal(t, AllScopes, stored.Scopes)
+	assert.Equal(t, 5, stored.MonthlyCap)
+}
@@ -0,0 +1,131 @@
+package key
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Scopes a key can be granted. Routes declare the scopes they require with
+// the RequireScopes middleware.
+const (
+	ScopeOrgsRead      = "orgs:read"
+	ScopeOrgsWrite     = "orgs:write"
+	ScopeOrgsAdmin     = "orgs:admin"
+	ScopeServicesAdmin = "services:admin"
+	ScopeKeysAdmin     = "keys:admin"
+	ScopeHoldsWrite    = "holds:write"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+// AllScopes lists every known scope.
+var AllScopes = []string{ScopeOrgsRead, ScopeOrgsWrite, ScopeOrgsAdmin, ScopeServicesAdmin, ScopeKeysAdmin, ScopeHoldsWrite, ScopeWebhooksWrite}
+
+// ValidateScopes returns an error naming the first unknown scope.
+func ValidateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range AllScopes {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// updateKeyRequest is the body of PATCH /keys/{key_id}. Omitted fields are left unchanged.
+type updateKeyRequest struct {
+	Scopes     *[]string `json:"scopes"`
+	Tier       *string   `json:"tier"`
+	MonthlyCap *int      `json:"monthly_cap"`
+	// OrganizationID binds the key to an organization, or unbinds it when empty.
+	OrganizationID *string `json:"organization_id"`
+}
+
+// UpdateOptions holds what HandleUpdateKey checks changes against.
+type UpdateOptions struct {
+	// Tiers are the rate limit tiers keys may be given.
+	Tiers []string
+	// OrganizationExists reports whether keys may be bound to orgID.
+	OrganizationExists func(orgID string) (bool, error)
+}
+
+// HandleUpdateKey lets an administrator change the scopes, tier, monthly cap
+// and organization of any key. Unknown tiers and organizations answer 400.
+// It must be mounted behind RequireScopes(ScopeKeysAdmin).
+func HandleUpdateKey(store Store, opts UpdateOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req updateKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		k, err := store.GetKeyByID(chi.URLParam(r, "key_id"))
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if req.Scopes != nil {
+			if err := ValidateScopes(*req.Scopes); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			k.Scopes = *req.Scopes
+		}
+		if req.Tier != nil {
+			if !slices.Contains(opts.Tiers, *req.Tier) {
+				http.Error(w, fmt.Sprintf("unknown tier %q", *req.Tier), http.StatusBadRequest)
+				return
+			}
+			k.Tier = *req.Tier
+		}
+		if req.MonthlyCap != nil {
+			if *req.MonthlyCap < 0 {
+				http.Error(w, "monthly_cap must not be negative", http.StatusBadRequest)
+				return
+			}
+			k.MonthlyCap = *req.MonthlyCap
+		}
+		if req.OrganizationID != nil && *req.OrganizationID != "" {
+			exists, err := opts.OrganizationExists(*req.OrganizationID)
+			if err != nil {
+				log.Printf("Failed to look up organization %s: %v", *req.OrganizationID, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, fmt.Sprintf("unknown organization %q", *req.OrganizationID), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.OrganizationID != nil {
+			k.OrganizationID = *req.OrganizationID
+		}
+
+		if err := store.UpdateKey(k); err != nil {
+			log.Printf("Failed to update API key: %s, error: %v", k.ID, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(k)
+	}
+}
@@ -0,0 +1,260 @@
+package key
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrKeyNotFound is returned when no stored key matches the lookup.
+	ErrKeyNotFound = errors.New("api key not found")
+	// ErrOwnerExists is returned when claiming an owner that already has keys.
+	ErrOwnerExists = errors.New("owner already has keys")
+)
+
+// Key is the stored record of an API key. The raw "cml-" key is only ever
+// shown to the caller once; the database keeps its SHA-256 hash.
+type Key struct {
+	ID         string     `json:"id"`
+	Hash       string     `json:"-"`
+	Owner      UserInfo   `json:"owner"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Revoked    bool       `json:"revoked"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	MonthlyCap int        `json:"monthly_cap"`
+	Tier       string     `json:"tier"`
+	Scopes     []string   `json:"scopes"`
+	// OrganizationID is the organization whose staff use the key, if any.
+	// Only an administrator binds a key to an organization.
+	OrganizationID string `json:"organization_id,omitempty"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ActsFor reports whether the key may act as staff of the organization: it
+// is bound to it, or administers every organization.
+func (k Key) ActsFor(orgID string) bool {
+	return k.HasScope(ScopeOrgsAdmin) || (k.OrganizationID != "" && k.OrganizationID == orgID)
+}
+
+// Store persists API keys.
+type Store interface {
+	InsertKey(k Key) error
+	// InsertFirstKey inserts k unless its owner already has a key, in which
+	// case it returns ErrOwnerExists.
+	InsertFirstKey(k Key) error
+	GetKeyByHash(hash string) (Key, error)
+	GetKeyByID(id string) (Key, error)
+	ListKeysByOwner(ownerID string) ([]Key, error)
+	RevokeKey(id string) error
+	TouchKey(id string, at time.Time) error
+	// UpdateKey saves the monthly cap, tier, scopes and organization of k.
+	UpdateKey(k Key) error
+
+	// RecordUsage counts one request by the key against endpoint on day (YYYY-MM-DD).
+	RecordUsage(id, day, endpoint string) error
+	// ListUsage returns the per-day, per-endpoint counters of the key for days
+	// starting with prefix, e.g. "2024-05" for a whole month.
+	ListUsage(id, prefix string) ([]UsageRecord, error)
+	// ReserveUsage counts one request of the owner in month (YYYY-MM) unless
+	// the owner already made cap requests in it, and reports whether it did.
+	// A cap of zero or less is unlimited.
+	ReserveUsage(ownerID, month string, cap int) (bool, error)
+	// OwnerUsage returns the number of requests the owner made in month.
+	OwnerUsage(ownerID, month string) (int, error)
+}
+
+// SQLStore implements Store on the api_keys table created by storage.Migrate.
+type SQLStore struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLStore)(nil)
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+const keyColumns = `id, key_hash, owner_id, owner_email, owner_verified_email, owner_service, created_at, revoked, last_used_at, monthly_cap, tier, scopes, organization_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row rowScanner) (Key, error) {
+	var k Key
+	var lastUsed sql.NullTime
+	var scopes string
+	err := row.Scan(&k.ID, &k.Hash, &k.Owner.ID, &k.Owner.Email, &k.Owner.VerifiedEmail, &k.Owner.Service, &k.CreatedAt, &k.Revoked, &lastUsed, &k.MonthlyCap, &k.Tier, &scopes, &k.OrganizationID)
+	if err != nil {
+		return Key{}, err
+	}
+	k.Scopes = strings.Fields(scopes)
+	if lastUsed.Valid {
+		t := lastUsed.Time
+		k.LastUsedAt = &t
+	}
+	return k, nil
+}
+
+func (s *SQLStore) InsertKey(k Key) error {
+	_, err := s.db.Exec(`
+		INSERT INTO api_keys (id, key_hash, owner_id, owner_email, owner_verified_email, owner_service, created_at, revoked, monthly_cap, tier, scopes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, k.ID, k.Hash, k.Owner.ID, k.Owner.Email, k.Owner.VerifiedEmail, k.Owner.Service, k.CreatedAt, k.Revoked, k.MonthlyCap, k.Tier, strings.Join(k.Scopes, " "))
+	return err
+}
+
+func (s *SQLStore) InsertFirstKey(k Key) error {
+	// A single statement, so two clients claiming the same owner cannot both succeed
+	result, err := s.db.Exec(`
+		INSERT INTO api_keys (id, key_hash, owner_id, owner_email, owner_verified_email, owner_service, created_at, revoked, monthly_cap, tier, scopes)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM api_keys WHERE owner_id = ?)
+	`, k.ID, k.Hash, k.Owner.ID, k.Owner.Email, k.Owner.VerifiedEmail, k.Owner.Service, k.CreatedAt, k.Revoked, k.MonthlyCap, k.Tier, strings.Join(k.Scopes, " "), k.Owner.ID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrOwnerExists
+	}
+	return nil
+}
+
+func (s *SQLStore) GetKeyByHash(hash string) (Key, error) {
+	k, err := scanKey(s.db.QueryRow("SELECT "+keyColumns+" FROM api_keys WHERE key_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Key{}, ErrKeyNotFound
+	}
+	return k, err
+}
+
+func (s *SQLStore) GetKeyByID(id string) (Key, error) {
+	k, err := scanKey(s.db.QueryRow("SELECT "+keyColumns+" FROM api_keys WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Key{}, ErrKeyNotFound
+	}
+	return k, err
+}
+
+// ListKeysByOwner returns every key of the owner, revoked ones included, oldest first.
+func (s *SQLStore) ListKeysByOwner(ownerID string) ([]Key, error) {
+	rows, err := s.db.Query("SELECT "+keyColumns+" FROM api_keys WHERE owner_id = ? ORDER BY created_at, id", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) RevokeKey(id string) error {
+	return s.execOne("UPDATE api_keys SET revoked = 1 WHERE id = ?", id)
+}
+
+func (s *SQLStore) TouchKey(id string, at time.Time) error {
+	return s.execOne("UPDATE api_keys SET last_used_at = ? WHERE id = ?", at, id)
+}
+
+func (s *SQLStore) UpdateKey(k Key) error {
+	return s.execOne("UPDATE api_keys SET monthly_cap = ?, tier = ?, scopes = ?, organization_id = ? WHERE id = ?", k.MonthlyCap, k.Tier, strings.Join(k.Scopes, " "), k.OrganizationID, k.ID)
+}
+
+func (s *SQLStore) RecordUsage(id, day, endpoint string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO api_key_usage (key_id, day, endpoint, count) VALUES (?, ?, ?, 1)
+		ON CONFLICT (key_id, day, endpoint) DO UPDATE SET count = count + 1
+	`, id, day, endpoint)
+	return err
+}
+
+func (s *SQLStore) ListUsage(id, prefix string) ([]UsageRecord, error) {
+	rows, err := s.db.Query(`
+		SELECT day, endpoint, count
+		FROM api_key_usage
+		WHERE key_id = ? AND day LIKE ? || '%'
+		ORDER BY day, endpoint
+	`, id, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []UsageRecord{}
+	for rows.Next() {
+		var u UsageRecord
+		if err := rows.Scan(&u.Day, &u.Endpoint, &u.Count); err != nil {
+			return nil, err
+		}
+		records = append(records, u)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLStore) ReserveUsage(ownerID, month string, cap int) (bool, error) {
+	// Checking the cap and counting in one statement keeps concurrent
+	// requests from going over it
+	result, err := s.db.Exec(`
+		INSERT INTO api_owner_usage (owner_id, month, used) VALUES (?, ?, 1)
+		ON CONFLICT (owner_id, month) DO UPDATE SET used = used + 1
+		WHERE ? <= 0 OR used < ?
+	`, ownerID, month, cap, cap)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func (s *SQLStore) OwnerUsage(ownerID, month string) (int, error) {
+	var used int
+	err := s.db.QueryRow("SELECT used FROM api_owner_usage WHERE owner_id = ? AND month = ?", ownerID, month).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return used, err
+}
+
+// execOne runs an update that must affect exactly one key.
+func (s *SQLStore) execOne(query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package key
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// UsageRecord is the number of requests a key made to one endpoint on one day.
+type UsageRecord struct {
+	Day      string `json:"day"`
+	Endpoint string `json:"endpoint"`
+	Count    int    `json:"count"`
+}
+
+// Usage summarises a key's consumption for one calendar month (UTC). The
+// monthly cap applies to the requests of all the keys of its owner together,
+// so minting more keys does not raise it.
+type Usage struct {
+	KeyID      string        `json:"key_id"`
+	Month      string        `json:"month"`
+	MonthlyCap int           `json:"monthly_cap"`
+	Used       int           `json:"used"`
+	OwnerUsed  int           `json:"owner_used"`
+	Remaining  *int          `json:"remaining,omitempty"` // unset when the key has no cap
+	Days       []UsageRecord `json:"days"`
+}
+
+// MonthlyUsage returns the usage of k in the month containing at.
+func MonthlyUsage(store Store, k Key, at time.Time) (Usage, error) {
+	month := at.UTC().Format(monthLayout)
+	records, err := store.ListUsage(k.ID, month)
+	if err != nil {
+		return Usage{}, err
+	}
+	ownerUsed, err := store.OwnerUsage(k.Owner.ID, month)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{KeyID: k.ID, Month: month, MonthlyCap: k.MonthlyCap, OwnerUsed: ownerUsed, Days: records}
+	for _, u := range records {
+		usage.Used += u.Count
+	}
+	if k.MonthlyCap > 0 {
+		remaining := k.MonthlyCap - ownerUsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.Remaining = &remaining
+	}
+	return usage, nil
+}
+
+// ReserveUsage counts a request by k against the monthly cap of the month
+// containing at, shared by all the keys of its owner. It reports false,
+// without counting it, once the cap has been reached.
+func ReserveUsage(store Store, k Key, at time.Time) (bool, error) {
+	return store.ReserveUsage(k.Owner.ID, at.UTC().Format(monthLayout), k.MonthlyCap)
+}
+
+// RecordUsage counts one request by k against endpoint.
+func RecordUsage(store Store, k Key, endpoint string, at time.Time) error {
+	return store.RecordUsage(k.ID, at.UTC().Format(dayLayout), endpoint)
+}
+
+// HandleKeyUsage reports the consumption of the key named by the key_id URL
+// parameter for the month given by the optional month=YYYY-MM query
+// parameter, defaulting to the current month. Callers may only see keys with
+// the same owner as the key they authenticated with.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleKeyUsage(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := FromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		at := time.Now()
+		if month := r.URL.Query().Get("month"); month != "" {
+			parsed, err := time.Parse(monthLayout, month)
+			if err != nil {
+				http.Error(w, "month must be in YYYY-MM format", http.StatusBadRequest)
+				return
+			}
+			at = parsed
+		}
+
+		k, err := store.GetKeyByID(chi.URLParam(r, "key_id"))
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+		if k.Owner.ID != caller.Owner.ID {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		usage, err := MonthlyUsage(store, k, at)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(usage)
+	}
+}
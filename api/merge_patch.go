@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+// mergePatch merges patch into target following RFC 7386: objects are merged
+// recursively, null removes a member and any other value replaces it.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+		} else {
+			targetObj[name] = mergePatch(targetObj[name], value)
+		}
+	}
+	return targetObj
+}
+
+// applyMergePatch returns a copy of v with patch applied, round-tripping
+// through its JSON representation.
+func applyMergePatch[T any](v T, patch interface{}) (T, error) {
+	var result T
+
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return result, err
+	}
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return result, err
+	}
+
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(merged, &result)
+	return result, err
+}
@@ -1,35 +1,126 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/go-chi/chi/v5"
 )
 
+// endpointName identifies the route for usage metering, e.g. "GET /orgs/{org_id}",
+// so that requests for different IDs are counted together.
+func endpointName(r *http.Request) string {
+	pattern := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		pattern = rctx.RoutePattern()
+	}
+	return r.Method + " " + pattern
+}
+
+// LoadApiKey middleware to store a valid CAMLL API key from the
+// Authorization header in the request context without rejecting requests
+// missing one. It lets RateLimiter throttle requests by key before
+// ValidateApiKey, and by client IP when they have no valid key.
+func LoadApiKey(store key.Store) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if strings.HasPrefix(authHeader, "Bearer ") {
+				k, valid, err := key.LookupKey(store, strings.TrimPrefix(authHeader, "Bearer "))
+				if err == nil && valid {
+					r = r.WithContext(key.NewContext(r.Context(), k))
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
 // ValidateApiKey middleware to validate CAMLL API key from the Authorization header.
-func ValidateApiKey() Adapter {
+// It only reads the key, which is stored in the request context; see
+// key.FromContext. A key already loaded by LoadApiKey is not looked up
+// again. Routes chain RateLimiter before it, behind LoadApiKey, and
+// MeterUsage after it.
+func ValidateApiKey(store key.Store) Adapter {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := key.FromContext(r.Context()); ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
 			// Check Authorization header exists
-			// authHeader := r.Header.Get("Authorization")
-			// if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			// 	http.Error(w, "Authorization required", http.StatusUnauthorized)
-			// 	return
-			// }
-
-			// // Extract and validate the CAMLL API key
-			// camllAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
-			// valid, err := key.ValidateKey(camllAPIKey)
-
-			// if err != nil {
-			// 	http.Error(w, "Error validating CAMLL API key", http.StatusInternalServerError)
-			// 	return
-			// }
-
-			// if !valid {
-			// 	http.Error(w, "Invalid CAMLL API key", http.StatusUnauthorized)
-			// 	return
-			// }
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing_api_key", "Authorization header must be in 'Bearer {token}' format")
+				return
+			}
 
-			h.ServeHTTP(w, r)
+			// Extract and validate the CAMLL API key
+			camllAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
+			k, valid, err := key.LookupKey(store, camllAPIKey)
+
+			if err != nil {
+				log.Printf("Error validating CAMLL API key: %v", err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "Error validating CAMLL API key")
+				return
+			}
+
+			if !valid {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeError(w, http.StatusUnauthorized, "invalid_api_key", "Invalid CAMLL API key")
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(key.NewContext(r.Context(), k)))
+		})
+	}
+}
+
+// MeterUsage middleware to record the use of the authenticated key. Keys
+// whose owner is over its monthly cap are rejected with 429 and every
+// accepted request is metered. It must run after ValidateApiKey and
+// RateLimiter, and after RequireScopes and RequireOrganization so that
+// requests they reject are not metered.
+func MeterUsage(store key.Store) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, ok := key.FromContext(r.Context())
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing_api_key", "Authorization required")
+				return
+			}
+
+			now := time.Now()
+			if err := key.Touch(store, &k, now); err != nil {
+				log.Printf("Error updating API key %s: %v", k.ID, err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "Error validating CAMLL API key")
+				return
+			}
+
+			// Count the request against the monthly cap of the key's owner;
+			// the endpoint is metered once served
+			reserved, err := key.ReserveUsage(store, k, now)
+			if err != nil {
+				log.Printf("Error checking usage of API key %s: %v", k.ID, err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "Error checking API key usage")
+				return
+			}
+			if !reserved {
+				writeError(w, http.StatusTooManyRequests, "usage_cap_exceeded", "Monthly usage cap of this API key has been reached")
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(key.NewContext(r.Context(), k)))
+
+			if err := key.RecordUsage(store, k, endpointName(r), now); err != nil {
+				log.Printf("Error recording usage of API key %s: %v", k.ID, err)
+			}
 		})
 	}
 }
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupKeyStore(t *testing.T) *key.SQLStore {
+	db, err := storage.SetupInMemoryDatabase()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return key.NewSQLStore(db)
+}
+
+// echoOwner responds with the owner ID of the key found in the request context
+var echoOwner = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	k, ok := key.FromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(k.Owner.ID))
+})
+
+func TestValidateApiKey(t *testing.T) {
+	store := setupKeyStore(t)
+	apiKey, _, err := key.GenKey(store, key.UserInfo{ID: "u1", Email: "a@example.org"}, key.Options{})
+	require.NoError(t, err)
+	h := ValidateApiKey(store)(echoOwner)
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "missing header", header: "", wantStatus: http.StatusUnauthorized, wantError: "missing_api_key"},
+		{name: "wrong scheme", header: "Basic " + apiKey, wantStatus: http.StatusUnauthorized, wantError: "missing_api_key"},
+		{name: "unknown key", header: "Bearer cml-deadbeef", wantStatus: http.StatusUnauthorized, wantError: "invalid_api_key"},
+		{name: "valid key", header: "Bearer " + apiKey, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantError != "" {
+				var body errorResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+				assert.Equal(t, tt.wantError, body.Error)
+			} else {
+				assert.Equal(t, "u1", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateApiKeyUsageCap(t *testing.T) {
+	store := setupKeyStore(t)
+	apiKey, k, err := key.GenKey(store, key.UserInfo{ID: "u1", Email: "a@example.org"}, key.Options{MonthlyCap: 2})
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.With(ValidateApiKey(store), MeterUsage(store)).Get("/orgs/{org_id}", echoOwner)
+
+	codes := make([]int, 3)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/orgs/org%d", i), nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		codes[i] = rec.Code
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+
+	usage, err := key.MonthlyUsage(store, k, time.Now())
+	require.NoError(t, err)
+	require.Len(t, usage.Days, 1)
+	assert.Equal(t, "GET /orgs/{org_id}", usage.Days[0].Endpoint)
+	assert.Equal(t, 2, usage.Days[0].Count)
+}
+
+func TestRateLimitedRequestsAreNotMetered(t *testing.T) {
+	store := setupKeyStore(t)
+	apiKey, k, err := key.GenKey(store, key.UserInfo{ID: "u1", Email: "a@example.org"}, key.Options{})
+	require.NoError(t, err)
+
+	limit := RateLimit{Burst: 1, RefillPerSecond: 0.001}
+	r := chi.NewRouter()
+	r.With(
+		LoadApiKey(store),
+		RateLimiter(RateLimitConfig{Default: limit}),
+		ValidateApiKey(store),
+		MeterUsage(store),
+	).Get("/orgs", echoOwner)
+
+	codes := make([]int, 2)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodGet, "/orgs", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		codes[i] = rec.Code
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes)
+
+	usage, err := key.MonthlyUsage(store, k, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, usage.Used)
+	assert.Equal(t, 1, usage.OwnerUsed)
+}
+
+func TestForbiddenRequestsAreNotMetered(t *testing.T) {
+	store := setupKeyStore(t)
+	apiKey, k, err := key.GenKey(store, key.UserInfo{ID: "u1", Email: "a@example.org"}, key.Options{Scopes: []string{key.ScopeOrgsRead}})
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.With(ValidateApiKey(store), RequireScopes(key.ScopeOrgsWrite), MeterUsage(store)).Post("/orgs", echoOwner)
+
+	req := httptest.NewRequest(http.MethodPost, "/orgs", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	usage, err := key.MonthlyUsage(store, k, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, usage.Used)
+	assert.Zero(t, usage.OwnerUsed)
+}
+
+func TestInvalidKeysAreRateLimited(t *testing.T) {
+	store := setupKeyStore(t)
+	apiKey, _, err := key.GenKey(store, key.UserInfo{ID: "u1", Email: "a@example.org"}, key.Options{})
+	require.NoError(t, err)
+
+	limit := RateLimit{Burst: 2, RefillPerSecond: 0.001}
+	r := chi.NewRouter()
+	r.With(
+		LoadApiKey(store),
+		RateLimiter(RateLimitConfig{Default: limit}),
+		ValidateApiKey(store),
+		MeterUsage(store),
+	).Get("/orgs", echoOwner)
+
+	get := func(header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/orgs", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	codes := []int{get("Bearer cml-deadbeef"), get("Bearer cml-deadbeef"), get("Bearer cml-deadbeef"), get("")}
+	assert.Equal(t, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests}, codes)
+
+	// A valid key from the same address has buckets of its own
+	assert.Equal(t, http.StatusOK, get("Bearer "+apiKey))
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorResponse is the JSON body written when a middleware rejects a request.
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: code, Message: message})
+}
@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+)
+
+// RateLimit is the token bucket of one key tier: up to Burst requests at
+// once, refilled at RefillPerSecond.
+type RateLimit struct {
+	Burst           int
+	RefillPerSecond float64
+}
+
+// RateLimitConfig maps key tiers to their limits. Default applies to keys
+// whose tier is not listed and to unauthenticated clients, which are limited
+// by IP address.
+type RateLimitConfig struct {
+	Tiers   map[string]RateLimit
+	Default RateLimit
+}
+
+// ParseRateLimits parses tier limits written as "tier=burst:refill_per_second"
+// pairs separated by commas, e.g. "standard=20:2,partner=200:50".
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	tiers := make(map[string]RateLimit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		tier, limit, ok := strings.Cut(entry, "=")
+		burst, refill, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 || tier == "" {
+			return nil, fmt.Errorf("invalid rate limit %q: want tier=burst:refill_per_second", entry)
+		}
+
+		b, err := strconv.Atoi(burst)
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid burst in rate limit %q", entry)
+		}
+		rps, err := strconv.ParseFloat(refill, 64)
+		if err != nil || rps <= 0 {
+			return nil, fmt.Errorf("invalid refill rate in rate limit %q", entry)
+		}
+
+		tiers[tier] = RateLimit{Burst: b, RefillPerSecond: rps}
+	}
+	return tiers, nil
+}
+
+type bucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// limiter holds one token bucket per client.
+type limiter struct {
+	cfg       RateLimitConfig
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newLimiter(cfg RateLimitConfig, now func() time.Time) *limiter {
+	return &limiter{cfg: cfg, now: now, buckets: make(map[string]*bucket), lastSweep: now()}
+}
+
+// take removes a token from each of the client buckets, all limited by limit.
+// The request is allowed only if every bucket has a token. It returns whether
+// the request is allowed, the tokens left in the emptiest bucket and, when
+// denied, how long until every bucket has a token again.
+func (l *limiter) take(limit RateLimit, clients ...string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	tokens := float64(limit.Burst)
+	buckets := make([]*bucket, len(clients))
+	for i, client := range clients {
+		b, ok := l.buckets[client]
+		if !ok {
+			b = &bucket{tokens: float64(limit.Burst), updated: now}
+			l.buckets[client] = b
+		}
+		b.limit = limit
+
+		elapsed := now.Sub(b.updated).Seconds()
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.RefillPerSecond)
+		b.updated = now
+		tokens = math.Min(tokens, b.tokens)
+		buckets[i] = b
+	}
+
+	if tokens < 1 {
+		wait := time.Duration((1 - tokens) / limit.RefillPerSecond * float64(time.Second))
+		return false, 0, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, int(tokens - 1), 0
+}
+
+// sweep drops buckets that have refilled completely, so clients that went
+// away do not accumulate. Recreating them later is equivalent. The caller
+// must hold mu.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.RefillPerSecond >= float64(b.limit.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// clientIP returns the host part of r.RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimiter middleware to throttle clients with token buckets. Requests are
+// limited both per authenticated API key and per key owner, so that minting
+// more keys does not raise the limit; without a key the client IP is used.
+// It must run after LoadApiKey and before ValidateApiKey, so requests with
+// missing or invalid keys are throttled by IP, and before MeterUsage, so
+// throttled requests cost no usage writes.
+func RateLimiter(cfg RateLimitConfig) Adapter {
+	return rateLimiter(newLimiter(cfg, time.Now))
+}
+
+func rateLimiter(l *limiter) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clients := []string{"ip:" + clientIP(r)}
+			limit := l.cfg.Default
+			if k, ok := key.FromContext(r.Context()); ok {
+				clients = []string{"key:" + k.ID, "owner:" + k.Owner.ID}
+				if tierLimit, ok := l.cfg.Tiers[k.Tier]; ok {
+					limit = tierLimit
+				}
+			}
+
+			allowed, remaining, wait := l.take(limit, clients...)
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+			if !allowed {
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(l.now().Add(wait).Unix(), 10))
+				writeError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, retry later")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
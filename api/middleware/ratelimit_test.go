@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tiers, err := ParseRateLimits("standard=20:2, partner=200:0.5")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]RateLimit{
+		"standard": {Burst: 20, RefillPerSecond: 2},
+		"partner":  {Burst: 200, RefillPerSecond: 0.5},
+	}, tiers)
+
+	for _, bad := range []string{"standard", "standard=20", "=1:1", "standard=0:1", "standard=1:x"} {
+		_, err := ParseRateLimits(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	l := newLimiter(RateLimitConfig{
+		Tiers:   map[string]RateLimit{"partner": {Burst: 3, RefillPerSecond: 1}},
+		Default: RateLimit{Burst: 1, RefillPerSecond: 0.5},
+	}, func() time.Time { return now })
+	h := rateLimiter(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(k *key.Key, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if k != nil {
+			req = req.WithContext(key.NewContext(req.Context(), *k))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	partner := &key.Key{ID: "key_1", Tier: "partner", Owner: key.UserInfo{ID: "u1"}}
+	for i := 0; i < 3; i++ {
+		rec := send(partner, "10.0.0.1:1234")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "3", rec.Header().Get("X-RateLimit-Limit"))
+	}
+	rec := send(partner, "10.0.0.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+
+	// Anonymous clients from the same address have their own, default bucket
+	assert.Equal(t, http.StatusOK, send(nil, "10.0.0.1:1234").Code)
+	rec = send(nil, "10.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, send(partner, "10.0.0.1:1234").Code)
+
+	// Another key of the same owner shares the owner's bucket
+	sibling := &key.Key{ID: "key_2", Tier: "partner", Owner: partner.Owner}
+	assert.Equal(t, http.StatusTooManyRequests, send(sibling, "10.0.0.2:1234").Code)
+	stranger := &key.Key{ID: "key_3", Tier: "partner", Owner: key.UserInfo{ID: "u2"}}
+	assert.Equal(t, http.StatusOK, send(stranger, "10.0.0.2:1234").Code)
+}
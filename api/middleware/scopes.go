@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/go-chi/chi/v5"
+)
+
+// RequireScopes middleware to reject keys that lack any of the given scopes
+// with 403. It must run after ValidateApiKey.
+func RequireScopes(scopes ...string) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, ok := key.FromContext(r.Context())
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing_api_key", "Authorization required")
+				return
+			}
+
+			for _, scope := range scopes {
+				if !k.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(scopes, " ")))
+					writeError(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("API key is missing the %s scope", scope))
+					return
+				}
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireOrganization middleware to reject keys that do not act for the
+// organization named by the URL parameter param with 403, see key.ActsFor.
+// It must run after ValidateApiKey.
+func RequireOrganization(param string) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, ok := key.FromContext(r.Context())
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing_api_key", "Authorization required")
+				return
+			}
+
+			if !k.ActsFor(chi.URLParam(r, param)) {
+				writeError(w, http.StatusForbidden, "wrong_organization", "API key does not act for this organization")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
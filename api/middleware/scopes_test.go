@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireScopes(t *testing.T) {
+	h := RequireScopes(key.ScopeOrgsRead, key.ScopeOrgsWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		key        *key.Key
+		wantStatus int
+	}{
+		{name: "no key", key: nil, wantStatus: http.StatusUnauthorized},
+		{name: "read only", key: &key.Key{Scopes: []string{key.ScopeOrgsRead}}, wantStatus: http.StatusForbidden},
+		{name: "read and write", key: &key.Key{Scopes: []string{key.ScopeOrgsRead, key.ScopeOrgsWrite}}, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/orgs", nil)
+			if tt.key != nil {
+				req = req.WithContext(key.NewContext(req.Context(), *tt.key))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
+
+func TestRequireOrganization(t *testing.T) {
+	r := chi.NewRouter()
+	r.With(RequireOrganization("org_id")).Get("/orgs/{org_id}/holds", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		key        *key.Key
+		wantStatus int
+	}{
+		{name: "no key", key: nil, wantStatus: http.StatusUnauthorized},
+		{name: "unbound", key: &key.Key{Scopes: []string{key.ScopeOrgsWrite}}, wantStatus: http.StatusForbidden},
+		{name: "other organization", key: &key.Key{OrganizationID: "org2"}, wantStatus: http.StatusForbidden},
+		{name: "own organization", key: &key.Key{OrganizationID: "org1"}, wantStatus: http.StatusOK},
+		{name: "administrator", key: &key.Key{Scopes: []string{key.ScopeOrgsAdmin}}, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/orgs/org1/holds", nil)
+			if tt.key != nil {
+				req = req.WithContext(key.NewContext(req.Context(), *tt.key))
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
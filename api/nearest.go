@@ -0,0 +1,447 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+)
+
+const (
+	DefaultNearestLimit = 10
+	MaxNearestLimit     = 50
+	// DefaultUpdatedWithin is how recent capacity must be for the available
+	// filter unless the request says otherwise.
+	DefaultUpdatedWithin = 24 * time.Hour
+)
+
+// errInvalidNearestCursor is returned for a malformed nearest search cursor.
+var errInvalidNearestCursor = errors.New("invalid cursor")
+
+type organizationWithDistance struct {
+	core.Organization
+	// Distance from the searched location in kilometers
+	Distance float64 `json:"distance"`
+	// MatchedServices are the requested services the organization covers
+	MatchedServices []string `json:"matched_services"`
+}
+
+// nearestPage is one page of a nearest search. NextCursor is empty on the last page.
+type nearestPage struct {
+	Organizations []organizationWithDistance `json:"organizations"`
+	NextCursor    string                     `json:"next_cursor,omitempty"`
+	// RadiusKm is the distance the search was limited to when the request
+	// did not set radius_km, as open searches are.
+	RadiusKm float64 `json:"radius_km,omitempty"`
+}
+
+// nearestCursor is the position after the last result of a page. Results are
+// ordered by distance, then ID.
+type nearestCursor struct {
+	Distance float64 `json:"d"`
+	ID       string  `json:"id"`
+}
+
+func (c nearestCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeNearestCursor(s string) (*nearestCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidNearestCursor
+	}
+	var c nearestCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errInvalidNearestCursor
+	}
+	return &c, nil
+}
+
+// Match modes of the nearest search.
+const (
+	// MatchAll keeps organizations offering every requested service (the default).
+	MatchAll = "all"
+	// MatchAny keeps organizations offering at least one requested service.
+	MatchAny = "any"
+	// MatchAtLeast keeps organizations offering at least min_matches of them.
+	MatchAtLeast = "at_least"
+)
+
+// minMatches translates a match mode into storage.ServiceMatch.MinMatches.
+func minMatches(mode string, n int, services []core.Service) (int, error) {
+	switch mode {
+	case "", MatchAll:
+		return 0, nil
+	case MatchAny:
+		return 1, nil
+	case MatchAtLeast:
+		if n < 1 || n > len(services) {
+			return 0, fmt.Errorf("min_matches must be between 1 and %d", len(services))
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("match must be %s, %s or %s", MatchAll, MatchAny, MatchAtLeast)
+	}
+}
+
+// nearestRequest holds the parameters of a nearest search.
+type nearestRequest struct {
+	Services  []string `json:"services"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	// IncludeSubcategories also matches organizations offering a
+	// service below a requested category
+	IncludeSubcategories bool    `json:"include_subcategories"`
+	Limit                int     `json:"limit"`
+	RadiusKm             float64 `json:"radius_km"`
+	Cursor               string  `json:"cursor"`
+	Match                string  `json:"match"`
+	MinMatches           int     `json:"min_matches"`
+	// OpenNow and OpenAt keep the organizations open now or at that time
+	OpenNow bool       `json:"open_now"`
+	OpenAt  *time.Time `json:"open_at"`
+	// Available keeps the services with capacity left, updated within the
+	// UpdatedWithin duration (e.g. "6h")
+	Available     bool   `json:"available"`
+	UpdatedWithin string `json:"updated_within"`
+}
+
+// updatedSince returns the oldest capacity update the available filter
+// accepts at now.
+func (req nearestRequest) updatedSince(now time.Time) (time.Time, error) {
+	within := DefaultUpdatedWithin
+	if req.UpdatedWithin != "" {
+		d, err := time.ParseDuration(req.UpdatedWithin)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("updated_within must be a positive duration such as 6h")
+		}
+		within = d
+	}
+	return now.Add(-within), nil
+}
+
+func (req nearestRequest) validate() error {
+	if req.Latitude < -90 || req.Latitude > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if req.Longitude < -180 || req.Longitude > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if len(req.Services) == 0 {
+		return errors.New("services is required")
+	}
+	if req.Limit < 0 || req.RadiusKm < 0 {
+		return errors.New("limit and radius_km must not be negative")
+	}
+	if req.OpenNow && req.OpenAt != nil {
+		return errors.New("open_now and open_at cannot be combined")
+	}
+	if (req.OpenNow || req.OpenAt != nil) && req.RadiusKm > storage.MaxOpenSearchRadiusKm {
+		return fmt.Errorf("radius_km must be at most %d with open_now or open_at", storage.MaxOpenSearchRadiusKm)
+	}
+	return nil
+}
+
+// hasNearestQuery reports whether the search parameters are in the query
+// string rather than the body.
+func hasNearestQuery(query url.Values) bool {
+	return query.Has("lat") || query.Has("lon") || query.Has("services")
+}
+
+// parseNearestQuery reads the nearest search query parameters:
+//
+//	lat, lon               the location to search around, both required
+//	services               comma separated service IDs
+//	include_subcategories  true to also match subcategories
+//	limit, radius_km       as in the body form
+//	cursor                 next_cursor of the previous page
+//	match, min_matches     the match mode
+//	open_now               true to keep the organizations open now
+//	open_at                RFC 3339 time to keep the organizations open then
+//	available              true to keep the services with capacity left
+//	updated_within         how recent that capacity must be, 24h by default
+func parseNearestQuery(query url.Values) (nearestRequest, error) {
+	req := nearestRequest{
+		Cursor: query.Get("cursor"),
+		Match:  query.Get("match"),
+	}
+	for _, ids := range query["services"] {
+		for _, id := range strings.Split(ids, ",") {
+			if id != "" {
+				req.Services = append(req.Services, id)
+			}
+		}
+	}
+
+	if !query.Has("lat") || !query.Has("lon") {
+		return req, errors.New("lat and lon are required")
+	}
+	floats := []struct {
+		name string
+		dst  *float64
+	}{
+		{"lat", &req.Latitude},
+		{"lon", &req.Longitude},
+		{"radius_km", &req.RadiusKm},
+	}
+	for _, f := range floats {
+		if v := query.Get(f.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return req, fmt.Errorf("%s must be a number", f.name)
+			}
+			*f.dst = n
+		}
+	}
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"limit", &req.Limit},
+		{"min_matches", &req.MinMatches},
+	}
+	for _, i := range ints {
+		if v := query.Get(i.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return req, fmt.Errorf("%s must be an integer", i.name)
+			}
+			*i.dst = n
+		}
+	}
+	if v := query.Get("include_subcategories"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, errors.New("include_subcategories must be true or false")
+		}
+		req.IncludeSubcategories = b
+	}
+	if v := query.Get("open_now"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, errors.New("open_now must be true or false")
+		}
+		req.OpenNow = b
+	}
+	if v := query.Get("available"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, errors.New("available must be true or false")
+		}
+		req.Available = b
+	}
+	req.UpdatedWithin = query.Get("updated_within")
+	if v := query.Get("open_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return req, errors.New("open_at must be an RFC 3339 time")
+		}
+		req.OpenAt = &t
+	}
+	return req, nil
+}
+
+// GetNearestOrganizationHandler lists the organizations offering the
+// requested services, closest first. The search is read from the query
+// string (GET /services/nearest?lat=..&lon=..&services=1,2) or, for complex
+// queries, from a JSON body. It may set limit (k), radius_km, the cursor of
+// the previous page and a match mode: all requested services (the default),
+// any of them, or at_least min_matches of them. With open_now or open_at,
+// only organizations open at that time for enough of them are listed. With
+// available, only services with recently updated capacity left count.
+func GetNearestOrganizationHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req nearestRequest
+		if query := r.URL.Query(); r.Method == http.MethodGet && hasNearestQuery(query) {
+			var err error
+			req, err = parseNearestQuery(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			// Parse the request body
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cursor, err := decodeNearestCursor(req.Cursor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Validate the services
+		services, err := store.GetServicesByID(req.Services)
+		if err != nil {
+			http.Error(w, "One or more services do not exist", http.StatusBadRequest)
+			return
+		}
+
+		matchCount, err := minMatches(req.Match, req.MinMatches, services)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Find organizations offering enough of the specified services
+		match := storage.ServiceMatch{
+			ServiceIDs:         req.Services,
+			IncludeDescendants: req.IncludeSubcategories,
+			MinMatches:         matchCount,
+			Available:          req.Available,
+		}
+		if req.Available {
+			match.UpdatedSince, err = req.updatedSince(time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		limit := req.Limit
+		if limit == 0 {
+			limit = DefaultNearestLimit
+		}
+		if limit > MaxNearestLimit {
+			limit = MaxNearestLimit
+		}
+		query := storage.NearestQuery{
+			Latitude:  req.Latitude,
+			Longitude: req.Longitude,
+			Match:     match,
+			// Fetch one extra result to learn whether there is a next page
+			Limit:    limit + 1,
+			RadiusKm: req.RadiusKm,
+			OpenAt:   req.OpenAt,
+		}
+		if req.OpenNow {
+			now := time.Now()
+			query.OpenAt = &now
+		}
+		page := nearestPage{Organizations: []organizationWithDistance{}}
+		if query.OpenAt != nil && query.RadiusKm == 0 {
+			// Reported, so clients know farther organizations were not searched
+			query.RadiusKm = storage.MaxOpenSearchRadiusKm
+			page.RadiusKm = query.RadiusKm
+		}
+		if cursor != nil {
+			query.After = &storage.NearestPosition{DistanceKm: cursor.Distance, ID: cursor.ID}
+		}
+
+		nearby, err := store.NearestOrganizations(query)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if len(nearby) > limit {
+			last := nearby[limit-1]
+			page.NextCursor = nearestCursor{Distance: last.DistanceKm, ID: last.Organization.ID}.encode()
+			nearby = nearby[:limit]
+		}
+		for _, n := range nearby {
+			page.Organizations = append(page.Organizations, organizationWithDistance{
+				Organization:    n.Organization,
+				Distance:        n.DistanceKm,
+				MatchedServices: n.MatchedServiceIDs,
+			})
+		}
+
+		// The requested categories may only be offered through subcategories
+		var parents map[string]string
+		if req.IncludeSubcategories {
+			catalog, err := store.GetPredefinedServices()
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			parents = make(map[string]string, len(catalog))
+			for _, svc := range catalog {
+				parents[svc.ID] = svc.ParentID
+			}
+		}
+
+		// The services and translations of the whole page are loaded at once
+		orgIDs := make([]string, len(page.Organizations))
+		for i := range page.Organizations {
+			orgIDs[i] = page.Organizations[i].Organization.ID
+		}
+		offered, err := store.GetServicesByOrganizationIDs(orgIDs)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		languages := requestLanguages(r)
+		var orgTranslations map[string]map[string]core.OrganizationTranslation
+		var serviceTranslations map[string]map[string]string
+		if len(languages) > 0 && len(orgIDs) > 0 {
+			orgTranslations, err = store.GetOrganizationTranslationsByIDs(orgIDs)
+			if err == nil {
+				serviceTranslations, err = store.GetServiceTranslations()
+			}
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		for i := range page.Organizations {
+			org := &page.Organizations[i].Organization
+			// The offered services carry their capacity
+			org.Services = coveredServices(offered[org.ID], page.Organizations[i].MatchedServices, parents)
+			if len(languages) > 0 {
+				translateOrganization(languages, org, orgTranslations[org.ID])
+				translateServices(languages, org.Services, serviceTranslations)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Language")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// coveredServices returns the services whose IDs are in matched or, when
+// parents maps service IDs to their parent category, that descend from one.
+func coveredServices(services []core.Service, matched []string, parents map[string]string) []core.Service {
+	isMatched := make(map[string]bool, len(matched))
+	for _, id := range matched {
+		isMatched[id] = true
+	}
+	covers := func(id string) bool {
+		// Bound the walk in case the catalog has a cycle
+		for depth := 0; id != "" && depth <= len(parents); depth++ {
+			if isMatched[id] {
+				return true
+			}
+			id = parents[id]
+		}
+		return false
+	}
+
+	covered := []core.Service{}
+	for _, svc := range services {
+		if covers(svc.ID) {
+			covered = append(covered, svc)
+		}
+	}
+	return covered
+}
@@ -1,16 +1,18 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/CTRL-Impact-Team4/khair-backend/core"
 	"github.com/CTRL-Impact-Team4/khair-backend/storage"
 	"github.com/go-chi/chi/v5"
 )
 
-func PostOrgsHandler(store *sql.DB) http.HandlerFunc {
+func PostOrgsHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -25,7 +27,7 @@ func PostOrgsHandler(store *sql.DB) http.HandlerFunc {
 		}
 
 		// Insert the new organization into the database
-		err := storage.CreateOrganization(store, org)
+		err := store.CreateOrganization(org)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -42,12 +44,14 @@ func PostOrgsHandler(store *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetOrgByID(store *sql.DB) http.HandlerFunc {
+// GetOrgByID returns an organization with its services and opening hours,
+// translated into the language negotiated by requestLanguages.
+func GetOrgByID(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		orgID := chi.URLParam(r, "org_id")
-		org, err := storage.GetOrganizationByID(store, orgID)
+		org, err := store.GetOrganizationByID(orgID)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if errors.Is(err, storage.ErrNotFound) {
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			} else {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -55,7 +59,7 @@ func GetOrgByID(store *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		services, err := storage.GetServicesByOrganizationID(store, orgID)
+		services, err := store.GetServicesByOrganizationID(orgID)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
@@ -63,6 +67,15 @@ func GetOrgByID(store *sql.DB) http.HandlerFunc {
 
 		org.Services = services
 
+		if err := addOpeningHours(store, &org); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := localizeOrganization(store, requestLanguages(r), &org); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
 		jsonResponse, err := json.Marshal(org)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -70,25 +83,224 @@ func GetOrgByID(store *sql.DB) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Language")
 		w.WriteHeader(http.StatusOK)
 		w.Write(jsonResponse)
 	}
 }
 
-func DeleteOrgByID(store *sql.DB) http.HandlerFunc {
+// DeleteOrgByID deletes an organization and its service associations. With
+// ?mode=archive the organization is archived instead and can be restored by
+// an administrator.
+func DeleteOrgByID(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		orgID := chi.URLParam(r, "org_id")
-		err := storage.DeleteOrganizationByID(store, orgID)
+
+		var err error
+		switch mode := r.URL.Query().Get("mode"); mode {
+		case "", "delete":
+			err = store.DeleteOrganizationByID(orgID)
+		case "archive":
+			err = store.ArchiveOrganization(orgID)
+		default:
+			http.Error(w, "mode must be delete or archive", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if errors.Is(err, storage.ErrNotFound) {
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			} else {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
 			return
 		}
-		// TODO: delete association from org/service table
 
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+// RestoreOrgByID brings back an organization archived with DELETE ?mode=archive.
+func RestoreOrgByID(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		err := store.RestoreOrganization(orgID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		org, err := store.GetOrganizationByID(orgID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeUpdatedOrganization(w, store, org)
+	}
+}
+
+// writeUpdatedOrganization responds with org and its current services.
+func writeUpdatedOrganization(w http.ResponseWriter, store storage.Store, org core.Organization) {
+	services, err := store.GetServicesByOrganizationID(org.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	org.Services = services
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(org)
+}
+
+// PutOrgByID replaces an organization's name, phone and location. Services
+// are managed through /orgs/{org_id}/services and are not changed.
+func PutOrgByID(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+
+		var org core.Organization
+		if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if org.ID != "" && org.ID != orgID {
+			http.Error(w, "id in body does not match the URL", http.StatusBadRequest)
+			return
+		}
+		org.ID = orgID
+
+		err := store.UpdateOrganization(org)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		writeUpdatedOrganization(w, store, org)
+	}
+}
+
+// PatchOrgByID applies a JSON merge patch (RFC 7386) to an organization, e.g.
+// {"phone": "555-0100", "location": {"latitude": 40.7}}.
+func PatchOrgByID(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+
+		var patch interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			http.Error(w, "merge patch must be a JSON object", http.StatusBadRequest)
+			return
+		}
+
+		org, err := store.GetOrganizationByID(orgID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		patched, err := applyMergePatch(org, patch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if patched.ID != orgID {
+			http.Error(w, "id cannot be changed", http.StatusBadRequest)
+			return
+		}
+
+		err = store.UpdateOrganization(patched)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		writeUpdatedOrganization(w, store, patched)
+	}
+}
+
+// parseListOptions reads the list query parameters:
+//
+//	sort        name (default) or created_at, prefixed with - for descending order
+//	service_id  only organizations offering all of these comma separated services
+//	name        only organizations whose name contains this, ignoring case
+//	limit       page size, at most storage.MaxListLimit
+//	cursor      next_cursor of the previous page
+func parseListOptions(r *http.Request) (storage.ListOrganizationsOptions, error) {
+	query := r.URL.Query()
+
+	opts := storage.ListOrganizationsOptions{
+		NameContains: query.Get("name"),
+		Cursor:       query.Get("cursor"),
+	}
+	opts.SortBy = strings.TrimPrefix(query.Get("sort"), "-")
+	opts.Descending = strings.HasPrefix(query.Get("sort"), "-")
+	for _, ids := range query["service_id"] {
+		for _, id := range strings.Split(ids, ",") {
+			if id != "" {
+				opts.ServiceIDs = append(opts.ServiceIDs, id)
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return opts, errors.New("limit must be a positive integer")
+		}
+		opts.Limit = n
+	}
+	return opts, nil
+}
+
+func listOrgs(store storage.Store, archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseListOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Archived = archived
+
+		page, err := store.ListOrganizations(opts)
+		if err != nil {
+			if errors.Is(err, storage.ErrInvalidCursor) || errors.Is(err, storage.ErrInvalidSort) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// ListOrgsHandler lists organizations a page at a time, see parseListOptions.
+func ListOrgsHandler(store storage.Store) http.HandlerFunc {
+	return listOrgs(store, false)
+}
+
+// ListArchivedOrgsHandler is ListOrgsHandler for archived organizations.
+func ListArchivedOrgsHandler(store storage.Store) http.HandlerFunc {
+	return listOrgs(store, true)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+// referralRequest is the body of a new referral from the organization in the URL.
+type referralRequest struct {
+	ToOrganizationID string `json:"to_organization_id"`
+	ServiceID        string `json:"service_id"`
+	Notes            string `json:"notes"`
+}
+
+// referralUpdateRequest is the body of PATCH /orgs/{org_id}/referrals/{referral_id}.
+// Omitted fields are left unchanged.
+type referralUpdateRequest struct {
+	Status *core.ReferralStatus `json:"status"`
+	Notes  *string              `json:"notes"`
+}
+
+// writeReferral encodes a referral with status, mapping referral errors to responses.
+func writeReferral(w http.ResponseWriter, referral core.Referral, err error, status int) {
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case errors.Is(err, storage.ErrInvalidReferral):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, storage.ErrReferralTransition):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(referral)
+}
+
+// PostReferralHandler refers a client from the organization in the URL to
+// another organization offering the service, e.g.
+// {"to_organization_id": "shelter", "service_id": "1", "notes": "..."}.
+func PostReferralHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req referralRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ToOrganizationID == "" || req.ServiceID == "" {
+			http.Error(w, "to_organization_id and service_id are required", http.StatusBadRequest)
+			return
+		}
+
+		referral, err := store.CreateReferral(core.Referral{
+			FromOrganizationID: chi.URLParam(r, "org_id"),
+			ToOrganizationID:   req.ToOrganizationID,
+			ServiceID:          req.ServiceID,
+			Notes:              req.Notes,
+		})
+		writeReferral(w, referral, err, http.StatusCreated)
+	}
+}
+
+// ListOrgReferralsHandler lists the referrals an organization sent or
+// received, newest first. The direction query parameter keeps only sent or
+// received ones and status only those with that status.
+func ListOrgReferralsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := storage.ReferralFilter{
+			OrganizationID: chi.URLParam(r, "org_id"),
+			Direction:      query.Get("direction"),
+			Status:         core.ReferralStatus(query.Get("status")),
+		}
+		switch filter.Direction {
+		case "", storage.ReferralsSent, storage.ReferralsReceived:
+		default:
+			http.Error(w, "direction must be sent or received", http.StatusBadRequest)
+			return
+		}
+		switch filter.Status {
+		case "", core.ReferralPending, core.ReferralAccepted, core.ReferralDeclined, core.ReferralCompleted, core.ReferralCancelled:
+		default:
+			http.Error(w, "status must be pending, accepted, declined, completed or cancelled", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := store.GetOrganizationByID(filter.OrganizationID); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		referrals, err := store.ListReferrals(filter)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(referrals)
+	}
+}
+
+// GetReferralHandler returns a referral the organization in the URL sent or
+// received; anyone else's is reported as missing.
+func GetReferralHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		referral, err := store.GetReferral(chi.URLParam(r, "referral_id"))
+		if err == nil && referral.FromOrganizationID != orgID && referral.ToOrganizationID != orgID {
+			err = storage.ErrNotFound
+		}
+		writeReferral(w, referral, err, http.StatusOK)
+	}
+}
+
+// PatchReferralHandler lets either side of a referral act on it with
+// {"status": ..., "notes": ...}: the receiving organization accepts or
+// declines it, either marks it completed once accepted, and the referring
+// organization cancels it until then. Notes from the receiving organization
+// are its response_notes. Changes the referral's status does not allow
+// answer 409.
+func PatchReferralHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req referralUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		referral, err := store.UpdateReferral(chi.URLParam(r, "org_id"), chi.URLParam(r, "referral_id"), storage.ReferralUpdate{
+			Status: req.Status,
+			Notes:  req.Notes,
+		})
+		writeReferral(w, referral, err, http.StatusOK)
+	}
+}
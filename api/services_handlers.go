@@ -1,9 +1,8 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
-	"math"
+	"errors"
 	"net/http"
 
 	core "github.com/CTRL-Impact-Team4/khair-backend/core"
@@ -11,31 +10,70 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
-func GetServices(store *sql.DB) http.HandlerFunc {
+// serviceNode is a catalog service with its subcategories.
+type serviceNode struct {
+	core.Service
+	Children []*serviceNode `json:"children,omitempty"`
+}
+
+// buildServiceTree nests services under their parents, keeping their order.
+// Services whose parent is not in the list become roots.
+func buildServiceTree(services []core.Service) []*serviceNode {
+	nodes := make(map[string]*serviceNode, len(services))
+	for _, svc := range services {
+		nodes[svc.ID] = &serviceNode{Service: svc}
+	}
+
+	roots := []*serviceNode{}
+	for _, svc := range services {
+		node := nodes[svc.ID]
+		if parent, ok := nodes[svc.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// GetServices returns the service catalog as a flat list, or as a tree of
+// categories with ?tree=true. Names are translated as negotiated by
+// requestLanguages.
+func GetServices(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		services, err := storage.GetPredefinedServices(store)
+		services, err := store.GetPredefinedServices()
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		if err := localizeServices(store, requestLanguages(r), services); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 
-		jsonResponse, err := json.Marshal(services)
+		var response interface{} = services
+		if r.URL.Query().Get("tree") == "true" {
+			response = buildServiceTree(services)
+		}
+
+		jsonResponse, err := json.Marshal(response)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Language")
 		w.WriteHeader(http.StatusOK)
 		w.Write(jsonResponse)
 	}
 }
 
-func PostServicesByOrgIDHandler(db *sql.DB) http.HandlerFunc {
+func PostServicesByOrgIDHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		orgID := chi.URLParam(r, "org_id")
 
-		_, err := storage.GetOrganizationByID(db, orgID)
+		_, err := store.GetOrganizationByID(orgID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -48,14 +86,18 @@ func PostServicesByOrgIDHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Validate that services exist in the predefined list
-		services, err := storage.GetServicesByID(db, serviceIDs)
+		services, err := store.GetServicesByID(serviceIDs)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		if !checkNotDeprecated(w, store, orgID, services) {
+			return
+		}
+
 		// Associate the services with the organization
-		err = storage.AddServicesToOrganization(db, orgID, serviceIDs)
+		err = store.AddServicesToOrganization(orgID, serviceIDs)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
@@ -68,19 +110,15 @@ func PostServicesByOrgIDHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetServicesByOrgIDHandler(db *sql.DB) http.HandlerFunc {
+// PutServicesByOrgIDHandler replaces the whole set of services of an
+// organization with the service IDs in the body, in one transaction.
+func PutServicesByOrgIDHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		orgID := chi.URLParam(r, "org_id")
 
-		_, err := storage.GetOrganizationByID(db, orgID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-
-		services, err := storage.GetServicesByOrganizationID(db, orgID)
+		_, err := store.GetOrganizationByID(orgID)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if errors.Is(err, storage.ErrNotFound) {
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			} else {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -88,8 +126,29 @@ func GetServicesByOrgIDHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if len(services) == 0 {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		var serviceIDs []string
+		if err := json.NewDecoder(r.Body).Decode(&serviceIDs); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// Validate that services exist in the predefined list
+		services := []core.Service{}
+		if len(serviceIDs) > 0 {
+			services, err = store.GetServicesByID(serviceIDs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !checkNotDeprecated(w, store, orgID, services) {
+			return
+		}
+
+		err = store.ReplaceOrganizationServices(orgID, serviceIDs)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
@@ -99,53 +158,49 @@ func GetServicesByOrgIDHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// Haversine function to calculate distance between two coordinates
-func haversine(lat1, lon1, lat2, lon2 float64) float64 {
-	const R = 6371 // Earth radius in kilometers
-	lat1Rad, lon1Rad := lat1*math.Pi/180, lon1*math.Pi/180
-	lat2Rad, lon2Rad := lat2*math.Pi/180, lon2*math.Pi/180
-
-	dlat := lat2Rad - lat1Rad
-	dlon := lon2Rad - lon1Rad
-
-	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
-		math.Cos(lat1Rad)*math.Cos(lat2Rad)*
-			math.Sin(dlon/2)*math.Sin(dlon/2)
-	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
-
-	return R * c
-}
-
-func GetNearestOrganizationHandler(db *sql.DB) http.HandlerFunc {
+// DeleteServiceByOrgIDHandler stops an organization offering one service.
+func DeleteServiceByOrgIDHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Services  []string `json:"services"`
-			Latitude  float64  `json:"latitude"`
-			Longitude float64  `json:"longitude"`
-		}
+		orgID := chi.URLParam(r, "org_id")
+		serviceID := chi.URLParam(r, "service_id")
 
-		type organizationWithDistance struct {
-			core.Organization
-			Distance float64 `json:"distance"`
+		_, err := store.GetOrganizationByID(orgID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
 		}
 
-		// Parse the request body
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		err = store.RemoveServiceFromOrganization(orgID, serviceID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
 			return
 		}
 
-		// Validate the services
-		services, err := storage.GetServicesByID(db, req.Services)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func GetServicesByOrgIDHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+
+		_, err := store.GetOrganizationByID(orgID)
 		if err != nil {
-			http.Error(w, "One or more services do not exist", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 
-		// Get organizations offering all specified services
-		orgs, err := storage.GetOrganizationsByServices(db, req.Services)
+		services, err := store.GetServicesByOrganizationID(orgID)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if errors.Is(err, storage.ErrNotFound) {
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			} else {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -153,32 +208,13 @@ func GetNearestOrganizationHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Find the closest organization
-		var closestOrg *organizationWithDistance
-		minDistance := math.MaxFloat64
-
-		for _, org := range orgs {
-			distance := haversine(req.Latitude, req.Longitude, org.Location.Latitude, org.Location.Longitude)
-			if distance < minDistance {
-				minDistance = distance
-				closestOrg = &organizationWithDistance{
-					Organization: org,
-					Distance:     distance,
-				}
-			}
-		}
-
-		// Check if no organization was found
-		if closestOrg == nil {
+		if len(services) == 0 {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 
-		closestOrg.Services = services
-
-		// Return the closest organization
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(closestOrg)
+		json.NewEncoder(w).Encode(services)
 	}
 }
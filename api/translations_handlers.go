@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	core "github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+// writeTranslations responds with translations keyed by language tag.
+func writeTranslations(w http.ResponseWriter, translations interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(translations)
+}
+
+// writeTranslationError maps the error of a translation lookup or change to
+// a response: 404 for an unknown service or organization, 500 otherwise.
+func writeTranslationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrUnknownService) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	} else {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// urlLanguage returns the normalized language tag of the URL. It answers 400
+// and returns false if the tag is invalid.
+func urlLanguage(w http.ResponseWriter, r *http.Request) (string, bool) {
+	lang, ok := normalizeLanguage(chi.URLParam(r, "lang"))
+	if !ok {
+		http.Error(w, "invalid language tag", http.StatusBadRequest)
+	}
+	return lang, ok
+}
+
+// GetServiceTranslationsHandler lists the translated names of a service,
+// e.g. {"ar": "سرير", "fr": "Lit"}.
+func GetServiceTranslationsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceID := chi.URLParam(r, "service_id")
+
+		_, err := store.GetServicesByID([]string{serviceID})
+		if err != nil {
+			writeTranslationError(w, err)
+			return
+		}
+
+		translations, err := store.GetServiceTranslations()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		names := translations[serviceID]
+		if names == nil {
+			names = map[string]string{}
+		}
+		writeTranslations(w, names)
+	}
+}
+
+// PutServiceTranslationHandler sets the name of a service in the language of
+// the URL, e.g. PUT /services/1/translations/fr with {"name": "Lit"}.
+func PutServiceTranslationHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceID := chi.URLParam(r, "service_id")
+		lang, ok := urlLanguage(w, r)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.SetServiceTranslation(serviceID, lang, body.Name)
+		if err != nil {
+			writeTranslationError(w, err)
+			return
+		}
+
+		writeTranslations(w, map[string]string{lang: body.Name})
+	}
+}
+
+// DeleteServiceTranslationHandler removes the name of a service in the
+// language of the URL.
+func DeleteServiceTranslationHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceID := chi.URLParam(r, "service_id")
+		lang, ok := urlLanguage(w, r)
+		if !ok {
+			return
+		}
+
+		err := store.DeleteServiceTranslation(serviceID, lang)
+		if err != nil {
+			writeTranslationError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetOrgTranslationsHandler lists the translated names and descriptions of
+// an organization keyed by language tag.
+func GetOrgTranslationsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+
+		_, err := store.GetOrganizationByID(orgID)
+		if err != nil {
+			writeTranslationError(w, err)
+			return
+		}
+
+		translations, err := store.GetOrganizationTranslations(orgID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeTranslations(w, translations)
+	}
+}
+
+// PutOrgTranslationHandler sets the name and description of an organization
+// in the language of the URL. Either may be left empty to fall back to the
+// default language.
+func PutOrgTranslationHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		lang, ok := urlLanguage(w, r)
+		if !ok {
+			return
+		}
+
+		var t core.OrganizationTranslation
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if t.Name == "" && t.Description == "" {
+			http.Error(w, "name or description is required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.SetOrganizationTranslation(orgID, lang, t)
+		if err != nil {
+			writeTranslationError(w, err)
+			return
+		}
+
+		writeTranslations(w, map[string]core.OrganizationTranslation{lang: t})
+	}
+}
+
+// DeleteOrgTranslationHandler removes the translation of an organization in
+// the language of the URL.
+func DeleteOrgTranslationHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := chi.URLParam(r, "org_id")
+		lang, ok := urlLanguage(w, r)
+		if !ok {
+			return
+		}
+
+		err := store.DeleteOrganizationTranslation(orgID, lang)
+		if err != nil {
+			writeTranslationError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
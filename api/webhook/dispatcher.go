@@ -0,0 +1,259 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+)
+
+const (
+	// DefaultMaxAttempts is how many times a delivery is tried before it is
+	// dead-lettered.
+	DefaultMaxAttempts = 6
+	// DefaultBackoff is the delay before the first retry. It doubles after
+	// every failed attempt, so the defaults give up after about 15 minutes.
+	DefaultBackoff = 30 * time.Second
+	// DefaultPollInterval is how often the dispatcher looks for due retries.
+	DefaultPollInterval = 5 * time.Second
+	// DefaultWorkers is how many deliveries are attempted at once.
+	DefaultWorkers = 4
+	// deliveryTimeout bounds a single attempt, including reading the response.
+	deliveryTimeout = 10 * time.Second
+	// claimTimeout is how long an attempt keeps its delivery from being due
+	// again. An attempt cut short, by a shutdown or a crash, is retried after it.
+	claimTimeout = 2 * deliveryTimeout
+)
+
+// Dispatcher records a delivery for every webhook wanting a published event
+// and sends the deliveries, retrying failures with exponential backoff.
+// Deliveries are recorded as the events are published and persisted before
+// they are sent, so pending retries survive a restart; events published
+// while the dispatcher is not running are not delivered.
+type Dispatcher struct {
+	store  Store
+	client *http.Client
+
+	MaxAttempts  int
+	Backoff      time.Duration
+	PollInterval time.Duration
+	Workers      int
+}
+
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		store: store,
+		client: &http.Client{
+			Timeout: deliveryTimeout,
+			Transport: &http.Transport{
+				// No proxy, which would connect to receivers unchecked
+				Proxy: nil,
+				DialContext: (&net.Dialer{
+					Timeout: deliveryTimeout,
+					Control: dialPublic,
+				}).DialContext,
+				TLSHandshakeTimeout: deliveryTimeout,
+				MaxIdleConnsPerHost: DefaultWorkers,
+			},
+			// A redirect is a failed delivery, not a reason to resend the
+			// payload elsewhere
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		MaxAttempts:  DefaultMaxAttempts,
+		Backoff:      DefaultBackoff,
+		PollInterval: DefaultPollInterval,
+		Workers:      DefaultWorkers,
+	}
+}
+
+// Start records the deliveries of the events published on bus and sends them
+// with Workers goroutines until ctx is cancelled. The returned channel is
+// closed once the attempts in flight have finished.
+func (d *Dispatcher) Start(ctx context.Context, bus *storage.EventBus) <-chan struct{} {
+	// Deliveries are recorded by the write publishing the event, so a slow
+	// receiver cannot make the dispatcher miss events
+	wake := make(chan struct{}, 1)
+	stopHandling := bus.Handle(func(e storage.Event) {
+		if err := d.enqueue(e); err != nil {
+			log.Printf("Failed to record webhook deliveries of event %d: %v", e.ID, err)
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+
+	jobs := make(chan Delivery)
+	var workers sync.WaitGroup
+	for i := 0; i < max(d.Workers, 1); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for delivery := range jobs {
+				d.attempt(ctx, delivery)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer workers.Wait()
+		defer close(jobs)
+		defer stopHandling()
+
+		poll := time.NewTicker(d.PollInterval)
+		defer poll.Stop()
+
+		d.deliverDue(ctx, jobs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+				d.deliverDue(ctx, jobs)
+			case <-poll.C:
+				d.deliverDue(ctx, jobs)
+			}
+		}
+	}()
+	return done
+}
+
+// enqueue records a pending delivery of e for every webhook wanting it.
+func (d *Dispatcher) enqueue(e storage.Event) error {
+	hooks, err := d.store.ListWebhooksForEvent(e.Type)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, h := range hooks {
+		id, err := generateID("dlv_")
+		if err != nil {
+			return err
+		}
+		err = d.store.InsertDelivery(Delivery{
+			ID:            id,
+			WebhookID:     h.ID,
+			EventType:     string(e.Type),
+			Payload:       payload,
+			Status:        StatusPending,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			NextAttemptAt: &now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverDue hands the due deliveries to the workers, oldest first. A
+// delivery handed over twice, e.g. by overlapping passes, is attempted once,
+// see attempt.
+func (d *Dispatcher) deliverDue(ctx context.Context, jobs chan<- Delivery) {
+	due, err := d.store.DueDeliveries(time.Now())
+	if err != nil {
+		log.Printf("Failed to load due webhook deliveries: %v", err)
+		return
+	}
+
+	for _, delivery := range due {
+		select {
+		case jobs <- delivery:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// attempt sends delivery once and records the outcome: delivered, retried
+// after the backoff, or dead once MaxAttempts is reached.
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) {
+	claimedAt := time.Now()
+	claimed, err := d.store.ClaimDelivery(delivery, claimedAt, claimedAt.Add(claimTimeout))
+	if err != nil {
+		log.Printf("Failed to claim webhook delivery %s: %v", delivery.ID, err)
+		return
+	}
+	if !claimed {
+		// Attempted by another worker since it was loaded
+		return
+	}
+
+	h, err := d.store.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		// Deleted since; its deliveries went with it
+		return
+	}
+
+	code, err := d.send(ctx, h, delivery)
+	if ctx.Err() != nil {
+		// Shutting down; the delivery is retried once its claim times out
+		return
+	}
+
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.LastStatusCode = code
+	delivery.LastError = ""
+	delivery.UpdatedAt = now
+	delivery.NextAttemptAt = nil
+	switch {
+	case err == nil:
+		delivery.Status = StatusDelivered
+	case delivery.Attempts >= d.MaxAttempts:
+		delivery.Status = StatusDead
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		next := now.Add(d.Backoff << (delivery.Attempts - 1))
+		delivery.NextAttemptAt = &next
+	}
+
+	if err := d.store.UpdateDelivery(delivery); err != nil {
+		log.Printf("Failed to record webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// send POSTs the signed payload to the webhook. Any response other than 2xx
+// is an error; the status code is returned when there was a response.
+func (d *Dispatcher) send(ctx context.Context, h Webhook, delivery Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderSignature, Sign(h.Secret, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+type createWebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// createWebhookResponse is the only response that ever contains the secret.
+type createWebhookResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// HandleCreateWebhook registers a webhook owned by the calling key.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleCreateWebhook(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := key.FromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var req createWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		h, err := Create(store, caller.ID, req.URL, req.EventTypes)
+		if err != nil {
+			if errors.Is(err, ErrInvalidWebhook) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				log.Printf("Failed to create webhook for key %s: %v", caller.ID, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(createWebhookResponse{Webhook: h, Secret: h.Secret})
+	}
+}
+
+// HandleListWebhooks lists the webhooks of the calling key.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleListWebhooks(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := key.FromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		hooks, err := store.ListWebhooksByKey(caller.ID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(hooks)
+	}
+}
+
+// ownedWebhook loads the webhook named by the webhook_id URL parameter and
+// writes an error response unless it belongs to the calling key. Someone
+// else's webhook is reported as missing rather than leaking that it exists.
+func ownedWebhook(store Store, w http.ResponseWriter, r *http.Request) (Webhook, bool) {
+	caller, ok := key.FromContext(r.Context())
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return Webhook{}, false
+	}
+
+	h, err := store.GetWebhook(chi.URLParam(r, "webhook_id"))
+	if err != nil {
+		if errors.Is(err, ErrWebhookNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return Webhook{}, false
+	}
+	if h.KeyID != caller.ID {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return Webhook{}, false
+	}
+	return h, true
+}
+
+// HandleDeleteWebhook deletes a webhook of the calling key with its delivery
+// log. It must be mounted behind the ValidateApiKey middleware.
+func HandleDeleteWebhook(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := ownedWebhook(store, w, r)
+		if !ok {
+			return
+		}
+
+		if err := store.DeleteWebhook(h.ID); err != nil {
+			log.Printf("Failed to delete webhook: %s, error: %v", h.ID, err)
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleListDeliveries returns the delivery log of a webhook of the calling
+// key, newest first. The status query parameter keeps only pending,
+// delivered or dead deliveries, limit caps the number returned.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleListDeliveries(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		status := query.Get("status")
+		switch status {
+		case "", StatusPending, StatusDelivered, StatusDead:
+		default:
+			http.Error(w, "status must be pending, delivered or dead", http.StatusBadRequest)
+			return
+		}
+		limit := defaultDeliveryLimit
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDeliveryLimit {
+				http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxDeliveryLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		h, ok := ownedWebhook(store, w, r)
+		if !ok {
+			return
+		}
+
+		deliveries, err := store.ListDeliveries(h.ID, status, limit)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
+
+// HandleListDeadLetters returns the deliveries of all webhooks of the calling
+// key that failed every attempt, newest first.
+// It must be mounted behind the ValidateApiKey middleware.
+func HandleListDeadLetters(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := key.FromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		deliveries, err := store.ListDeadLetters(caller.ID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
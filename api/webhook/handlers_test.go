@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authenticated mimics the ValidateApiKey middleware without importing it
+func authenticated(keys key.Store, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, valid, err := key.ValidateKey(keys, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil || !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(key.NewContext(r.Context(), k)))
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	store := setupTestStore(t)
+	keys := key.NewSQLStore(store.db)
+	r := chi.NewRouter()
+	r.Post("/webhooks", authenticated(keys, HandleCreateWebhook(store)))
+	r.Get("/webhooks", authenticated(keys, HandleListWebhooks(store)))
+	r.Get("/webhooks/dead-letters", authenticated(keys, HandleListDeadLetters(store)))
+	r.Delete("/webhooks/{webhook_id}", authenticated(keys, HandleDeleteWebhook(store)))
+	r.Get("/webhooks/{webhook_id}/deliveries", authenticated(keys, HandleListDeliveries(store)))
+
+	call := func(method, target, apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	apiKey, _ := newKey(t, store, "u1")
+	otherKey, _ := newKey(t, store, "u2")
+
+	rec := call(http.MethodPost, "/webhooks", apiKey, `{"url":"not a url"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = call(http.MethodPost, "/webhooks", apiKey, `{"url":"https://example.org/hook","event_types":["nope"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = call(http.MethodPost, "/webhooks", apiKey, `{"url":"https://example.org/hook","event_types":["capacity.changed"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var created createWebhookResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.Secret, "whsec_"))
+
+	rec = call(http.MethodGet, "/webhooks", apiKey, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), created.Secret)
+	var hooks []Webhook
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hooks))
+	require.Len(t, hooks, 1)
+	assert.Equal(t, created.ID, hooks[0].ID)
+
+	rec = call(http.MethodGet, "/webhooks", otherKey, "")
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	now := time.Now().UTC()
+	require.NoError(t, store.InsertDelivery(Delivery{ID: "dlv_1", WebhookID: created.ID, EventType: "capacity.changed", Payload: []byte(`{}`), Status: StatusDead, Attempts: 6, CreatedAt: now, UpdatedAt: now}))
+	require.NoError(t, store.InsertDelivery(Delivery{ID: "dlv_2", WebhookID: created.ID, EventType: "capacity.changed", Payload: []byte(`{}`), Status: StatusDelivered, Attempts: 1, CreatedAt: now.Add(time.Second), UpdatedAt: now}))
+
+	rec = call(http.MethodGet, "/webhooks/"+created.ID+"/deliveries", apiKey, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var deliveries []Delivery
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, "dlv_2", deliveries[0].ID)
+
+	rec = call(http.MethodGet, "/webhooks/"+created.ID+"/deliveries?status=dead", apiKey, "")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "dlv_1", deliveries[0].ID)
+
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodGet, "/webhooks/"+created.ID+"/deliveries?status=lost", apiKey, "").Code)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodGet, "/webhooks/"+created.ID+"/deliveries?limit=0", apiKey, "").Code)
+
+	rec = call(http.MethodGet, "/webhooks/dead-letters", apiKey, "")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "dlv_1", deliveries[0].ID)
+
+	// Other keys cannot see or delete the webhook
+	assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "/webhooks/"+created.ID+"/deliveries", otherKey, "").Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/webhooks/"+created.ID, otherKey, "").Code)
+	assert.JSONEq(t, `[]`, call(http.MethodGet, "/webhooks/dead-letters", otherKey, "").Body.String())
+
+	assert.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/webhooks/"+created.ID, apiKey, "").Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/webhooks/"+created.ID, apiKey, "").Code)
+}
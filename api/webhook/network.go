@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// errPrivateAddress is the error of a delivery to an address outside the
+// public internet.
+var errPrivateAddress = errors.New("webhook receivers must have a public address")
+
+// isPrivateIP reports whether ip is loopback, private, link-local or
+// unspecified, so that webhooks cannot be used to reach the network the
+// server runs in, such as cloud metadata endpoints.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkHost rejects the URLs whose host is a private IP address or localhost.
+// Other names are checked once resolved, when delivering.
+func checkHost(u *url.URL) error {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, errPrivateAddress)
+	}
+	if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, errPrivateAddress)
+	}
+	return nil
+}
+
+// dialPublic is the net.Dialer Control function of deliveries. It runs once
+// the host name is resolved, right before connecting, so names resolving to
+// private addresses are refused too.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
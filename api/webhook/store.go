@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+)
+
+// ErrWebhookNotFound is returned when no stored webhook matches the lookup.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Store persists webhooks and their deliveries.
+type Store interface {
+	InsertWebhook(h Webhook) error
+	GetWebhook(id string) (Webhook, error)
+	// ListWebhooksByKey returns the webhooks of the key, oldest first.
+	ListWebhooksByKey(keyID string) ([]Webhook, error)
+	// DeleteWebhook deletes the webhook and its delivery log.
+	DeleteWebhook(id string) error
+	// ListWebhooksForEvent returns the webhooks of unrevoked keys that want
+	// events of type t.
+	ListWebhooksForEvent(t storage.EventType) ([]Webhook, error)
+
+	InsertDelivery(d Delivery) error
+	// UpdateDelivery saves the status, attempts and last outcome of d.
+	UpdateDelivery(d Delivery) error
+	// DueDeliveries returns the pending deliveries to attempt at now, oldest first.
+	DueDeliveries(now time.Time) ([]Delivery, error)
+	// ClaimDelivery postpones the next attempt of d, as loaded by
+	// DueDeliveries, to until so that it is attempted once. It reports false
+	// if d was attempted or claimed since it was loaded.
+	ClaimDelivery(d Delivery, now, until time.Time) (bool, error)
+	// ListDeliveries returns up to limit deliveries of the webhook, newest
+	// first, optionally only those with status.
+	ListDeliveries(webhookID, status string, limit int) ([]Delivery, error)
+	// ListDeadLetters returns the dead deliveries of all webhooks of the key,
+	// newest first.
+	ListDeadLetters(keyID string) ([]Delivery, error)
+}
+
+// SQLStore implements Store on the webhooks and webhook_deliveries tables
+// created by storage.Migrate.
+type SQLStore struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLStore)(nil)
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+const webhookColumns = `w.id, w.key_id, w.url, w.event_types, w.secret, w.created_at`
+
+const deliveryColumns = `d.id, d.webhook_id, d.event_type, d.payload, d.status, d.attempts, d.last_status_code, d.last_error, d.created_at, d.updated_at, d.next_attempt_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var h Webhook
+	var eventTypes string
+	if err := row.Scan(&h.ID, &h.KeyID, &h.URL, &eventTypes, &h.Secret, &h.CreatedAt); err != nil {
+		return Webhook{}, err
+	}
+	h.EventTypes = strings.Fields(eventTypes)
+	return h, nil
+}
+
+func scanDelivery(row rowScanner) (Delivery, error) {
+	var d Delivery
+	var payload string
+	var next sql.NullTime
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.UpdatedAt, &next)
+	if err != nil {
+		return Delivery{}, err
+	}
+	d.Payload = []byte(payload)
+	if next.Valid {
+		t := next.Time
+		d.NextAttemptAt = &t
+	}
+	return d, nil
+}
+
+func (s *SQLStore) queryWebhooks(query string, args ...interface{}) ([]Webhook, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *SQLStore) queryDeliveries(query string, args ...interface{}) ([]Delivery, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLStore) InsertWebhook(h Webhook) error {
+	_, err := s.db.Exec(`
+		INSERT INTO webhooks (id, key_id, url, event_types, secret, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, h.ID, h.KeyID, h.URL, strings.Join(h.EventTypes, " "), h.Secret, h.CreatedAt)
+	return err
+}
+
+func (s *SQLStore) GetWebhook(id string) (Webhook, error) {
+	h, err := scanWebhook(s.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks w WHERE w.id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return h, err
+}
+
+func (s *SQLStore) ListWebhooksByKey(keyID string) ([]Webhook, error) {
+	return s.queryWebhooks("SELECT "+webhookColumns+" FROM webhooks w WHERE w.key_id = ? ORDER BY w.created_at, w.id", keyID)
+}
+
+func (s *SQLStore) DeleteWebhook(id string) error {
+	result, err := s.db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) ListWebhooksForEvent(t storage.EventType) ([]Webhook, error) {
+	hooks, err := s.queryWebhooks(`
+		SELECT ` + webhookColumns + `
+		FROM webhooks w
+		JOIN api_keys k ON k.id = w.key_id
+		WHERE k.revoked = 0
+		ORDER BY w.created_at, w.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	wanted := hooks[:0]
+	for _, h := range hooks {
+		if h.Wants(t) {
+			wanted = append(wanted, h)
+		}
+	}
+	return wanted, nil
+}
+
+func (s *SQLStore) InsertDelivery(d Delivery) error {
+	_, err := s.db.Exec(`
+		INSERT INTO webhook_deliveries (id, webhook_id, event_type, payload, status, attempts, last_status_code, last_error, created_at, updated_at, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, d.ID, d.WebhookID, d.EventType, string(d.Payload), d.Status, d.Attempts, d.LastStatusCode, d.LastError, d.CreatedAt, d.UpdatedAt, d.NextAttemptAt)
+	return err
+}
+
+func (s *SQLStore) UpdateDelivery(d Delivery) error {
+	result, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, updated_at = ?, next_attempt_at = ?
+		WHERE id = ?
+	`, d.Status, d.Attempts, d.LastStatusCode, d.LastError, d.UpdatedAt, d.NextAttemptAt, d.ID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) DueDeliveries(now time.Time) ([]Delivery, error) {
+	return s.queryDeliveries(`
+		SELECT `+deliveryColumns+`
+		FROM webhook_deliveries d
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id
+	`, StatusPending, now.UTC())
+}
+
+func (s *SQLStore) ClaimDelivery(d Delivery, now, until time.Time) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET next_attempt_at = ?
+		WHERE id = ? AND status = ? AND attempts = ? AND next_attempt_at <= ?
+	`, until.UTC(), d.ID, StatusPending, d.Attempts, now.UTC())
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+func (s *SQLStore) ListDeliveries(webhookID, status string, limit int) ([]Delivery, error) {
+	return s.queryDeliveries(`
+		SELECT `+deliveryColumns+`
+		FROM webhook_deliveries d
+		WHERE d.webhook_id = ? AND (? = '' OR d.status = ?)
+		ORDER BY d.created_at DESC, d.id DESC
+		LIMIT ?
+	`, webhookID, status, status, limit)
+}
+
+func (s *SQLStore) ListDeadLetters(keyID string) ([]Delivery, error) {
+	return s.queryDeliveries(`
+		SELECT `+deliveryColumns+`
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE w.key_id = ? AND d.status = ?
+		ORDER BY d.created_at DESC, d.id DESC
+	`, keyID, StatusDead)
+}
@@ -0,0 +1,167 @@
+// Package webhook notifies partner systems of storage events by POSTing them
+// to URLs registered by API keys.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+)
+
+// Headers sent with every delivery.
+const (
+	// HeaderEvent carries the event type, e.g. capacity.changed.
+	HeaderEvent = "X-Khair-Event"
+	// HeaderDelivery carries the delivery ID, which stays the same across retries.
+	HeaderDelivery = "X-Khair-Delivery"
+	// HeaderSignature carries Sign(secret, body).
+	HeaderSignature = "X-Khair-Signature"
+)
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	// StatusDead marks a delivery that failed every attempt; it is listed as
+	// a dead letter and not retried.
+	StatusDead = "dead"
+)
+
+// EventTypes are the events a webhook can subscribe to.
+var EventTypes = []storage.EventType{
+	storage.EventOrganizationCreated,
+	storage.EventOrganizationUpdated,
+	storage.EventOrganizationDeleted,
+	storage.EventCapacityChanged,
+}
+
+// ErrInvalidWebhook is returned for a webhook with a bad URL or event type.
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// Webhook is a subscription of an API key to events. The secret signing its
+// deliveries is only shown to the caller when it is created.
+type Webhook struct {
+	ID    string `json:"id"`
+	KeyID string `json:"key_id"`
+	URL   string `json:"url"`
+	// EventTypes are the events delivered to URL; empty means all of them.
+	EventTypes []string  `json:"event_types"`
+	Secret     string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Wants reports whether the webhook subscribed to events of type t.
+func (h Webhook) Wants(t storage.EventType) bool {
+	if len(h.EventTypes) == 0 {
+		return true
+	}
+	for _, et := range h.EventTypes {
+		if et == string(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the URL is absolute http(s) to a public host and the event
+// types are known.
+func (h Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	if err := checkHost(u); err != nil {
+		return err
+	}
+	for _, et := range h.EventTypes {
+		known := false
+		for _, t := range EventTypes {
+			if et == string(t) {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidWebhook, et)
+		}
+	}
+	return nil
+}
+
+// Delivery is one event sent, or to be sent, to a webhook. It is the entry
+// of the delivery log.
+type Delivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// LastStatusCode is the response status of the last attempt, zero if
+	// the receiver could not be reached.
+	LastStatusCode int       `json:"last_status_code,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// NextAttemptAt is when a pending delivery is tried next.
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// Sign returns the signature of body sent in HeaderSignature: "sha256="
+// followed by the hex HMAC-SHA256 of body keyed with the webhook secret.
+// Receivers recompute it over the raw request body and compare with
+// hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateID returns prefix followed by 16 random hex characters.
+func generateID(prefix string) (string, error) {
+	bytes := make([]byte, 8)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(bytes), nil
+}
+
+func generateSecret() (string, error) {
+	bytes := make([]byte, 24)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(bytes), nil
+}
+
+// Create validates and persists a new webhook of keyID with a fresh secret.
+func Create(store Store, keyID, rawURL string, eventTypes []string) (Webhook, error) {
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+	h := Webhook{KeyID: keyID, URL: rawURL, EventTypes: eventTypes, CreatedAt: time.Now().UTC()}
+	if err := h.validate(); err != nil {
+		return Webhook{}, err
+	}
+
+	var err error
+	if h.ID, err = generateID("whk_"); err != nil {
+		return Webhook{}, err
+	}
+	if h.Secret, err = generateSecret(); err != nil {
+		return Webhook{}, err
+	}
+	if err := store.InsertWebhook(h); err != nil {
+		return Webhook{}, err
+	}
+	return h, nil
+}
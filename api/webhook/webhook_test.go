@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/CTRL-Impact-Team4/khair-backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestStore(t *testing.T) *SQLStore {
+	db, err := storage.SetupInMemoryDatabase()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewSQLStore(db)
+}
+
+// newKey issues an API key to own webhooks in tests.
+func newKey(t *testing.T, store *SQLStore, ownerID string) (string, key.Key) {
+	apiKey, k, err := key.GenKey(key.NewSQLStore(store.db), key.UserInfo{ID: ownerID, Email: ownerID + "@example.org"}, key.Options{})
+	require.NoError(t, err)
+	return apiKey, k
+}
+
+// receiverURL is the URL webhooks of the tests are registered with; the
+// dispatchers of runDispatcher deliver it to a local receiver.
+const receiverURL = "http://partner.example/hook"
+
+// runDispatcher runs a dispatcher with fast retries until the test ends,
+// delivering every webhook to receiver.
+func runDispatcher(t *testing.T, store Store, bus *storage.EventBus, maxAttempts int, receiver *httptest.Server) *Dispatcher {
+	d := NewDispatcher(store)
+	d.MaxAttempts = maxAttempts
+	d.Backoff = time.Millisecond
+	d.PollInterval = 5 * time.Millisecond
+	if receiver != nil {
+		var dialer net.Dialer
+		d.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, receiver.Listener.Addr().String())
+			},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := d.Start(ctx, bus)
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return d
+}
+
+func TestCreateWebhook(t *testing.T) {
+	store := setupTestStore(t)
+	_, k := newKey(t, store, "u1")
+
+	_, err := Create(store, k.ID, "ftp://example.org", nil)
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	_, err = Create(store, k.ID, "/relative", nil)
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	_, err = Create(store, k.ID, "https://example.org/hook", []string{"organization.exploded"})
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	for _, private := range []string{
+		"http://127.0.0.1:8080/", "http://localhost/", "http://api.localhost./", "http://10.0.0.1/",
+		"http://192.168.1.1/", "http://169.254.169.254/latest/meta-data", "http://[::1]/", "http://0.0.0.0/",
+	} {
+		_, err = Create(store, k.ID, private, nil)
+		assert.ErrorIs(t, err, ErrInvalidWebhook, private)
+	}
+
+	h, err := Create(store, k.ID, "https://example.org/hook", []string{"capacity.changed"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, h.Secret)
+
+	got, err := store.GetWebhook(h.ID)
+	require.NoError(t, err)
+	assert.Equal(t, h.Secret, got.Secret)
+	assert.Equal(t, []string{"capacity.changed"}, got.EventTypes)
+
+	all, err := Create(store, k.ID, "https://example.org/all", nil)
+	require.NoError(t, err)
+	assert.True(t, all.Wants(storage.EventOrganizationCreated))
+
+	hooks, err := store.ListWebhooksForEvent(storage.EventOrganizationCreated)
+	require.NoError(t, err)
+	require.Len(t, hooks, 1)
+	assert.Equal(t, all.ID, hooks[0].ID)
+
+	// Webhooks of revoked keys get nothing
+	require.NoError(t, key.NewSQLStore(store.db).RevokeKey(k.ID))
+	hooks, err = store.ListWebhooksForEvent(storage.EventCapacityChanged)
+	require.NoError(t, err)
+	assert.Empty(t, hooks)
+}
+
+func TestDispatcherRetriesUntilDelivered(t *testing.T) {
+	store := setupTestStore(t)
+	_, k := newKey(t, store, "u1")
+
+	var calls int32
+	received := make(chan *http.Request, 1)
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer receiver.Close()
+
+	h, err := Create(store, k.ID, receiverURL, []string{string(storage.EventCapacityChanged)})
+	require.NoError(t, err)
+
+	bus := storage.NewEventBus()
+	runDispatcher(t, store, bus, 5, receiver)
+	bus.Publish(storage.Event{Type: storage.EventOrganizationCreated, Organization: core.Organization{ID: "org1"}})
+	bus.Publish(storage.Event{Type: storage.EventCapacityChanged, Organization: core.Organization{ID: "org1"}, ServiceID: "1"})
+
+	var r *http.Request
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "webhook not delivered")
+	}
+	assert.Equal(t, "capacity.changed", r.Header.Get(HeaderEvent))
+	assert.Equal(t, Sign(h.Secret, body), r.Header.Get(HeaderSignature))
+	assert.Contains(t, string(body), `"service_id":"1"`)
+
+	var deliveries []Delivery
+	require.Eventually(t, func() bool {
+		deliveries, err = store.ListDeliveries(h.ID, StatusDelivered, 10)
+		return err == nil && len(deliveries) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, r.Header.Get(HeaderDelivery), deliveries[0].ID)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries[0].LastStatusCode)
+	assert.Nil(t, deliveries[0].NextAttemptAt)
+
+	// The organization.created event was filtered out
+	all, err := store.ListDeliveries(h.ID, "", 10)
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	store := setupTestStore(t)
+	_, k := newKey(t, store, "u1")
+
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	h, err := Create(store, k.ID, receiverURL, nil)
+	require.NoError(t, err)
+
+	bus := storage.NewEventBus()
+	runDispatcher(t, store, bus, 3, receiver)
+	bus.Publish(storage.Event{Type: storage.EventOrganizationDeleted, Organization: core.Organization{ID: "org1"}})
+
+	var dead []Delivery
+	require.Eventually(t, func() bool {
+		dead, err = store.ListDeadLetters(k.ID)
+		return err == nil && len(dead) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, h.ID, dead[0].WebhookID)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, dead[0].LastStatusCode)
+	assert.Contains(t, dead[0].LastError, "500")
+
+	// Dead letters are not retried
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Deleting the webhook removes its delivery log
+	require.NoError(t, store.DeleteWebhook(h.ID))
+	dead, err = store.ListDeadLetters(k.ID)
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+	assert.ErrorIs(t, store.DeleteWebhook(h.ID), ErrWebhookNotFound)
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	store := setupTestStore(t)
+	_, k := newKey(t, store, "u1")
+
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer receiver.Close()
+
+	// Registered before its host resolved to a private address
+	h := Webhook{ID: "whk_1", KeyID: k.ID, URL: receiver.URL, Secret: "whsec_1", CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.InsertWebhook(h))
+
+	bus := storage.NewEventBus()
+	runDispatcher(t, store, bus, 1, nil)
+	bus.Publish(storage.Event{Type: storage.EventOrganizationCreated, Organization: core.Organization{ID: "org1"}})
+
+	var dead []Delivery
+	var err error
+	require.Eventually(t, func() bool {
+		dead, err = store.ListDeadLetters(k.ID)
+		return err == nil && len(dead) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Contains(t, dead[0].LastError, errPrivateAddress.Error())
+	assert.Zero(t, dead[0].LastStatusCode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestDispatcherRecordsEveryEvent(t *testing.T) {
+	store := setupTestStore(t)
+	_, k := newKey(t, store, "u1")
+
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	h, err := Create(store, k.ID, receiverURL, nil)
+	require.NoError(t, err)
+
+	// Far more events than a stream subscriber may fall behind by, while
+	// every worker is stuck on a slow receiver
+	bus := storage.NewEventBus()
+	d := runDispatcher(t, store, bus, 1, receiver)
+	const events = 200
+	for i := 0; i < events; i++ {
+		bus.Publish(storage.Event{Type: storage.EventOrganizationUpdated, Organization: core.Organization{ID: "org1"}})
+	}
+
+	deliveries, err := store.ListDeliveries(h.ID, "", 2*events)
+	require.NoError(t, err)
+	assert.Len(t, deliveries, events)
+	assert.Equal(t, DefaultWorkers, d.Workers)
+}
@@ -1,15 +1,63 @@
 package core
 
 import (
+	"time"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Organization struct {
-	ID       string    `json:"id"`
-	Name     string    `json:"name"`
-	Phone    string    `json:"phone"`
-	Location Location  `json:"location"`
-	Services []Service `json:"services"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Phone       string    `json:"phone"`
+	Location    Location  `json:"location"`
+	Services    []Service `json:"services"`
+	// Hours is when the organization is open, if known.
+	Hours *OpeningHours `json:"hours,omitempty"`
+	// ServiceHours are the hours of offered services that differ from the
+	// organization's, keyed by service ID.
+	ServiceHours map[string]OpeningHours `json:"service_hours,omitempty"`
+}
+
+// OpeningHours is a weekly schedule with exceptions for holidays and other
+// special days.
+type OpeningHours struct {
+	// TimeZone is the IANA name of the time zone of the schedule, e.g.
+	// "America/New_York".
+	TimeZone   string             `json:"time_zone"`
+	Weekly     []OpeningPeriod    `json:"weekly"`
+	Exceptions []OpeningException `json:"exceptions,omitempty"`
+}
+
+// OpeningTimes is a span of a day in "15:04" local time. A span closing
+// before it opens runs past midnight, and "24:00" closes at midnight.
+type OpeningTimes struct {
+	Opens  string `json:"opens"`
+	Closes string `json:"closes"`
+}
+
+// OpeningPeriod is a span of time the schedule is open every week.
+type OpeningPeriod struct {
+	// Day is the lowercase English name of the weekday, e.g. "monday".
+	Day string `json:"day"`
+	OpeningTimes
+}
+
+// OpeningException replaces the weekly schedule on one date.
+type OpeningException struct {
+	// Date is the local date in "2006-01-02" format.
+	Date string `json:"date"`
+	// Periods are the opening times on that date; none means closed all day.
+	Periods     []OpeningTimes `json:"periods,omitempty"`
+	Description string         `json:"description,omitempty"`
+}
+
+// OrganizationTranslation is the name and description of an organization in
+// one language. Empty fields fall back to the default language.
+type OrganizationTranslation struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
 }
 
 type Location struct {
@@ -20,6 +68,83 @@ type Location struct {
 type Service struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
+	// Deprecated services stay in the catalog for the organizations already
+	// offering them but cannot be added to any other.
+	Deprecated bool `json:"deprecated,omitempty"`
+	// ParentID is the category this service belongs to, empty for top-level
+	// categories.
+	ParentID string `json:"parent_id,omitempty"`
+	// Capacity is how much of the service an organization has left. It is
+	// only set on the services of an organization that tracks it.
+	Capacity *Capacity `json:"capacity,omitempty"`
+}
+
+// Capacity counts the units of a service an organization offers, such as
+// beds, and how many of them are free.
+type Capacity struct {
+	Total     int       `json:"total"`
+	Available int       `json:"available"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HoldStatus is where a Hold is in its lifecycle.
+type HoldStatus string
+
+const (
+	// HoldHeld takes one unit of the capacity until the hold expires.
+	HoldHeld HoldStatus = "held"
+	// HoldConfirmed means the organization handed out the unit; it is not
+	// given back to the capacity.
+	HoldConfirmed HoldStatus = "confirmed"
+	// HoldReleased and HoldExpired gave the unit back to the capacity.
+	HoldReleased HoldStatus = "released"
+	HoldExpired  HoldStatus = "expired"
+)
+
+// Hold reserves one unit of a capacity tracked service at an organization,
+// such as a bed, for someone on their way there.
+type Hold struct {
+	ID             string     `json:"id"`
+	OrganizationID string     `json:"organization_id"`
+	ServiceID      string     `json:"service_id"`
+	Status         HoldStatus `json:"status"`
+	// Reference lets the caller and the organization match the hold to a
+	// person, e.g. a case number.
+	Reference string    `json:"reference,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// PlacedBy is the ID of the API key that placed the hold, which may look
+	// it up and release it.
+	PlacedBy string `json:"-"`
+}
+
+// ReferralStatus is where a Referral is in its lifecycle.
+type ReferralStatus string
+
+const (
+	ReferralPending   ReferralStatus = "pending"
+	ReferralAccepted  ReferralStatus = "accepted"
+	ReferralDeclined  ReferralStatus = "declined"
+	ReferralCompleted ReferralStatus = "completed"
+	// ReferralCancelled is a referral the referring organization took back.
+	ReferralCancelled ReferralStatus = "cancelled"
+)
+
+// Referral sends a client from one organization to another for a service
+// the receiving organization offers.
+type Referral struct {
+	ID                 string         `json:"id"`
+	FromOrganizationID string         `json:"from_organization_id"`
+	ToOrganizationID   string         `json:"to_organization_id"`
+	ServiceID          string         `json:"service_id"`
+	Status             ReferralStatus `json:"status"`
+	// Notes are written by the referring organization and ResponseNotes by
+	// the receiving one.
+	Notes         string    `json:"notes,omitempty"`
+	ResponseNotes string    `json:"response_notes,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 // OrganizationService is the join table between Organizations and Services
@@ -1,5 +1,15 @@
 #!/bin/bash
 
+# The script creates organizations, so it needs a key with the orgs:write
+# scope, e.g. the administrator key the server was started with:
+#   KHAIR_API_KEY=$KHAIR_ADMIN_KEY ./curl_tests.sh
+KHAIR_API_KEY=${KHAIR_API_KEY:-$KHAIR_ADMIN_KEY}
+if [ -z "$KHAIR_API_KEY" ]; then
+  echo "Error: set KHAIR_API_KEY to a key with the orgs:write scope."
+  exit 1
+fi
+AUTH_HEADER="Authorization: Bearer $KHAIR_API_KEY"
+
 # Function to log messages
 log_message() {
   echo -e "\n$1"
@@ -16,7 +26,7 @@ handle_error() {
 # Step 1: Add the first organization
 log_message "Adding Organization One..."
 response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/orgs \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '{
   "id": "org1",
   "name": "Organization One",
@@ -36,7 +46,7 @@ fi
 # Step 2: Add the second organization
 log_message "Adding Organization Two..."
 response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/orgs \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '{
   "id": "org2",
   "name": "Organization Two",
@@ -55,7 +65,7 @@ fi
 
 log_message "Adding Organization Three with both services..."
 response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/orgs \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '{
   "id": "org3",
   "name": "Organization Three",
@@ -69,7 +79,7 @@ response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/
 # Step 3: Add service "1" to the first organization
 log_message "Adding Service 1 to Organization One..."
 response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/orgs/org1/services \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '["1"]')
 
 if [ "$response" -eq 200 ]; then
@@ -81,7 +91,7 @@ fi
 # Step 4: Add service "2" to the second organization
 log_message "Adding Service 2 to Organization Two..."
 response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/orgs/org2/services \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '["2"]')
 
 if [ "$response" -eq 200 ]; then
@@ -92,19 +102,19 @@ fi
 
 
 log_message "Getting Service 2 from Organization Two..."
-response=$(curl -s -X GET http://localhost:8080/orgs/org2/services -H "Content-Type: application/json")
+response=$(curl -s -X GET http://localhost:8080/orgs/org2/services -H "Content-Type: application/json" -H "$AUTH_HEADER")
 
 log_message "Got Service 2 to Organization Two\n$response"
 
 log_message "Getting Org 2..."
-response=$(curl -s -X GET http://localhost:8080/orgs/org2 -H "Content-Type: application/json")
+response=$(curl -s -X GET http://localhost:8080/orgs/org2 -H "Content-Type: application/json" -H "$AUTH_HEADER")
 
 log_message "Got\n$response"
 
 # Step 6: Add both services to the third organization
 log_message "Adding Services 1 and 2 to Organization Three..."
 response=$(curl -s -w "%{http_code}" -o /dev/null -X POST http://localhost:8080/orgs/org3/services \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '["1", "2"]')
 
 if [ "$response" -eq 200 ]; then
@@ -115,8 +125,8 @@ fi
 
 # Step 5: Test finding the closest organization offering both services
 log_message "Finding closest organization offering both services (1 and 2)..."
-response=$(curl -s -X GET http://localhost:8080/services/nearest \
-  -H "Content-Type: application/json" \
+response=$(curl -s -X POST http://localhost:8080/search \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '{
   "services": ["1", "2"],
   "latitude": 37.7749,
@@ -127,32 +137,22 @@ log_message "Response for both services (1 and 2): $response"
 
 # Step 6: Test finding the closest organization offering only service 1
 log_message "Finding closest organization offering only Service 1..."
-response=$(curl -s -X GET http://localhost:8080/services/nearest \
-  -H "Content-Type: application/json" \
-  -d '{
-  "services": ["1"],
-  "latitude": 37.7749,
-  "longitude": -122.4194
-}')
+response=$(curl -s "http://localhost:8080/services/nearest?lat=37.7749&lon=-122.4194&services=1" \
+  -H "$AUTH_HEADER")
 
 log_message "Response for only Service 1: $response"
 
 # Step 7: Test finding the closest organization offering only service 2
 log_message "Finding closest organization offering only Service 2..."
-response=$(curl -s -X GET http://localhost:8080/services/nearest \
-  -H "Content-Type: application/json" \
-  -d '{
-  "services": ["2"],
-  "latitude": 37.7749,
-  "longitude": -122.4194
-}')
+response=$(curl -s "http://localhost:8080/services/nearest?lat=37.7749&lon=-122.4194&services=2" \
+  -H "$AUTH_HEADER")
 
 log_message "Response for only Service 2: $response"
 
 # Step 8: Test finding an organization that doesn't have both services
 log_message "Testing organization that doesn't have both services (expecting no matches)..."
 response=$(curl -s -X GET http://localhost:8080/services/nearest \
-  -H "Content-Type: application/json" \
+  -H "Content-Type: application/json" -H "$AUTH_HEADER" \
   -d '{
   "services": ["1", "3"], 
   "latitude": 37.7749,
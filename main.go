@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"maps"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
 
 	api "github.com/CTRL-Impact-Team4/khair-backend/api"
+	"github.com/CTRL-Impact-Team4/khair-backend/api/key"
 	mw "github.com/CTRL-Impact-Team4/khair-backend/api/middleware"
+	"github.com/CTRL-Impact-Team4/khair-backend/api/webhook"
 	"github.com/CTRL-Impact-Team4/khair-backend/core"
 	"github.com/CTRL-Impact-Team4/khair-backend/storage"
 
@@ -14,32 +25,221 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 )
 
-const addr = "localhost:8080"
+const (
+	addr          = "localhost:8080"
+	defaultDBPath = "khair.db"
+	// defaultRateLimits are the token buckets per key tier, see mw.ParseRateLimits.
+	// The standard tier also applies to unauthenticated clients by IP.
+	defaultRateLimits = "standard=20:2,partner=200:50"
+	// holdSweepInterval is how often expired holds give their units back
+	holdSweepInterval = time.Minute
+	// shutdownTimeout is how long requests in progress may take to finish
+	// once the server is asked to stop
+	shutdownTimeout = 10 * time.Second
+)
+
+// getenv returns the value of the environment variable key, or fallback when
+// it is unset or empty.
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getenvInt is getenv for integer settings. It exits if the value is not a number.
+func getenvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", key, err)
+	}
+	return n
+}
 
 func main() {
+	// Background work stops on SIGINT or SIGTERM, see the end of main
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
 
-	store, _ := storage.SetupInMemoryDatabase()
-	storage.InsertPredefinedServices(store, []core.Service{
+	dbPath := getenv("KHAIR_DB_PATH", defaultDBPath)
+	db, err := storage.Open(dbPath)
+	if err != nil {
+		log.Fatalf("failed to open database %s: %v", dbPath, err)
+	}
+	defer db.Close()
+	store := storage.NewSQLStore(db)
+	keys := key.NewSQLStore(db)
+	webhooks := webhook.NewSQLStore(db)
+
+	// Seed the initial catalog; further services are managed through the
+	// services:admin endpoints and are kept across restarts
+	err = store.InsertPredefinedServices([]core.Service{
 		{ID: "1", Name: "Bed"},
 		{ID: "2", Name: "Food"},
 	})
+	if err != nil {
+		log.Fatalf("failed to seed services: %v", err)
+	}
+
+	// Bootstrap an administrator key so the first write-scoped keys can be granted
+	if adminKey := os.Getenv("KHAIR_ADMIN_KEY"); adminKey != "" {
+		_, err := key.EnsureKey(keys, adminKey, key.UserInfo{ID: key.AdminOwnerID, Email: getenv("KHAIR_ADMIN_EMAIL", "admin@localhost")}, key.Options{
+			Scopes: key.AllScopes,
+		})
+		if err != nil {
+			log.Fatalf("failed to bootstrap KHAIR_ADMIN_KEY: %v", err)
+		}
+	}
+
+	tiers, err := mw.ParseRateLimits(getenv("KHAIR_RATE_LIMITS", defaultRateLimits))
+	if err != nil {
+		log.Fatalf("invalid KHAIR_RATE_LIMITS: %v", err)
+	}
+	if _, ok := tiers[key.DefaultTier]; !ok {
+		log.Fatalf("KHAIR_RATE_LIMITS must define the %q tier", key.DefaultTier)
+	}
+	// One limiter shared by all routes, so a client has a single bucket
+	rateLimit := mw.RateLimiter(mw.RateLimitConfig{
+		Tiers:   tiers,
+		Default: tiers[key.DefaultTier],
+	})
 
-	authenticationMiddleware := r.With(
-		mw.ValidateApiKey(),
-		middleware.AllowContentType("application/json"),
+	// Key issuance is public so partner apps can self-serve read-only
+	// credentials for a new owner; further keys of an owner are issued to
+	// callers presenting one of its keys. DELETE /keys revokes the key
+	// presented in the Authorization header.
+	public := r.With(rateLimit)
+	public.Post("/keys", key.HandleCreateKey(keys, key.Options{
+		MonthlyCap: getenvInt("KHAIR_DEFAULT_MONTHLY_CAP", 0),
+		Scopes:     []string{key.ScopeOrgsRead},
+	}))
+	public.Delete("/keys", key.HandleDeleteKey(keys))
+
+	// Requests are throttled before they are rejected for their key, so
+	// floods of missing or invalid keys are limited by IP
+	authenticated := r.With(
+		mw.LoadApiKey(keys),
+		rateLimit,
+		mw.ValidateApiKey(keys),
+		middleware.AllowContentType("application/json", "application/merge-patch+json"),
 	)
 
-	authenticationMiddleware.Post("/orgs", api.PostOrgsHandler(store))
-	authenticationMiddleware.Get("/orgs/{org_id}", api.GetOrgByID(store))
-	authenticationMiddleware.Delete("/orgs/{org_id}", api.DeleteOrgByID(store))
-	authenticationMiddleware.Get("/services", api.GetServices(store))
-	authenticationMiddleware.Post("/orgs/{org_id}/services", api.PostServicesByOrgIDHandler(store))
-	authenticationMiddleware.Get("/orgs/{org_id}/services", api.GetServicesByOrgIDHandler(store))
-	authenticationMiddleware.Get("/services/nearest", api.GetNearestOrganizationHandler(store))
+	// Usage is metered last, so requests the key is not authorized for do
+	// not count towards the monthly cap
+	meterUsage := mw.MeterUsage(keys)
+	authenticationMiddleware := authenticated.With(meterUsage)
+	orgsRead := authenticated.With(mw.RequireScopes(key.ScopeOrgsRead), meterUsage)
+	orgsWrite := authenticated.With(mw.RequireScopes(key.ScopeOrgsWrite), meterUsage)
+	orgsAdmin := authenticated.With(mw.RequireScopes(key.ScopeOrgsAdmin), meterUsage)
+	servicesAdmin := authenticated.With(mw.RequireScopes(key.ScopeServicesAdmin), meterUsage)
+	keysAdmin := authenticated.With(mw.RequireScopes(key.ScopeKeysAdmin), meterUsage)
+	holdsWrite := authenticated.With(mw.RequireScopes(key.ScopeHoldsWrite), meterUsage)
+	webhooksWrite := authenticated.With(mw.RequireScopes(key.ScopeWebhooksWrite), meterUsage)
+	// Staff of the organization in {org_id}, with keys bound to it. Every
+	// change to an existing organization goes through it; keys with orgs:write
+	// alone can only create organizations, and orgs:admin acts for all.
+	orgStaff := authenticated.With(mw.RequireScopes(key.ScopeOrgsWrite), mw.RequireOrganization("org_id"), meterUsage)
+
+	// Any valid key may manage the keys of its own owner
+	authenticationMiddleware.Get("/keys", key.HandleListKeys(keys))
+	authenticationMiddleware.Delete("/keys/{key_id}", key.HandleRevokeKey(keys))
+	authenticationMiddleware.Get("/keys/{key_id}/usage", key.HandleKeyUsage(keys))
+	keysAdmin.Patch("/keys/{key_id}", key.HandleUpdateKey(keys, key.UpdateOptions{
+		Tiers: slices.Collect(maps.Keys(tiers)),
+		OrganizationExists: func(orgID string) (bool, error) {
+			_, err := store.GetOrganizationByID(orgID)
+			if errors.Is(err, storage.ErrNotFound) {
+				return false, nil
+			}
+			return err == nil, err
+		},
+	}))
+
+	orgsRead.Get("/orgs", api.ListOrgsHandler(store))
+	orgsWrite.Post("/orgs", api.PostOrgsHandler(store))
+	orgsRead.Get("/orgs/{org_id}", api.GetOrgByID(store))
+	orgStaff.Put("/orgs/{org_id}", api.PutOrgByID(store))
+	orgStaff.Patch("/orgs/{org_id}", api.PatchOrgByID(store))
+	orgStaff.Delete("/orgs/{org_id}", api.DeleteOrgByID(store))
+	orgsRead.Get("/orgs/{org_id}/translations", api.GetOrgTranslationsHandler(store))
+	orgStaff.Put("/orgs/{org_id}/translations/{lang}", api.PutOrgTranslationHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/translations/{lang}", api.DeleteOrgTranslationHandler(store))
+	orgsAdmin.Get("/admin/orgs/archived", api.ListArchivedOrgsHandler(store))
+	orgsAdmin.Post("/admin/orgs/{org_id}/restore", api.RestoreOrgByID(store))
+	orgsRead.Get("/services", api.GetServices(store))
+	servicesAdmin.Post("/services", api.PostServiceHandler(store))
+	servicesAdmin.Patch("/services/{service_id}", api.PatchServiceHandler(store))
+	servicesAdmin.Delete("/services/{service_id}", api.DeleteServiceHandler(store))
+	orgsRead.Get("/services/{service_id}/translations", api.GetServiceTranslationsHandler(store))
+	servicesAdmin.Put("/services/{service_id}/translations/{lang}", api.PutServiceTranslationHandler(store))
+	servicesAdmin.Delete("/services/{service_id}/translations/{lang}", api.DeleteServiceTranslationHandler(store))
+	orgStaff.Post("/orgs/{org_id}/services", api.PostServicesByOrgIDHandler(store))
+	orgStaff.Put("/orgs/{org_id}/services", api.PutServicesByOrgIDHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/services/{service_id}", api.DeleteServiceByOrgIDHandler(store))
+	orgsRead.Get("/orgs/{org_id}/services", api.GetServicesByOrgIDHandler(store))
+	orgStaff.Put("/orgs/{org_id}/hours", api.PutOpeningHoursHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/hours", api.DeleteOpeningHoursHandler(store))
+	orgStaff.Put("/orgs/{org_id}/services/{service_id}/hours", api.PutOpeningHoursHandler(store))
+	orgStaff.Delete("/orgs/{org_id}/services/{service_id}/hours", api.DeleteOpeningHoursHandler(store))
+	orgStaff.Patch("/orgs/{org_id}/services/{service_id}/capacity", api.PatchCapacityHandler(store))
+	// Callers place holds; the organization's staff confirm them. A hold is
+	// seen and released by the key that placed it, which belongs to no
+	// organization, or by the staff, so those handlers check the caller.
+	holdsWrite.Post("/orgs/{org_id}/services/{service_id}/holds", api.PostHoldHandler(store))
+	authenticationMiddleware.Get("/holds/{hold_id}", api.GetHoldHandler(store))
+	orgStaff.Get("/orgs/{org_id}/holds", api.ListOrgHoldsHandler(store))
+	orgStaff.Post("/orgs/{org_id}/holds/{hold_id}/confirm", api.ConfirmHoldHandler(store))
+	authenticationMiddleware.Post("/holds/{hold_id}/release", api.ReleaseHoldHandler(store))
+	// Referrals carry notes about clients, and {org_id} decides which side of
+	// a referral the caller acts for, so only that organization's staff see them
+	orgStaff.Post("/orgs/{org_id}/referrals", api.PostReferralHandler(store))
+	orgStaff.Get("/orgs/{org_id}/referrals", api.ListOrgReferralsHandler(store))
+	orgStaff.Get("/orgs/{org_id}/referrals/{referral_id}", api.GetReferralHandler(store))
+	orgStaff.Patch("/orgs/{org_id}/referrals/{referral_id}", api.PatchReferralHandler(store))
+	orgsRead.Get("/services/nearest", api.GetNearestOrganizationHandler(store))
+	orgsRead.Post("/search", api.GetNearestOrganizationHandler(store))
+	orgsRead.Get("/events", api.StreamEventsHandler(store))
+
+	// Webhooks carry the same data as /events and belong to the key that
+	// registered them. They make the server send requests, so they need a
+	// scope of their own rather than the orgs:read of self-issued keys.
+	webhooksWrite.Post("/webhooks", webhook.HandleCreateWebhook(webhooks))
+	webhooksWrite.Get("/webhooks", webhook.HandleListWebhooks(webhooks))
+	webhooksWrite.Get("/webhooks/dead-letters", webhook.HandleListDeadLetters(webhooks))
+	webhooksWrite.Delete("/webhooks/{webhook_id}", webhook.HandleDeleteWebhook(webhooks))
+	webhooksWrite.Get("/webhooks/{webhook_id}/deliveries", webhook.HandleListDeliveries(webhooks))
+
+	dispatched := webhook.NewDispatcher(webhooks).Start(ctx, store.Events())
+	swept := storage.StartHoldSweeper(ctx, store, holdSweepInterval)
+
+	server := &http.Server{Addr: addr, Handler: r}
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		<-ctx.Done()
+		log.Printf("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("requests still in progress were cut short: %v", err)
+		}
+	}()
 
 	log.Printf("serving http://%s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// Let the last requests, webhook attempts and sweep finish before the
+	// database is closed
+	<-shutDown
+	<-dispatched
+	<-swept
 }
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// ErrInvalidCapacity is returned when the available units are negative or
+// more than the total.
+var ErrInvalidCapacity = errors.New("invalid capacity")
+
+// capacityColumns selects the capacity of organization_services os, to be
+// scanned into a nullCapacity.
+const capacityColumns = "os.capacity_total, os.capacity_available, os.capacity_updated_at"
+
+// nullCapacity holds the nullable capacity columns of a row.
+type nullCapacity struct {
+	total, available sql.NullInt64
+	updatedAt        sql.NullString
+}
+
+// capacity returns nil when the organization does not track the capacity of
+// the service.
+func (c nullCapacity) capacity() (*core.Capacity, error) {
+	if !c.total.Valid {
+		return nil, nil
+	}
+	// The driver reads TIMESTAMP columns as times, which come back here
+	// without trailing zeros in the fraction; RFC 3339 parses either form
+	updatedAt, err := time.Parse(time.RFC3339Nano, c.updatedAt.String)
+	if err != nil {
+		return nil, err
+	}
+	return &core.Capacity{Total: int(c.total.Int64), Available: int(c.available.Int64), UpdatedAt: updatedAt}, nil
+}
+
+// CapacityUpdate changes some of the capacity of a service at an
+// organization. Nil fields are left unchanged, and count as zero where the
+// capacity is not tracked yet.
+type CapacityUpdate struct {
+	Total     *int
+	Available *int
+}
+
+var (
+	// errCapacityOutOfRange is the ErrInvalidCapacity of the range checks.
+	errCapacityOutOfRange = fmt.Errorf("%w: available must be between 0 and total", ErrInvalidCapacity)
+	// errCapacityNeedsTotal is returned by the first update of a capacity
+	// without a total.
+	errCapacityNeedsTotal = fmt.Errorf("%w: total is required until the capacity is tracked", ErrInvalidCapacity)
+)
+
+func validateCapacity(total, available int) error {
+	if total < 0 || available < 0 || available > total {
+		return errCapacityOutOfRange
+	}
+	return nil
+}
+
+// UpdateCapacity applies u to the capacity of a service at an unarchived
+// organization as of now. The first update must set the total. It returns
+// sql.ErrNoRows if the organization does not offer the service.
+func UpdateCapacity(db *sql.DB, orgID, serviceID string, u CapacityUpdate) (core.Capacity, error) {
+	if (u.Total != nil && *u.Total < 0) || (u.Available != nil && *u.Available < 0) {
+		return core.Capacity{}, errCapacityOutOfRange
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return core.Capacity{}, err
+	}
+	defer tx.Rollback()
+
+	// Merge and check in a single statement so concurrent updates each apply
+	// to the latest capacity
+	updatedAt := time.Now().UTC()
+	result, err := tx.Exec(`
+		UPDATE organization_services
+		SET capacity_total = COALESCE(?, capacity_total, 0),
+			capacity_available = COALESCE(?, capacity_available, 0),
+			capacity_updated_at = ?
+		WHERE organization_id = ? AND service_id = ?
+		AND organization_id IN (SELECT id FROM organizations WHERE archived_at IS NULL)
+		AND COALESCE(?, capacity_available, 0) <= COALESCE(?, capacity_total, 0)
+		AND (? IS NOT NULL OR capacity_total IS NOT NULL)
+	`, u.Total, u.Available, updatedAt.Format(createdAtLayout), orgID, serviceID, u.Available, u.Total, u.Total)
+	if err != nil {
+		return core.Capacity{}, err
+	}
+	if err := expectOneRow(result); err != nil {
+		var total sql.NullInt64
+		err := tx.QueryRow(`
+			SELECT os.capacity_total
+			FROM organization_services os
+			JOIN organizations o ON o.id = os.organization_id
+			WHERE os.organization_id = ? AND os.service_id = ? AND o.archived_at IS NULL
+		`, orgID, serviceID).Scan(&total)
+		if err != nil {
+			return core.Capacity{}, err
+		}
+		if !total.Valid && u.Total == nil {
+			return core.Capacity{}, errCapacityNeedsTotal
+		}
+		return core.Capacity{}, errCapacityOutOfRange
+	}
+
+	c := core.Capacity{UpdatedAt: updatedAt}
+	err = tx.QueryRow(`
+		SELECT capacity_total, capacity_available
+		FROM organization_services
+		WHERE organization_id = ? AND service_id = ?
+	`, orgID, serviceID).Scan(&c.Total, &c.Available)
+	if err != nil {
+		return core.Capacity{}, err
+	}
+	return c, tx.Commit()
+}
+
+func (s *SQLStore) UpdateCapacity(orgID, serviceID string, u CapacityUpdate) (core.Capacity, error) {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	c, err := UpdateCapacity(s.db, orgID, serviceID, u)
+	if err != nil {
+		return c, notFound(err)
+	}
+	s.publishCapacity(orgID, serviceID)
+	return c, nil
+}
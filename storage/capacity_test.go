@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTo is the update setting both the total and available units.
+func setTo(total, available int) CapacityUpdate {
+	return CapacityUpdate{Total: &total, Available: &available}
+}
+
+func TestStoreCapacity(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		before := time.Now().UTC()
+		c, err := s.UpdateCapacity("org1", "1", setTo(20, 3))
+		require.NoError(t, err)
+		assert.Equal(t, 20, c.Total)
+		assert.Equal(t, 3, c.Available)
+		assert.False(t, c.UpdatedAt.Before(before))
+
+		services, err := s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		require.Len(t, services, 2)
+		require.NotNil(t, services[0].Capacity)
+		assert.Equal(t, c, *services[0].Capacity)
+		assert.Nil(t, services[1].Capacity)
+
+		page, err := s.ListOrganizations(ListOrganizationsOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "org1", page.Organizations[0].ID)
+		assert.Equal(t, &c, page.Organizations[0].Services[0].Capacity)
+
+		_, err = s.UpdateCapacity("org1", "1", setTo(2, 3))
+		assert.ErrorIs(t, err, ErrInvalidCapacity)
+		_, err = s.UpdateCapacity("org1", "1", setTo(2, -1))
+		assert.ErrorIs(t, err, ErrInvalidCapacity)
+		_, err = s.UpdateCapacity("org2", "2", setTo(2, 1))
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// Replacing the services keeps the capacity of those still offered
+		require.NoError(t, s.ReplaceOrganizationServices("org1", []string{"1"}))
+		services, err = s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		require.Len(t, services, 1)
+		assert.Equal(t, &c, services[0].Capacity)
+
+		// Removing a service forgets its capacity
+		require.NoError(t, s.RemoveServiceFromOrganization("org1", "1"))
+		require.NoError(t, s.AddServicesToOrganization("org1", []string{"1"}))
+		services, err = s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		assert.Nil(t, services[0].Capacity)
+
+		require.NoError(t, s.ArchiveOrganization("org2"))
+		_, err = s.UpdateCapacity("org2", "1", setTo(2, 1))
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestMatchAvailableCapacity(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		_, err := s.UpdateCapacity("org1", "1", setTo(10, 0))
+		require.NoError(t, err)
+		_, err = s.UpdateCapacity("org2", "1", setTo(10, 4))
+		require.NoError(t, err)
+
+		nearest := func(match ServiceMatch) []string {
+			nearby, err := s.NearestOrganizations(NearestQuery{Match: match, Limit: 10})
+			require.NoError(t, err)
+			return nearbyIDs(nearby)
+		}
+
+		assert.Equal(t, []string{"org1", "org2"}, nearest(ServiceMatch{ServiceIDs: []string{"1"}}))
+		assert.Equal(t, []string{"org2"}, nearest(ServiceMatch{ServiceIDs: []string{"1"}, Available: true}))
+		assert.Equal(t, []string{"org2"}, nearest(ServiceMatch{ServiceIDs: []string{"1"}, Available: true, UpdatedSince: time.Now().Add(-time.Hour)}))
+		assert.Empty(t, nearest(ServiceMatch{ServiceIDs: []string{"1"}, Available: true, UpdatedSince: time.Now().Add(time.Hour)}))
+		// Food is not capacity tracked
+		assert.Empty(t, nearest(ServiceMatch{ServiceIDs: []string{"2"}, Available: true}))
+
+		_, err = s.UpdateCapacity("org1", "1", setTo(10, 1))
+		require.NoError(t, err)
+		matches, err := s.MatchOrganizationsByServices(ServiceMatch{ServiceIDs: []string{"1", "2"}, MinMatches: 1, Available: true})
+		require.NoError(t, err)
+		require.Len(t, matches, 2)
+		assert.Equal(t, []string{"1"}, matches[0].MatchedServiceIDs)
+	})
+}
+
+func TestStoreUpdateCapacity(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		n := func(v int) *int { return &v }
+
+		_, err := s.UpdateCapacity("org1", "1", CapacityUpdate{Available: n(2)})
+		assert.ErrorIs(t, err, ErrInvalidCapacity, "the first update sets the total")
+		_, err = s.UpdateCapacity("org1", "1", CapacityUpdate{})
+		assert.ErrorIs(t, err, ErrInvalidCapacity, "the first update sets the total")
+		services, err := s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		assert.Nil(t, services[0].Capacity, "refused updates do not start tracking")
+		c, err := s.UpdateCapacity("org1", "1", CapacityUpdate{Total: n(10), Available: n(5)})
+		require.NoError(t, err)
+		assert.Equal(t, 10, c.Total)
+		assert.Equal(t, 5, c.Available)
+
+		_, err = s.UpdateCapacity("org1", "1", CapacityUpdate{Total: n(4)})
+		assert.ErrorIs(t, err, ErrInvalidCapacity)
+		_, err = s.UpdateCapacity("org1", "1", CapacityUpdate{Available: n(-1)})
+		assert.ErrorIs(t, err, ErrInvalidCapacity)
+		_, err = s.UpdateCapacity("org2", "2", CapacityUpdate{Total: n(1)})
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// Updates of different fields do not undo each other
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, err := s.UpdateCapacity("org1", "1", CapacityUpdate{Total: n(20)})
+				assert.NoError(t, err)
+			}()
+			go func() {
+				defer wg.Done()
+				_, err := s.UpdateCapacity("org1", "1", CapacityUpdate{Available: n(7)})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		services, err = s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		require.NotNil(t, services[0].Capacity)
+		assert.Equal(t, 20, services[0].Capacity.Total)
+		assert.Equal(t, 7, services[0].Capacity.Available)
+	})
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// CreateService adds a service to the catalog. It returns ErrServiceExists
+// if the ID is already taken.
+func CreateService(db *sql.DB, svc core.Service) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM services WHERE id = ?)", svc.ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrServiceExists
+	}
+	if err := checkParent(tx, svc); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO services (id, name, deprecated, parent_id) VALUES (?, ?, ?, NULLIF(?, ''))", svc.ID, svc.Name, svc.Deprecated, svc.ParentID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateService renames a catalog service, sets its deprecated flag and moves
+// it under another parent category.
+func UpdateService(db *sql.DB, svc core.Service) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkParent(tx, svc); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE services SET name = ?, deprecated = ?, parent_id = NULLIF(?, '') WHERE id = ?", svc.Name, svc.Deprecated, svc.ParentID, svc.ID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkParent verifies that the parent of svc exists and is not svc itself or
+// one of its descendants.
+func checkParent(tx *sql.Tx, svc core.Service) error {
+	if svc.ParentID == "" {
+		return nil
+	}
+
+	// Walk up from the new parent; reaching svc means a cycle
+	var found, cycle bool
+	err := tx.QueryRow(`
+		WITH RECURSIVE ancestors(id, parent_id) AS (
+			SELECT id, parent_id FROM services WHERE id = ?
+			UNION
+			SELECT s.id, s.parent_id FROM services s JOIN ancestors a ON s.id = a.parent_id
+		)
+		SELECT COUNT(*) > 0, COALESCE(SUM(id = ?), 0) > 0 FROM ancestors
+	`, svc.ParentID, svc.ID).Scan(&found, &cycle)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrUnknownService
+	}
+	if cycle {
+		return ErrServiceCycle
+	}
+	return nil
+}
+
+// DeleteService removes a service from the catalog. It returns
+// ErrServiceInUse while organizations, including archived ones, still offer
+// it or holds and referrals refer to it; deprecate the service instead.
+// Subcategories must be deleted or moved first.
+func DeleteService(db *sql.DB, serviceID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var inUse bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM organization_services WHERE service_id = ?)
+		OR EXISTS (SELECT 1 FROM holds WHERE service_id = ?)
+		OR EXISTS (SELECT 1 FROM referrals WHERE service_id = ?)
+	`, serviceID, serviceID, serviceID).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrServiceInUse
+	}
+
+	var hasChildren bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM services WHERE parent_id = ?)", serviceID).Scan(&hasChildren); err != nil {
+		return err
+	}
+	if hasChildren {
+		return ErrServiceHasChildren
+	}
+
+	if _, err := tx.Exec("DELETE FROM service_translations WHERE service_id = ?", serviceID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM services WHERE id = ?", serviceID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateService(svc core.Service) error {
+	return CreateService(s.db, svc)
+}
+
+func (s *SQLStore) UpdateService(svc core.Service) error {
+	return notFound(UpdateService(s.db, svc))
+}
+
+func (s *SQLStore) DeleteService(serviceID string) error {
+	return notFound(DeleteService(s.db, serviceID))
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	// EventOrganizationCreated is published when an organization is created
+	// or restored from the archive.
+	EventOrganizationCreated EventType = "organization.created"
+	// EventOrganizationUpdated is published when an organization or the set
+	// of services it offers changes.
+	EventOrganizationUpdated EventType = "organization.updated"
+	// EventOrganizationDeleted is published when an organization is deleted
+	// or archived.
+	EventOrganizationDeleted EventType = "organization.deleted"
+	// EventCapacityChanged is published when the capacity of a service at an
+	// organization is updated.
+	EventCapacityChanged EventType = "capacity.changed"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is disconnected.
+const subscriberBuffer = 64
+
+// Event is a change published by the Store write paths.
+type Event struct {
+	// ID increases with every event published on the bus.
+	ID   uint64    `json:"id"`
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Organization is the organization with its services after the change,
+	// or before it for deletions.
+	Organization core.Organization `json:"organization"`
+	// Previous is the organization with its services before an update.
+	Previous *core.Organization `json:"previous,omitempty"`
+	// ServiceID and Capacity are set on capacity changes.
+	ServiceID string         `json:"service_id,omitempty"`
+	Capacity  *core.Capacity `json:"capacity,omitempty"`
+}
+
+// EventBus fans events out to in-process subscribers. Publishing never
+// blocks on a subscriber: one that falls too far behind has its channel
+// closed, so it knows it missed events rather than silently skipping them.
+// Handlers, which must not miss events, are called by Publish instead.
+type EventBus struct {
+	mu            sync.Mutex
+	lastID        uint64
+	subscribers   map[chan Event]bool
+	lastHandlerID uint64
+	handlers      map[uint64]func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]bool), handlers: make(map[uint64]func(Event))}
+}
+
+// Subscribe returns a channel receiving the events published from now on and
+// a function to unsubscribe.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = true
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.drop(ch)
+	}
+}
+
+// Handle calls h with every event published from now on, in order, before
+// Publish returns, and returns a function to stop. h runs in the write path,
+// so it must be quick and must not publish.
+func (b *EventBus) Handle(h func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastHandlerID++
+	id := b.lastHandlerID
+	b.handlers[id] = h
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// drop closes a subscriber's channel. The caller must hold mu.
+func (b *EventBus) drop(ch chan Event) {
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish numbers and timestamps e, calls every handler with it and sends it
+// to every subscriber.
+func (b *EventBus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	e.Time = time.Now().UTC()
+	for _, h := range b.handlers {
+		h(e)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			b.drop(ch)
+		}
+	}
+}
+
+// hasSubscribers lets the write paths skip building events nobody receives.
+func (b *EventBus) hasSubscribers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0 || len(b.handlers) > 0
+}
+
+func (s *SQLStore) Events() *EventBus {
+	return s.events
+}
+
+// snapshot returns an unarchived organization with its services for an event.
+func (s *SQLStore) snapshot(orgID string) (core.Organization, error) {
+	org, err := GetOrganizationByID(s.db, orgID)
+	if err != nil {
+		return core.Organization{}, err
+	}
+	org.Services, err = GetServicesByOrganizationID(s.db, orgID)
+	return org, err
+}
+
+// change runs write, which changes orgID, and then publish with the state of
+// the organization before and after it, nil where it is not visible. Changes
+// are serialized, so events come out in the order of the writes and carry
+// the state each write left.
+func (s *SQLStore) change(orgID string, write func() error, publish func(before, after *core.Organization)) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	if !s.events.hasSubscribers() {
+		return write()
+	}
+	var before *core.Organization
+	if org, err := s.snapshot(orgID); err == nil {
+		before = &org
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	// The write has already succeeded, so an organization that cannot be
+	// loaded any more is not reported
+	var after *core.Organization
+	if org, err := s.snapshot(orgID); err == nil {
+		after = &org
+	}
+	publish(before, after)
+	return nil
+}
+
+// changeOrganization runs write and publishes an event of type t for orgID:
+// its last state for deletions, its new one otherwise.
+func (s *SQLStore) changeOrganization(t EventType, orgID string, write func() error) error {
+	return s.change(orgID, write, func(before, after *core.Organization) {
+		switch {
+		case t == EventOrganizationDeleted && before != nil:
+			s.events.Publish(Event{Type: t, Organization: *before})
+		case t != EventOrganizationDeleted && after != nil:
+			e := Event{Type: t, Organization: *after}
+			if t == EventOrganizationUpdated {
+				e.Previous = before
+			}
+			s.events.Publish(e)
+		}
+	})
+}
+
+func (m *MemoryStore) Events() *EventBus {
+	return m.events
+}
+
+// snapshot returns an unarchived organization with its services for an
+// event. The caller must hold mu.
+func (m *MemoryStore) snapshot(orgID string) (core.Organization, bool) {
+	org, ok := m.orgs[orgID]
+	if !ok || m.archived[orgID] {
+		return core.Organization{}, false
+	}
+	org.Services = m.offeredServices(orgID)
+	return org, true
+}
+
+// publishOrganization publishes a change of orgID with its current state.
+// The caller must hold mu.
+func (m *MemoryStore) publishOrganization(t EventType, orgID string) {
+	if !m.events.hasSubscribers() {
+		return
+	}
+	if org, ok := m.snapshot(orgID); ok {
+		m.events.Publish(Event{Type: t, Organization: org})
+	}
+}
+
+// publishUpdate publishes an update of orgID with its current state and
+// before, its state until then if it was visible. The caller must hold mu.
+func (m *MemoryStore) publishUpdate(orgID string, before core.Organization, visible bool) {
+	if !m.events.hasSubscribers() {
+		return
+	}
+	if org, ok := m.snapshot(orgID); ok {
+		e := Event{Type: EventOrganizationUpdated, Organization: org}
+		if visible {
+			e.Previous = &before
+		}
+		m.events.Publish(e)
+	}
+}
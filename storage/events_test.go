@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	assert.False(t, bus.hasSubscribers())
+
+	events, unsubscribe := bus.Subscribe()
+	slow, _ := bus.Subscribe()
+	assert.True(t, bus.hasSubscribers())
+
+	bus.Publish(Event{Type: EventOrganizationCreated})
+	e := <-events
+	assert.Equal(t, uint64(1), e.ID)
+	assert.False(t, e.Time.IsZero())
+
+	// A subscriber that stops reading is disconnected once its buffer is full
+	for i := 0; i < subscriberBuffer; i++ {
+		bus.Publish(Event{Type: EventOrganizationUpdated})
+		<-events
+	}
+	for range slow {
+	}
+
+	unsubscribe()
+	_, ok := <-events
+	assert.False(t, ok)
+	assert.False(t, bus.hasSubscribers())
+	unsubscribe()
+
+	// Handlers get every event, however many
+	var handled []uint64
+	stop := bus.Handle(func(e Event) { handled = append(handled, e.ID) })
+	assert.True(t, bus.hasSubscribers())
+	for i := 0; i < 2*subscriberBuffer; i++ {
+		bus.Publish(Event{Type: EventOrganizationUpdated})
+	}
+	require.Len(t, handled, 2*subscriberBuffer)
+	assert.Less(t, handled[0], handled[len(handled)-1])
+	stop()
+	bus.Publish(Event{Type: EventOrganizationUpdated})
+	assert.Len(t, handled, 2*subscriberBuffer)
+	assert.False(t, bus.hasSubscribers())
+}
+
+func TestStorePublishesEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		events, unsubscribe := s.Events().Subscribe()
+		defer unsubscribe()
+
+		next := func() Event {
+			select {
+			case e := <-events:
+				return e
+			default:
+				require.FailNow(t, "no event published")
+				return Event{}
+			}
+		}
+
+		require.NoError(t, s.CreateOrganization(core.Organization{ID: "org3", Name: "Org Three"}))
+		e := next()
+		assert.Equal(t, EventOrganizationCreated, e.Type)
+		assert.Equal(t, "Org Three", e.Organization.Name)
+
+		require.NoError(t, s.AddServicesToOrganization("org3", []string{"1"}))
+		e = next()
+		assert.Equal(t, EventOrganizationUpdated, e.Type)
+		assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}}, e.Organization.Services)
+
+		c, err := s.UpdateCapacity("org3", "1", setTo(5, 2))
+		require.NoError(t, err)
+		e = next()
+		assert.Equal(t, EventCapacityChanged, e.Type)
+		assert.Equal(t, "1", e.ServiceID)
+		assert.Equal(t, &c, e.Capacity)
+
+		require.NoError(t, s.UpdateOrganization(core.Organization{ID: "org3", Name: "Org 3"}))
+		e = next()
+		assert.Equal(t, EventOrganizationUpdated, e.Type)
+		require.NotNil(t, e.Previous)
+		assert.Equal(t, "Org Three", e.Previous.Name)
+		assert.Equal(t, "Org 3", e.Organization.Name)
+
+		require.NoError(t, s.ArchiveOrganization("org3"))
+		e = next()
+		assert.Equal(t, EventOrganizationDeleted, e.Type)
+		assert.Equal(t, "Org 3", e.Organization.Name)
+		require.NoError(t, s.RestoreOrganization("org3"))
+		assert.Equal(t, EventOrganizationCreated, next().Type)
+
+		require.NoError(t, s.RemoveServiceFromOrganization("org3", "1"))
+		assert.Equal(t, EventOrganizationUpdated, next().Type)
+		require.NoError(t, s.DeleteOrganizationByID("org3"))
+		e = next()
+		assert.Equal(t, EventOrganizationDeleted, e.Type)
+		assert.Equal(t, "org3", e.Organization.ID)
+
+		// Failed writes publish nothing
+		assert.Error(t, s.DeleteOrganizationByID("org3"))
+		assert.Empty(t, events)
+	})
+}
+
+func TestStoreEventsFollowWrites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		events, unsubscribe := s.Events().Subscribe()
+		defer unsubscribe()
+
+		const writes = 20
+		var wg sync.WaitGroup
+		for i := 0; i < writes; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, s.UpdateOrganization(core.Organization{ID: "org1", Name: fmt.Sprintf("Org %d", i)}))
+			}(i)
+		}
+		wg.Wait()
+
+		// Each event starts from the state the one before left
+		last := "Org One"
+		for i := 0; i < writes; i++ {
+			e := <-events
+			require.NotNil(t, e.Previous)
+			assert.Equal(t, last, e.Previous.Name)
+			last = e.Organization.Name
+		}
+		org, err := s.GetOrganizationByID("org1")
+		require.NoError(t, err)
+		assert.Equal(t, org.Name, last)
+	})
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+var (
+	// ErrNoCapacity is returned when a hold is placed on a service whose
+	// capacity is not tracked or has no unit available.
+	ErrNoCapacity = errors.New("no capacity available")
+	// ErrHoldNotActive is returned when confirming or releasing a hold that
+	// is no longer held, or confirming one past its expiry.
+	ErrHoldNotActive = errors.New("hold is not active")
+)
+
+const holdColumns = "id, organization_id, service_id, status, reference, created_at, expires_at, updated_at, placed_by"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanHold(row rowScanner) (core.Hold, error) {
+	var h core.Hold
+	var createdAt, expiresAt, updatedAt string
+	err := row.Scan(&h.ID, &h.OrganizationID, &h.ServiceID, &h.Status, &h.Reference, &createdAt, &expiresAt, &updatedAt, &h.PlacedBy)
+	if err != nil {
+		return core.Hold{}, err
+	}
+	if h.CreatedAt, err = time.Parse(createdAtLayout, createdAt); err != nil {
+		return core.Hold{}, err
+	}
+	if h.ExpiresAt, err = time.Parse(createdAtLayout, expiresAt); err != nil {
+		return core.Hold{}, err
+	}
+	if h.UpdatedAt, err = time.Parse(createdAtLayout, updatedAt); err != nil {
+		return core.Hold{}, err
+	}
+	return h, nil
+}
+
+// newID returns prefix followed by 16 random hex characters, for records
+// whose IDs are not chosen by the client.
+func newID(prefix string) (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(bytes), nil
+}
+
+// newHold fills in the ID, status and timestamps of a hold being placed.
+func newHold(hold core.Hold) (core.Hold, error) {
+	id, err := newID("hold_")
+	if err != nil {
+		return core.Hold{}, err
+	}
+	hold.ID = id
+	hold.Status = core.HoldHeld
+	hold.CreatedAt = time.Now().UTC()
+	hold.UpdatedAt = hold.CreatedAt
+	hold.ExpiresAt = hold.ExpiresAt.UTC()
+	return hold, nil
+}
+
+// PlaceHold takes one available unit of the service of hold at its
+// organization until hold.ExpiresAt. It returns sql.ErrNoRows if the
+// organization is archived or does not offer the service, and
+// ErrNoCapacity if its capacity is not tracked or nothing is available.
+func PlaceHold(db *sql.DB, hold core.Hold) (core.Hold, error) {
+	hold, err := newHold(hold)
+	if err != nil {
+		return core.Hold{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return core.Hold{}, err
+	}
+	defer tx.Rollback()
+
+	// Decrement in a single statement so concurrent holds cannot both take
+	// the last unit
+	result, err := tx.Exec(`
+		UPDATE organization_services
+		SET capacity_available = capacity_available - 1
+		WHERE organization_id = ? AND service_id = ? AND capacity_available > 0
+		AND organization_id IN (SELECT id FROM organizations WHERE archived_at IS NULL)
+	`, hold.OrganizationID, hold.ServiceID)
+	if err != nil {
+		return core.Hold{}, err
+	}
+	if err := expectOneRow(result); err != nil {
+		var total sql.NullInt64
+		err := tx.QueryRow(`
+			SELECT os.capacity_total
+			FROM organization_services os
+			JOIN organizations o ON o.id = os.organization_id
+			WHERE os.organization_id = ? AND os.service_id = ? AND o.archived_at IS NULL
+		`, hold.OrganizationID, hold.ServiceID).Scan(&total)
+		switch {
+		case err != nil:
+			return core.Hold{}, err
+		case !total.Valid:
+			return core.Hold{}, fmt.Errorf("%w: the capacity of the service is not tracked", ErrNoCapacity)
+		default:
+			return core.Hold{}, ErrNoCapacity
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO holds ("+holdColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		hold.ID, hold.OrganizationID, hold.ServiceID, hold.Status, hold.Reference,
+		hold.CreatedAt.Format(createdAtLayout), hold.ExpiresAt.Format(createdAtLayout), hold.UpdatedAt.Format(createdAtLayout), hold.PlacedBy)
+	if err != nil {
+		return core.Hold{}, err
+	}
+	return hold, tx.Commit()
+}
+
+func GetHold(db *sql.DB, holdID string) (core.Hold, error) {
+	return scanHold(db.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = ?", holdID))
+}
+
+// ListHolds returns the holds at an organization, newest first, optionally
+// only those with status.
+func ListHolds(db *sql.DB, orgID string, status core.HoldStatus) ([]core.Hold, error) {
+	rows, err := db.Query(`
+		SELECT `+holdColumns+`
+		FROM holds
+		WHERE organization_id = ? AND (? = '' OR status = ?)
+		ORDER BY created_at DESC, id DESC
+	`, orgID, status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []core.Hold{}
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// ConfirmHold records that the organization handed out the unit of a hold
+// that is held and not yet expired at now.
+func ConfirmHold(db *sql.DB, holdID string, now time.Time) (core.Hold, error) {
+	at := now.UTC().Format(createdAtLayout)
+	result, err := db.Exec(`
+		UPDATE holds SET status = ?, updated_at = ?
+		WHERE id = ? AND status = ? AND expires_at > ?
+	`, core.HoldConfirmed, at, holdID, core.HoldHeld, at)
+	if err != nil {
+		return core.Hold{}, err
+	}
+	if err := expectOneRow(result); err != nil {
+		return core.Hold{}, holdNotActive(db, holdID)
+	}
+	return GetHold(db, holdID)
+}
+
+// ReleaseHold ends a held hold and gives its unit back to the capacity.
+func ReleaseHold(db *sql.DB, holdID string, now time.Time) (core.Hold, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return core.Hold{}, err
+	}
+	defer tx.Rollback()
+
+	h, err := endHold(tx, holdID, core.HoldReleased, now)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return core.Hold{}, holdNotActive(db, holdID)
+		}
+		return core.Hold{}, err
+	}
+	return h, tx.Commit()
+}
+
+// ExpireHolds expires the holds still held at their expiry before now and
+// gives their units back to the capacity. It returns the expired holds.
+func ExpireHolds(db *sql.DB, now time.Time) ([]core.Hold, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM holds WHERE status = ? AND expires_at <= ?", core.HoldHeld, now.UTC().Format(createdAtLayout))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	expired := []core.Hold{}
+	for _, id := range ids {
+		h, err := endHold(tx, id, core.HoldExpired, now)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, h)
+	}
+	return expired, tx.Commit()
+}
+
+// endHold moves a held hold to status and returns its unit. It returns
+// sql.ErrNoRows unless the hold is held.
+func endHold(tx *sql.Tx, holdID string, status core.HoldStatus, now time.Time) (core.Hold, error) {
+	result, err := tx.Exec("UPDATE holds SET status = ?, updated_at = ? WHERE id = ? AND status = ?",
+		status, now.UTC().Format(createdAtLayout), holdID, core.HoldHeld)
+	if err != nil {
+		return core.Hold{}, err
+	}
+	if err := expectOneRow(result); err != nil {
+		return core.Hold{}, err
+	}
+
+	h, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = ?", holdID))
+	if err != nil {
+		return core.Hold{}, err
+	}
+	// The capacity may have been reset or stopped being tracked meanwhile;
+	// never report more available than the total
+	_, err = tx.Exec(`
+		UPDATE organization_services
+		SET capacity_available = MIN(capacity_available + 1, capacity_total)
+		WHERE organization_id = ? AND service_id = ? AND capacity_total IS NOT NULL
+	`, h.OrganizationID, h.ServiceID)
+	return h, err
+}
+
+// holdNotActive tells a missing hold, reported as sql.ErrNoRows, from one
+// in the wrong state.
+func holdNotActive(db *sql.DB, holdID string) error {
+	h, err := GetHold(db, holdID)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: it is %s", ErrHoldNotActive, h.Status)
+}
+
+// StartHoldSweeper expires the holds past their expiry every interval until
+// ctx is cancelled, so their units become available again. The returned
+// channel is closed once it has stopped.
+func StartHoldSweeper(ctx context.Context, store Store, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				expired, err := store.ExpireHolds(time.Now())
+				if err != nil {
+					log.Printf("Failed to expire holds: %v", err)
+				} else if len(expired) > 0 {
+					log.Printf("Expired %d holds", len(expired))
+				}
+			}
+		}
+	}()
+	return done
+}
+
+// publishCapacity publishes the current capacity of a service at an
+// organization after a hold or an update changed it. The caller must hold
+// changeMu from before the change, see change.
+func (s *SQLStore) publishCapacity(orgID, serviceID string) {
+	if !s.events.hasSubscribers() {
+		return
+	}
+	if org, err := s.snapshot(orgID); err == nil {
+		publishCapacity(s.events, org, serviceID)
+	}
+}
+
+func publishCapacity(events *EventBus, org core.Organization, serviceID string) {
+	for _, svc := range org.Services {
+		if svc.ID == serviceID && svc.Capacity != nil {
+			events.Publish(Event{Type: EventCapacityChanged, Organization: org, ServiceID: serviceID, Capacity: svc.Capacity})
+		}
+	}
+}
+
+func (s *SQLStore) PlaceHold(hold core.Hold) (core.Hold, error) {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	h, err := PlaceHold(s.db, hold)
+	if err != nil {
+		return h, notFound(err)
+	}
+	s.publishCapacity(h.OrganizationID, h.ServiceID)
+	return h, nil
+}
+
+func (s *SQLStore) GetHold(holdID string) (core.Hold, error) {
+	h, err := GetHold(s.db, holdID)
+	return h, notFound(err)
+}
+
+func (s *SQLStore) ListHolds(orgID string, status core.HoldStatus) ([]core.Hold, error) {
+	return ListHolds(s.db, orgID, status)
+}
+
+func (s *SQLStore) ConfirmHold(holdID string) (core.Hold, error) {
+	h, err := ConfirmHold(s.db, holdID, time.Now())
+	return h, notFound(err)
+}
+
+func (s *SQLStore) ReleaseHold(holdID string) (core.Hold, error) {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	h, err := ReleaseHold(s.db, holdID, time.Now())
+	if err != nil {
+		return h, notFound(err)
+	}
+	s.publishCapacity(h.OrganizationID, h.ServiceID)
+	return h, nil
+}
+
+func (s *SQLStore) ExpireHolds(now time.Time) ([]core.Hold, error) {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	expired, err := ExpireHolds(s.db, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range expired {
+		s.publishCapacity(h.OrganizationID, h.ServiceID)
+	}
+	return expired, nil
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreHolds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		_, err := s.UpdateCapacity("org1", "1", setTo(3, 2))
+		require.NoError(t, err)
+
+		available := func() int {
+			services, err := s.GetServicesByOrganizationID("org1")
+			require.NoError(t, err)
+			return services[0].Capacity.Available
+		}
+		place := func() (core.Hold, error) {
+			return s.PlaceHold(core.Hold{OrganizationID: "org1", ServiceID: "1", Reference: "case-7", ExpiresAt: time.Now().Add(time.Hour), PlacedBy: "key_1"})
+		}
+
+		first, err := place()
+		require.NoError(t, err)
+		assert.Equal(t, core.HoldHeld, first.Status)
+		assert.NotEmpty(t, first.ID)
+		second, err := place()
+		require.NoError(t, err)
+		assert.Equal(t, 0, available())
+
+		_, err = place()
+		assert.ErrorIs(t, err, ErrNoCapacity)
+		_, err = s.PlaceHold(core.Hold{OrganizationID: "org1", ServiceID: "2", ExpiresAt: time.Now().Add(time.Hour)})
+		assert.ErrorIs(t, err, ErrNoCapacity, "food is not capacity tracked")
+		_, err = s.PlaceHold(core.Hold{OrganizationID: "org2", ServiceID: "2", ExpiresAt: time.Now().Add(time.Hour)})
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		got, err := s.GetHold(first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "case-7", got.Reference)
+		assert.Equal(t, "key_1", got.PlacedBy)
+		assert.True(t, first.ExpiresAt.Equal(got.ExpiresAt))
+
+		confirmed, err := s.ConfirmHold(first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, core.HoldConfirmed, confirmed.Status)
+		assert.Equal(t, 0, available(), "a confirmed hold keeps its unit")
+		_, err = s.ReleaseHold(first.ID)
+		assert.ErrorIs(t, err, ErrHoldNotActive)
+
+		released, err := s.ReleaseHold(second.ID)
+		require.NoError(t, err)
+		assert.Equal(t, core.HoldReleased, released.Status)
+		assert.Equal(t, 1, available())
+		_, err = s.ConfirmHold(second.ID)
+		assert.ErrorIs(t, err, ErrHoldNotActive)
+
+		holds, err := s.ListHolds("org1", "")
+		require.NoError(t, err)
+		assert.Len(t, holds, 2)
+		holds, err = s.ListHolds("org1", core.HoldReleased)
+		require.NoError(t, err)
+		require.Len(t, holds, 1)
+		assert.Equal(t, second.ID, holds[0].ID)
+
+		_, err = s.GetHold("hold_missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = s.ConfirmHold("hold_missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = s.ReleaseHold("hold_missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestExpireHolds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		_, err := s.UpdateCapacity("org1", "1", setTo(2, 2))
+		require.NoError(t, err)
+
+		now := time.Now()
+		soon, err := s.PlaceHold(core.Hold{OrganizationID: "org1", ServiceID: "1", ExpiresAt: now.Add(time.Minute)})
+		require.NoError(t, err)
+		later, err := s.PlaceHold(core.Hold{OrganizationID: "org1", ServiceID: "1", ExpiresAt: now.Add(time.Hour)})
+		require.NoError(t, err)
+
+		events, unsubscribe := s.Events().Subscribe()
+		defer unsubscribe()
+
+		expired, err := s.ExpireHolds(now.Add(2 * time.Minute))
+		require.NoError(t, err)
+		require.Len(t, expired, 1)
+		assert.Equal(t, soon.ID, expired[0].ID)
+		assert.Equal(t, core.HoldExpired, expired[0].Status)
+
+		select {
+		case e := <-events:
+			assert.Equal(t, EventCapacityChanged, e.Type)
+			assert.Equal(t, 1, e.Capacity.Available)
+		default:
+			assert.Fail(t, "no capacity change published")
+		}
+
+		// Staff recounting in the meantime caps what expiring holds give back
+		_, err = s.UpdateCapacity("org1", "1", setTo(2, 2))
+		require.NoError(t, err)
+		expired, err = s.ExpireHolds(now.Add(2 * time.Hour))
+		require.NoError(t, err)
+		require.Len(t, expired, 1)
+		assert.Equal(t, later.ID, expired[0].ID)
+		services, err := s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		assert.Equal(t, 2, services[0].Capacity.Available)
+
+		expired, err = s.ExpireHolds(now.Add(3 * time.Hour))
+		require.NoError(t, err)
+		assert.Empty(t, expired)
+	})
+}
+
+func TestHoldSweeper(t *testing.T) {
+	s := NewMemoryStore()
+	seedStore(t, s)
+	_, err := s.UpdateCapacity("org1", "1", setTo(1, 1))
+	require.NoError(t, err)
+	h, err := s.PlaceHold(core.Hold{OrganizationID: "org1", ServiceID: "1", ExpiresAt: time.Now().Add(10 * time.Millisecond)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := StartHoldSweeper(ctx, s, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		got, err := s.GetHold(h.ID)
+		return err == nil && got.Status == core.HoldExpired
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	services, err := s.GetServicesByOrganizationID("org1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, services[0].Capacity.Available)
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	// Load time zones on hosts without a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// ErrInvalidOpeningHours is returned when storing a malformed schedule.
+var ErrInvalidOpeningHours = errors.New("invalid opening hours")
+
+const dateLayout = "2006-01-02"
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseClock returns the minutes since midnight of a "15:04" time, allowing
+// "24:00" for the end of the day.
+func parseClock(s string) (int, bool) {
+	if s == "24:00" {
+		return 24 * 60, true
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+func validateOpeningTimes(t core.OpeningTimes) error {
+	opens, ok := parseClock(t.Opens)
+	if !ok || opens == 24*60 {
+		return fmt.Errorf("%w: opens %q is not a 15:04 time", ErrInvalidOpeningHours, t.Opens)
+	}
+	closes, ok := parseClock(t.Closes)
+	if !ok {
+		return fmt.Errorf("%w: closes %q is not a 15:04 time", ErrInvalidOpeningHours, t.Closes)
+	}
+	if opens == closes {
+		return fmt.Errorf("%w: %s-%s opens and closes at the same time", ErrInvalidOpeningHours, t.Opens, t.Closes)
+	}
+	return nil
+}
+
+func validateOpeningHours(h core.OpeningHours) error {
+	if h.TimeZone == "" || h.TimeZone == "Local" {
+		return fmt.Errorf("%w: time_zone is required", ErrInvalidOpeningHours)
+	}
+	if _, err := time.LoadLocation(h.TimeZone); err != nil {
+		return fmt.Errorf("%w: unknown time_zone %q", ErrInvalidOpeningHours, h.TimeZone)
+	}
+
+	for _, p := range h.Weekly {
+		if _, ok := weekdays[p.Day]; !ok {
+			return fmt.Errorf("%w: unknown day %q", ErrInvalidOpeningHours, p.Day)
+		}
+		if err := validateOpeningTimes(p.OpeningTimes); err != nil {
+			return err
+		}
+	}
+
+	dates := make(map[string]bool, len(h.Exceptions))
+	for _, e := range h.Exceptions {
+		if _, err := time.Parse(dateLayout, e.Date); err != nil {
+			return fmt.Errorf("%w: date %q is not a 2006-01-02 date", ErrInvalidOpeningHours, e.Date)
+		}
+		if dates[e.Date] {
+			return fmt.Errorf("%w: more than one exception on %s", ErrInvalidOpeningHours, e.Date)
+		}
+		dates[e.Date] = true
+		for _, t := range e.Periods {
+			if err := validateOpeningTimes(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openingTimesOn returns the opening times on the local date of day: those
+// of its exception if it has one, or else the weekly periods of its weekday.
+func openingTimesOn(h core.OpeningHours, day time.Time) []core.OpeningTimes {
+	date := day.Format(dateLayout)
+	for _, e := range h.Exceptions {
+		if e.Date == date {
+			return e.Periods
+		}
+	}
+
+	var times []core.OpeningTimes
+	for _, p := range h.Weekly {
+		if weekdays[p.Day] == day.Weekday() {
+			times = append(times, p.OpeningTimes)
+		}
+	}
+	return times
+}
+
+// isOpenAt reports whether the schedule h is open at t. A period running past
+// midnight belongs to the day it opens on, so Friday 22:00-06:00 is open early
+// on Saturday even when Saturday is a holiday.
+func isOpenAt(h core.OpeningHours, t time.Time) bool {
+	loc, err := time.LoadLocation(h.TimeZone)
+	if err != nil {
+		return false
+	}
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+
+	for _, p := range openingTimesOn(h, local) {
+		opens, _ := parseClock(p.Opens)
+		closes, _ := parseClock(p.Closes)
+		if minute >= opens && (minute < closes || closes < opens) {
+			return true
+		}
+	}
+	for _, p := range openingTimesOn(h, local.AddDate(0, 0, -1)) {
+		opens, _ := parseClock(p.Opens)
+		closes, _ := parseClock(p.Closes)
+		if closes < opens && minute < closes {
+			return true
+		}
+	}
+	return false
+}
+
+// filterOpen keeps the matches still covering enough services when only
+// counting those open at t. hours holds the opening hours of the matched
+// organizations, keyed by organization and then service ID. A service is
+// open per its own hours, or else the organization's; organizations without
+// hours are never open.
+func filterOpen(matches []OrganizationMatch, match ServiceMatch, t time.Time, hoursByOrg map[string]map[string]core.OpeningHours) []OrganizationMatch {
+	var open []OrganizationMatch
+	for _, m := range matches {
+		hours := hoursByOrg[m.Organization.ID]
+		openIDs := []string{}
+		for _, id := range m.MatchedServiceIDs {
+			h, ok := hours[id]
+			if !ok {
+				h, ok = hours[""]
+			}
+			if ok && isOpenAt(h, t) {
+				openIDs = append(openIDs, id)
+			}
+		}
+		if len(openIDs) > 0 && len(openIDs) >= match.minMatches() {
+			m.MatchedServiceIDs = openIDs
+			open = append(open, m)
+		}
+	}
+	return open
+}
+
+// SetOpeningHours stores the hours of an unarchived organization, or of one of
+// its services when serviceID is not empty, replacing any previous ones. It
+// returns sql.ErrNoRows if the organization does not offer the service.
+func SetOpeningHours(db *sql.DB, orgID, serviceID string, hours core.OpeningHours) error {
+	if err := validateOpeningHours(hours); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(hours)
+	if err != nil {
+		return err
+	}
+
+	var result sql.Result
+	if serviceID == "" {
+		result, err = db.Exec(`
+			INSERT INTO opening_hours (organization_id, service_id, hours)
+			SELECT id, '', ? FROM organizations WHERE id = ? AND archived_at IS NULL
+			ON CONFLICT (organization_id, service_id) DO UPDATE SET hours = excluded.hours
+		`, doc, orgID)
+	} else {
+		result, err = db.Exec(`
+			INSERT INTO opening_hours (organization_id, service_id, hours)
+			SELECT os.organization_id, os.service_id, ?
+			FROM organization_services os JOIN organizations o ON o.id = os.organization_id
+			WHERE os.organization_id = ? AND os.service_id = ? AND o.archived_at IS NULL
+			ON CONFLICT (organization_id, service_id) DO UPDATE SET hours = excluded.hours
+		`, doc, orgID, serviceID)
+	}
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func DeleteOpeningHours(db *sql.DB, orgID, serviceID string) error {
+	result, err := db.Exec("DELETE FROM opening_hours WHERE organization_id = ? AND service_id = ?", orgID, serviceID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// GetOpeningHours returns the hours of an organization keyed by service ID,
+// with the organization's own hours under the empty ID.
+func GetOpeningHours(db *sql.DB, orgID string) (map[string]core.OpeningHours, error) {
+	rows, err := db.Query("SELECT service_id, hours FROM opening_hours WHERE organization_id = ?", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := make(map[string]core.OpeningHours)
+	for rows.Next() {
+		var serviceID, doc string
+		if err := rows.Scan(&serviceID, &doc); err != nil {
+			return nil, err
+		}
+		var h core.OpeningHours
+		if err := json.Unmarshal([]byte(doc), &h); err != nil {
+			return nil, err
+		}
+		hours[serviceID] = h
+	}
+	return hours, rows.Err()
+}
+
+// getOpeningHoursOf adds the opening hours of the organizations in orgIDs to
+// hours, keyed by organization and then service ID, in a single query.
+// Organizations without hours get an empty entry.
+func getOpeningHoursOf(db *sql.DB, orgIDs []string, hours map[string]map[string]core.OpeningHours) error {
+	if len(orgIDs) == 0 {
+		return nil
+	}
+	ids, err := json.Marshal(orgIDs)
+	if err != nil {
+		return err
+	}
+	for _, id := range orgIDs {
+		hours[id] = make(map[string]core.OpeningHours)
+	}
+
+	// A JSON array keeps the query to one parameter however many organizations there are
+	rows, err := db.Query(`
+		SELECT organization_id, service_id, hours
+		FROM opening_hours
+		WHERE organization_id IN (SELECT value FROM json_each(?))
+	`, string(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID, serviceID, doc string
+		if err := rows.Scan(&orgID, &serviceID, &doc); err != nil {
+			return err
+		}
+		var h core.OpeningHours
+		if err := json.Unmarshal([]byte(doc), &h); err != nil {
+			return err
+		}
+		hours[orgID][serviceID] = h
+	}
+	return rows.Err()
+}
+
+// deleteStaleServiceHours drops the hours of services the organization no
+// longer offers.
+func deleteStaleServiceHours(tx *sql.Tx, orgID string) error {
+	_, err := tx.Exec(`
+		DELETE FROM opening_hours
+		WHERE organization_id = ? AND service_id <> ''
+		AND service_id NOT IN (SELECT service_id FROM organization_services WHERE organization_id = ?)
+	`, orgID, orgID)
+	return err
+}
+
+func (s *SQLStore) SetOpeningHours(orgID, serviceID string, hours core.OpeningHours) error {
+	return notFound(SetOpeningHours(s.db, orgID, serviceID, hours))
+}
+
+func (s *SQLStore) DeleteOpeningHours(orgID, serviceID string) error {
+	return notFound(DeleteOpeningHours(s.db, orgID, serviceID))
+}
+
+func (s *SQLStore) GetOpeningHours(orgID string) (map[string]core.OpeningHours, error) {
+	return GetOpeningHours(s.db, orgID)
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsOpenAt(t *testing.T) {
+	hours := core.OpeningHours{
+		TimeZone: "America/New_York",
+		Weekly: []core.OpeningPeriod{
+			{Day: "monday", OpeningTimes: core.OpeningTimes{Opens: "09:00", Closes: "17:00"}},
+			{Day: "friday", OpeningTimes: core.OpeningTimes{Opens: "09:00", Closes: "17:00"}},
+			{Day: "friday", OpeningTimes: core.OpeningTimes{Opens: "22:00", Closes: "06:00"}},
+			{Day: "saturday", OpeningTimes: core.OpeningTimes{Opens: "10:00", Closes: "14:00"}},
+			{Day: "sunday", OpeningTimes: core.OpeningTimes{Opens: "00:00", Closes: "24:00"}},
+		},
+		Exceptions: []core.OpeningException{
+			{Date: "2024-01-06", Description: "Closed for the holiday"},
+			{Date: "2024-01-08", Periods: []core.OpeningTimes{{Opens: "12:00", Closes: "13:00"}}},
+		},
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, ny)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		open bool
+	}{
+		{"before opening", at(5, 8, 59), false},
+		{"at opening", at(5, 9, 0), true},
+		{"before closing", at(5, 16, 59), true},
+		{"at closing", at(5, 17, 0), false},
+		{"overnight period", at(5, 23, 0), true},
+		{"overnight period into a holiday", at(6, 5, 59), true},
+		{"end of overnight period", at(6, 6, 0), false},
+		{"holiday", at(6, 11, 0), false},
+		{"regular saturday", at(13, 11, 0), true},
+		{"all day sunday", at(7, 23, 59), true},
+		{"special hours", at(8, 12, 30), true},
+		{"outside special hours", at(8, 9, 30), false},
+		{"closed weekday", at(9, 10, 0), false},
+		{"other time zone", time.Date(2024, time.January, 5, 14, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.open, isOpenAt(hours, tt.t), tt.name)
+	}
+}
+
+func TestValidateOpeningHours(t *testing.T) {
+	weekly := func(day, opens, closes string) []core.OpeningPeriod {
+		return []core.OpeningPeriod{{Day: day, OpeningTimes: core.OpeningTimes{Opens: opens, Closes: closes}}}
+	}
+
+	assert.NoError(t, validateOpeningHours(core.OpeningHours{TimeZone: "Europe/Paris", Weekly: weekly("monday", "22:00", "02:00")}))
+
+	invalid := []core.OpeningHours{
+		{Weekly: weekly("monday", "09:00", "17:00")},
+		{TimeZone: "Mars/Olympus", Weekly: weekly("monday", "09:00", "17:00")},
+		{TimeZone: "UTC", Weekly: weekly("mon", "09:00", "17:00")},
+		{TimeZone: "UTC", Weekly: weekly("monday", "9am", "17:00")},
+		{TimeZone: "UTC", Weekly: weekly("monday", "24:00", "02:00")},
+		{TimeZone: "UTC", Weekly: weekly("monday", "09:00", "09:00")},
+		{TimeZone: "UTC", Exceptions: []core.OpeningException{{Date: "12/25/2024"}}},
+		{TimeZone: "UTC", Exceptions: []core.OpeningException{{Date: "2024-12-25"}, {Date: "2024-12-25"}}},
+	}
+	for _, h := range invalid {
+		assert.ErrorIs(t, validateOpeningHours(h), ErrInvalidOpeningHours, "%+v", h)
+	}
+}
+
+func TestStoreOpeningHours(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		weekdays := core.OpeningHours{TimeZone: "UTC", Weekly: []core.OpeningPeriod{
+			{Day: "monday", OpeningTimes: core.OpeningTimes{Opens: "09:00", Closes: "17:00"}},
+		}}
+		lunch := core.OpeningHours{TimeZone: "UTC", Weekly: []core.OpeningPeriod{
+			{Day: "monday", OpeningTimes: core.OpeningTimes{Opens: "12:00", Closes: "13:00"}},
+		}}
+
+		require.NoError(t, s.SetOpeningHours("org1", "", weekdays))
+		require.NoError(t, s.SetOpeningHours("org1", "2", lunch))
+		hours, err := s.GetOpeningHours("org1")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]core.OpeningHours{"": weekdays, "2": lunch}, hours)
+
+		assert.ErrorIs(t, s.SetOpeningHours("org2", "2", lunch), ErrNotFound)
+		assert.ErrorIs(t, s.SetOpeningHours("missing", "", lunch), ErrNotFound)
+		assert.ErrorIs(t, s.SetOpeningHours("org1", "", core.OpeningHours{}), ErrInvalidOpeningHours)
+
+		// Hours of a service go with it
+		require.NoError(t, s.RemoveServiceFromOrganization("org1", "2"))
+		hours, err = s.GetOpeningHours("org1")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]core.OpeningHours{"": weekdays}, hours)
+
+		require.NoError(t, s.DeleteOpeningHours("org1", ""))
+		assert.ErrorIs(t, s.DeleteOpeningHours("org1", ""), ErrNotFound)
+		hours, err = s.GetOpeningHours("org1")
+		require.NoError(t, err)
+		assert.Empty(t, hours)
+
+		require.NoError(t, s.ArchiveOrganization("org2"))
+		assert.ErrorIs(t, s.SetOpeningHours("org2", "", weekdays), ErrNotFound)
+	})
+}
+
+func TestNearestOrganizationsOpenAt(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		require.NoError(t, s.SetOpeningHours("org1", "", core.OpeningHours{TimeZone: "UTC", Weekly: []core.OpeningPeriod{
+			{Day: "friday", OpeningTimes: core.OpeningTimes{Opens: "09:00", Closes: "17:00"}},
+		}}))
+		require.NoError(t, s.SetOpeningHours("org1", "2", core.OpeningHours{TimeZone: "UTC", Weekly: []core.OpeningPeriod{
+			{Day: "friday", OpeningTimes: core.OpeningTimes{Opens: "12:00", Closes: "13:00"}},
+		}}))
+		require.NoError(t, s.SetOpeningHours("org2", "", core.OpeningHours{TimeZone: "UTC", Weekly: []core.OpeningPeriod{
+			{Day: "sunday", OpeningTimes: core.OpeningTimes{Opens: "00:00", Closes: "24:00"}},
+		}}))
+
+		// Between org1 and org2, within the reach of searches by opening hours
+		nearest := func(at time.Time, match ServiceMatch) []NearbyOrganization {
+			nearby, err := s.NearestOrganizations(NearestQuery{Latitude: 15.1, Longitude: -25.2, Match: match, Limit: 10, OpenAt: &at})
+			require.NoError(t, err)
+			return nearby
+		}
+		friday := time.Date(2024, time.January, 5, 10, 0, 0, 0, time.UTC)
+		sunday := time.Date(2024, time.January, 7, 10, 0, 0, 0, time.UTC)
+
+		assert.Equal(t, []string{"org1"}, nearbyIDs(nearest(friday, ServiceMatch{ServiceIDs: []string{"1"}})))
+		assert.Equal(t, []string{"org2"}, nearbyIDs(nearest(sunday, ServiceMatch{ServiceIDs: []string{"1"}})))
+
+		// Food is only served at lunch time
+		assert.Empty(t, nearest(friday, ServiceMatch{ServiceIDs: []string{"1", "2"}}))
+		nearby := nearest(friday.Add(2*time.Hour+30*time.Minute), ServiceMatch{ServiceIDs: []string{"1", "2"}})
+		require.Equal(t, []string{"org1"}, nearbyIDs(nearby))
+		assert.Equal(t, []string{"1", "2"}, nearby[0].MatchedServiceIDs)
+		nearby = nearest(friday, ServiceMatch{ServiceIDs: []string{"1", "2"}, MinMatches: 1})
+		require.Equal(t, []string{"org1"}, nearbyIDs(nearby))
+		assert.Equal(t, []string{"1"}, nearby[0].MatchedServiceIDs)
+
+		// The search stops widening at MaxOpenSearchRadiusKm, even when asked for more
+		for _, radius := range []float64{0, 20000} {
+			far, err := s.NearestOrganizations(NearestQuery{Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 10, RadiusKm: radius, OpenAt: &friday})
+			require.NoError(t, err)
+			assert.Empty(t, far, radius)
+		}
+	})
+}
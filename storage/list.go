@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// createdAtLayout is the fixed-width UTC format of organizations.created_at,
+// chosen so that string order is chronological order.
+const createdAtLayout = "2006-01-02T15:04:05.000000000Z"
+
+const (
+	SortByName      = "name"
+	SortByCreatedAt = "created_at"
+
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+var (
+	// ErrInvalidCursor is returned when a list cursor is malformed or was
+	// issued for a different sort order.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidSort is returned when organizations cannot be sorted by the requested field.
+	ErrInvalidSort = errors.New("invalid sort field")
+)
+
+// ListOrganizationsOptions selects a page of organizations.
+type ListOrganizationsOptions struct {
+	// SortBy is SortByName (the default) or SortByCreatedAt. Names sort
+	// ignoring the case of ASCII letters. Ties are broken by ID.
+	SortBy     string
+	Descending bool
+	// ServiceIDs keeps organizations offering all of these services.
+	ServiceIDs []string
+	// NameContains keeps organizations whose name contains it, ignoring the
+	// case of ASCII letters.
+	NameContains string
+	// Limit is the page size, DefaultListLimit when zero and at most MaxListLimit.
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first page.
+	Cursor string
+	// Archived lists archived organizations instead of active ones.
+	Archived bool
+}
+
+// OrganizationPage is one page of ListOrganizations. NextCursor is empty on the last page.
+type OrganizationPage struct {
+	Organizations []core.Organization `json:"organizations"`
+	NextCursor    string              `json:"next_cursor,omitempty"`
+}
+
+// listCursor is the position after the last organization of a page.
+type listCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         string `json:"id"`
+}
+
+func (c listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string, opts ListOrganizationsOptions) (*listCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.SortBy != opts.SortBy || c.Descending != opts.Descending {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// normalize applies defaults and validates opts.
+func (opts ListOrganizationsOptions) normalize() (ListOrganizationsOptions, error) {
+	if opts.SortBy == "" {
+		opts.SortBy = SortByName
+	}
+	if opts.SortBy != SortByName && opts.SortBy != SortByCreatedAt {
+		return opts, ErrInvalidSort
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+	if opts.Limit > MaxListLimit {
+		opts.Limit = MaxListLimit
+	}
+	return opts, nil
+}
+
+// foldCase lowers ASCII letters only, as SQLite's NOCASE collation and LIKE
+// do, so that both stores sort and match names alike.
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// escapeLike escapes the LIKE wildcards in s for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func ListOrganizations(db *sql.DB, opts ListOrganizationsOptions) (OrganizationPage, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return OrganizationPage{}, err
+	}
+	cursor, err := decodeCursor(opts.Cursor, opts)
+	if err != nil {
+		return OrganizationPage{}, err
+	}
+
+	// SortBy has been validated, so it is safe to use as a column name
+	sortColumn := "o." + opts.SortBy
+	if opts.SortBy == SortByName {
+		sortColumn += " COLLATE NOCASE"
+	}
+	direction, comparison := "ASC", ">"
+	if opts.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	where := []string{"o.archived_at IS NULL"}
+	if opts.Archived {
+		where = []string{"o.archived_at IS NOT NULL"}
+	}
+	var args []interface{}
+	for _, serviceID := range opts.ServiceIDs {
+		where = append(where, "EXISTS (SELECT 1 FROM organization_services os WHERE os.organization_id = o.id AND os.service_id = ?)")
+		args = append(args, serviceID)
+	}
+	if opts.NameContains != "" {
+		// LIKE ignores the case of ASCII letters
+		where = append(where, `o.name LIKE '%' || ? || '%' ESCAPE '\'`)
+		args = append(args, escapeLike(opts.NameContains))
+	}
+	if cursor != nil {
+		where = append(where, fmt.Sprintf("(%s, o.id) %s (?, ?)", sortColumn, comparison))
+		args = append(args, cursor.Value, cursor.ID)
+	}
+
+	query := "SELECT o.id, o.name, o.description, o.phone, o.latitude, o.longitude, o.created_at FROM organizations o WHERE " + strings.Join(where, " AND ")
+	// Fetch one extra row to learn whether there is a next page
+	query += fmt.Sprintf(" ORDER BY %s %s, o.id %s LIMIT ?", sortColumn, direction, direction)
+	args = append(args, opts.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return OrganizationPage{}, err
+	}
+	defer rows.Close()
+
+	organizations := []core.Organization{}
+	var createdAt []string
+	for rows.Next() {
+		var org core.Organization
+		var created string
+		if err := rows.Scan(&org.ID, &org.Name, &org.Description, &org.Phone, &org.Location.Latitude, &org.Location.Longitude, &created); err != nil {
+			return OrganizationPage{}, err
+		}
+		organizations = append(organizations, org)
+		createdAt = append(createdAt, created)
+	}
+	if err := rows.Err(); err != nil {
+		return OrganizationPage{}, err
+	}
+
+	var page OrganizationPage
+	if len(organizations) > opts.Limit {
+		last := opts.Limit - 1
+		value := organizations[last].Name
+		if opts.SortBy == SortByCreatedAt {
+			value = createdAt[last]
+		}
+		page.NextCursor = listCursor{SortBy: opts.SortBy, Descending: opts.Descending, Value: value, ID: organizations[last].ID}.encode()
+		organizations = organizations[:opts.Limit]
+	}
+
+	services, err := getServicesForOrganizations(db, organizations)
+	if err != nil {
+		return OrganizationPage{}, err
+	}
+	for i := range organizations {
+		organizations[i].Services = services[organizations[i].ID]
+	}
+
+	page.Organizations = organizations
+	return page, nil
+}
+
+// getServicesForOrganizations loads the services of all orgs in one query,
+// keyed by organization ID.
+func getServicesForOrganizations(db *sql.DB, orgs []core.Organization) (map[string][]core.Service, error) {
+	services := make(map[string][]core.Service, len(orgs))
+	if len(orgs) == 0 {
+		return services, nil
+	}
+
+	placeholders := make([]string, len(orgs))
+	args := make([]interface{}, len(orgs))
+	for i, org := range orgs {
+		placeholders[i] = "?"
+		args[i] = org.ID
+	}
+
+	query := fmt.Sprintf(`
+		SELECT os.organization_id, s.id, s.name, s.deprecated, COALESCE(s.parent_id, ''), %s
+		FROM services s
+		JOIN organization_services os ON s.id = os.service_id
+		WHERE os.organization_id IN (%s)
+		ORDER BY s.id
+	`, capacityColumns, strings.Join(placeholders, ","))
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID string
+		var svc core.Service
+		var c nullCapacity
+		if err := rows.Scan(&orgID, &svc.ID, &svc.Name, &svc.Deprecated, &svc.ParentID, &c.total, &c.available, &c.updatedAt); err != nil {
+			return nil, err
+		}
+		if svc.Capacity, err = c.capacity(); err != nil {
+			return nil, err
+		}
+		services[orgID] = append(services[orgID], svc)
+	}
+	return services, rows.Err()
+}
+
+func (s *SQLStore) ListOrganizations(opts ListOrganizationsOptions) (OrganizationPage, error) {
+	return ListOrganizations(s.db, opts)
+}
@@ -0,0 +1,938 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// MemoryStore is a map-backed Store for tests. It mirrors the behaviour of
+// SQLStore, including returning results ordered by ID.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	orgs        map[string]core.Organization
+	createdAt   map[string]string // organization ID -> createdAtLayout timestamp
+	archived    map[string]bool
+	services    map[string]core.Service
+	orgServices map[string]map[string]bool // organization ID -> set of service IDs
+	// serviceNames and orgTranslations are keyed by ID and then language tag
+	serviceNames    map[string]map[string]string
+	orgTranslations map[string]map[string]core.OrganizationTranslation
+	// hours is keyed by organization ID and then service ID, empty for the
+	// organization itself
+	hours map[string]map[string]core.OpeningHours
+	// capacity is keyed by organization ID and then service ID
+	capacity  map[string]map[string]core.Capacity
+	holds     map[string]core.Hold
+	referrals map[string]core.Referral
+	events    *EventBus
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		orgs:        make(map[string]core.Organization),
+		createdAt:   make(map[string]string),
+		archived:    make(map[string]bool),
+		services:    make(map[string]core.Service),
+		orgServices: make(map[string]map[string]bool),
+
+		serviceNames:    make(map[string]map[string]string),
+		orgTranslations: make(map[string]map[string]core.OrganizationTranslation),
+		hours:           make(map[string]map[string]core.OpeningHours),
+		capacity:        make(map[string]map[string]core.Capacity),
+		holds:           make(map[string]core.Hold),
+		referrals:       make(map[string]core.Referral),
+		events:          NewEventBus(),
+	}
+}
+
+func (m *MemoryStore) CreateOrganization(org core.Organization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgs[org.ID]; ok {
+		return fmt.Errorf("organization %q already exists", org.ID)
+	}
+	org.Services = nil
+	m.orgs[org.ID] = org
+	m.createdAt[org.ID] = time.Now().UTC().Format(createdAtLayout)
+	m.publishOrganization(EventOrganizationCreated, org.ID)
+	return nil
+}
+
+func (m *MemoryStore) GetOrganizationByID(orgID string) (core.Organization, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	org, ok := m.orgs[orgID]
+	if !ok || m.archived[orgID] {
+		return core.Organization{}, ErrNotFound
+	}
+	return org, nil
+}
+
+func (m *MemoryStore) UpdateOrganization(org core.Organization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgs[org.ID]; !ok || m.archived[org.ID] {
+		return ErrNotFound
+	}
+	before, visible := m.snapshot(org.ID)
+	org.Services = nil
+	m.orgs[org.ID] = org
+	m.publishUpdate(org.ID, before, visible)
+	return nil
+}
+
+func (m *MemoryStore) DeleteOrganizationByID(orgID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgs[orgID]; !ok {
+		return ErrNotFound
+	}
+	before, visible := m.snapshot(orgID)
+	delete(m.orgs, orgID)
+	delete(m.createdAt, orgID)
+	delete(m.archived, orgID)
+	delete(m.orgServices, orgID)
+	delete(m.orgTranslations, orgID)
+	delete(m.hours, orgID)
+	delete(m.capacity, orgID)
+	for id, h := range m.holds {
+		if h.OrganizationID == orgID {
+			delete(m.holds, id)
+		}
+	}
+	for id, r := range m.referrals {
+		if r.FromOrganizationID == orgID || r.ToOrganizationID == orgID {
+			delete(m.referrals, id)
+		}
+	}
+	if visible {
+		m.events.Publish(Event{Type: EventOrganizationDeleted, Organization: before})
+	}
+	return nil
+}
+
+func (m *MemoryStore) ArchiveOrganization(orgID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before, visible := m.snapshot(orgID)
+	if !visible {
+		return ErrNotFound
+	}
+	m.archived[orgID] = true
+	m.events.Publish(Event{Type: EventOrganizationDeleted, Organization: before})
+	return nil
+}
+
+func (m *MemoryStore) RestoreOrganization(orgID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.archived[orgID] {
+		return ErrNotFound
+	}
+	delete(m.archived, orgID)
+	m.publishOrganization(EventOrganizationCreated, orgID)
+	return nil
+}
+
+func (m *MemoryStore) ListOrganizations(opts ListOrganizationsOptions) (OrganizationPage, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return OrganizationPage{}, err
+	}
+	cursor, err := decodeCursor(opts.Cursor, opts)
+	if err != nil {
+		return OrganizationPage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sortValue := func(org core.Organization) string {
+		if opts.SortBy == SortByCreatedAt {
+			return m.createdAt[org.ID]
+		}
+		return org.Name
+	}
+	// less orders by the sort value, then ID, honouring the direction
+	less := func(v1, id1, v2, id2 string) bool {
+		if opts.Descending {
+			v1, id1, v2, id2 = v2, id2, v1, id1
+		}
+		if v1, v2 = foldCase(v1), foldCase(v2); v1 != v2 {
+			return v1 < v2
+		}
+		return id1 < id2
+	}
+
+	var matches []core.Organization
+	for _, org := range m.orgs {
+		if m.archived[org.ID] != opts.Archived {
+			continue
+		}
+		offersAll := true
+		for _, id := range opts.ServiceIDs {
+			if !m.orgServices[org.ID][id] {
+				offersAll = false
+				break
+			}
+		}
+		if !offersAll {
+			continue
+		}
+		if !strings.Contains(foldCase(org.Name), foldCase(opts.NameContains)) {
+			continue
+		}
+		if cursor != nil && !less(cursor.Value, cursor.ID, sortValue(org), org.ID) {
+			continue
+		}
+		matches = append(matches, org)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return less(sortValue(matches[i]), matches[i].ID, sortValue(matches[j]), matches[j].ID)
+	})
+
+	page := OrganizationPage{Organizations: []core.Organization{}}
+	if len(matches) > opts.Limit {
+		last := matches[opts.Limit-1]
+		page.NextCursor = listCursor{SortBy: opts.SortBy, Descending: opts.Descending, Value: sortValue(last), ID: last.ID}.encode()
+		matches = matches[:opts.Limit]
+	}
+	for _, org := range matches {
+		org.Services = m.offeredServices(org.ID)
+		page.Organizations = append(page.Organizations, org)
+	}
+	return page, nil
+}
+
+func (m *MemoryStore) GetOrganizationsByServices(serviceIDs []string, includeDescendants bool) ([]core.Organization, error) {
+	matches, err := m.MatchOrganizationsByServices(ServiceMatch{ServiceIDs: serviceIDs, IncludeDescendants: includeDescendants})
+	if err != nil {
+		return nil, err
+	}
+
+	var organizations []core.Organization
+	for _, match := range matches {
+		organizations = append(organizations, match.Organization)
+	}
+	return organizations, nil
+}
+
+func (m *MemoryStore) MatchOrganizationsByServices(match ServiceMatch) ([]OrganizationMatch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matches []OrganizationMatch
+	for _, org := range m.sortedOrganizations() {
+		offered := m.orgServices[org.ID]
+		var covered []string
+		for _, id := range match.ServiceIDs {
+			if _, ok := m.services[id]; !ok {
+				continue
+			}
+			for offeredID := range offered {
+				if !m.hasCapacity(org.ID, offeredID, match) {
+					continue
+				}
+				if offeredID == id || match.IncludeDescendants && m.isAncestor(id, offeredID) {
+					covered = append(covered, id)
+					break
+				}
+			}
+		}
+		covered = match.inRequestOrder(covered)
+		if len(covered) > 0 && len(covered) >= match.minMatches() {
+			matches = append(matches, OrganizationMatch{Organization: org, MatchedServiceIDs: covered})
+		}
+	}
+	return matches, nil
+}
+
+func (m *MemoryStore) NearestOrganizations(q NearestQuery) ([]NearbyOrganization, error) {
+	if q.Limit <= 0 {
+		return nil, nil
+	}
+
+	matches, err := m.MatchOrganizationsByServices(q.Match)
+	if err != nil {
+		return nil, err
+	}
+	if q.OpenAt != nil {
+		hours := make(map[string]map[string]core.OpeningHours, len(matches))
+		for _, match := range matches {
+			if hours[match.Organization.ID], err = m.GetOpeningHours(match.Organization.ID); err != nil {
+				return nil, err
+			}
+		}
+		matches = filterOpen(matches, q.Match, *q.OpenAt, hours)
+	}
+	return rankNearby(matches, q, q.maxRadiusKm()), nil
+}
+
+func (m *MemoryStore) GetOrganizationsInBox(box BoundingBox) ([]core.Organization, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var organizations []core.Organization
+	for _, org := range m.sortedOrganizations() {
+		if box.Contains(org.Location) {
+			organizations = append(organizations, org)
+		}
+	}
+	return organizations, nil
+}
+
+// hasCapacity reports whether the organization's offering of serviceID
+// satisfies the capacity requirements of match. The caller must hold mu.
+func (m *MemoryStore) hasCapacity(orgID, serviceID string, match ServiceMatch) bool {
+	if !match.Available {
+		return true
+	}
+	c, ok := m.capacity[orgID][serviceID]
+	return ok && c.Available > 0 && !c.UpdatedAt.Before(match.UpdatedSince)
+}
+
+// isAncestor reports whether ancestorID is above serviceID in the catalog
+// tree. The caller must hold mu.
+func (m *MemoryStore) isAncestor(ancestorID, serviceID string) bool {
+	for parentID := m.services[serviceID].ParentID; parentID != ""; parentID = m.services[parentID].ParentID {
+		if parentID == ancestorID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkParent mirrors checkParent of the SQL store. The caller must hold mu.
+func (m *MemoryStore) checkParent(svc core.Service) error {
+	if svc.ParentID == "" {
+		return nil
+	}
+	if _, ok := m.services[svc.ParentID]; !ok {
+		return ErrUnknownService
+	}
+	if svc.ParentID == svc.ID || m.isAncestor(svc.ID, svc.ParentID) {
+		return ErrServiceCycle
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertPredefinedServices(services []core.Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, svc := range services {
+		if _, ok := m.services[svc.ID]; !ok {
+			m.services[svc.ID] = svc
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetPredefinedServices() ([]core.Service, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sortedServices(func(core.Service) bool { return true }), nil
+}
+
+func (m *MemoryStore) GetServicesByID(serviceIDs []string) ([]core.Service, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(serviceIDs))
+	for _, id := range serviceIDs {
+		wanted[id] = true
+	}
+	services := m.sortedServices(func(svc core.Service) bool { return wanted[svc.ID] })
+	if len(services) != len(wanted) {
+		return nil, ErrUnknownService
+	}
+	return services, nil
+}
+
+func (m *MemoryStore) CreateService(svc core.Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.services[svc.ID]; ok {
+		return ErrServiceExists
+	}
+	if err := m.checkParent(svc); err != nil {
+		return err
+	}
+	m.services[svc.ID] = svc
+	return nil
+}
+
+func (m *MemoryStore) UpdateService(svc core.Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkParent(svc); err != nil {
+		return err
+	}
+	if _, ok := m.services[svc.ID]; !ok {
+		return ErrNotFound
+	}
+	m.services[svc.ID] = svc
+	return nil
+}
+
+func (m *MemoryStore) DeleteService(serviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.services[serviceID]; !ok {
+		return ErrNotFound
+	}
+	for _, offered := range m.orgServices {
+		if offered[serviceID] {
+			return ErrServiceInUse
+		}
+	}
+	for _, h := range m.holds {
+		if h.ServiceID == serviceID {
+			return ErrServiceInUse
+		}
+	}
+	for _, r := range m.referrals {
+		if r.ServiceID == serviceID {
+			return ErrServiceInUse
+		}
+	}
+	for _, svc := range m.services {
+		if svc.ParentID == serviceID {
+			return ErrServiceHasChildren
+		}
+	}
+	delete(m.services, serviceID)
+	delete(m.serviceNames, serviceID)
+	return nil
+}
+
+func (m *MemoryStore) AddServicesToOrganization(orgID string, serviceIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkAssociation(orgID, serviceIDs); err != nil {
+		return err
+	}
+
+	before, visible := m.snapshot(orgID)
+	offered := m.orgServices[orgID]
+	if offered == nil {
+		offered = make(map[string]bool)
+		m.orgServices[orgID] = offered
+	}
+	for _, id := range serviceIDs {
+		offered[id] = true
+	}
+	m.publishUpdate(orgID, before, visible)
+	return nil
+}
+
+func (m *MemoryStore) ReplaceOrganizationServices(orgID string, serviceIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkAssociation(orgID, serviceIDs); err != nil {
+		return err
+	}
+
+	before, visible := m.snapshot(orgID)
+	offered := make(map[string]bool, len(serviceIDs))
+	for _, id := range serviceIDs {
+		offered[id] = true
+	}
+	m.orgServices[orgID] = offered
+	m.deleteStaleServiceHours(orgID)
+	for serviceID := range m.capacity[orgID] {
+		if !offered[serviceID] {
+			delete(m.capacity[orgID], serviceID)
+		}
+	}
+	m.publishUpdate(orgID, before, visible)
+	return nil
+}
+
+func (m *MemoryStore) RemoveServiceFromOrganization(orgID, serviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.orgServices[orgID][serviceID] {
+		return ErrNotFound
+	}
+	before, visible := m.snapshot(orgID)
+	delete(m.orgServices[orgID], serviceID)
+	delete(m.capacity[orgID], serviceID)
+	m.deleteStaleServiceHours(orgID)
+	m.publishUpdate(orgID, before, visible)
+	return nil
+}
+
+// checkAssociation mirrors the foreign keys of organization_services. The
+// caller must hold mu.
+func (m *MemoryStore) checkAssociation(orgID string, serviceIDs []string) error {
+	if _, ok := m.orgs[orgID]; !ok {
+		return fmt.Errorf("organization %q does not exist", orgID)
+	}
+	for _, id := range serviceIDs {
+		if _, ok := m.services[id]; !ok {
+			return ErrUnknownService
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetServicesByOrganizationID(orgID string) ([]core.Service, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.offeredServices(orgID), nil
+}
+
+func (m *MemoryStore) GetServicesByOrganizationIDs(orgIDs []string) (map[string][]core.Service, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	services := make(map[string][]core.Service, len(orgIDs))
+	for _, orgID := range orgIDs {
+		if offered := m.offeredServices(orgID); len(offered) > 0 {
+			services[orgID] = offered
+		}
+	}
+	return services, nil
+}
+
+// offeredServices returns the services of an organization with their
+// capacity, ordered by ID. The caller must hold mu.
+func (m *MemoryStore) offeredServices(orgID string) []core.Service {
+	offered := m.orgServices[orgID]
+	services := m.sortedServices(func(svc core.Service) bool { return offered[svc.ID] })
+	for i := range services {
+		if c, ok := m.capacity[orgID][services[i].ID]; ok {
+			services[i].Capacity = &c
+		}
+	}
+	return services
+}
+
+func (m *MemoryStore) UpdateCapacity(orgID, serviceID string, u CapacityUpdate) (core.Capacity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.archived[orgID] || !m.orgServices[orgID][serviceID] {
+		return core.Capacity{}, ErrNotFound
+	}
+	c, tracked := m.capacity[orgID][serviceID]
+	if !tracked && u.Total == nil {
+		return core.Capacity{}, errCapacityNeedsTotal
+	}
+	if u.Total != nil {
+		c.Total = *u.Total
+	}
+	if u.Available != nil {
+		c.Available = *u.Available
+	}
+	if err := validateCapacity(c.Total, c.Available); err != nil {
+		return core.Capacity{}, err
+	}
+	c.UpdatedAt = time.Now().UTC()
+	if m.capacity[orgID] == nil {
+		m.capacity[orgID] = make(map[string]core.Capacity)
+	}
+	m.capacity[orgID][serviceID] = c
+	if org, ok := m.snapshot(orgID); ok {
+		m.events.Publish(Event{Type: EventCapacityChanged, Organization: org, ServiceID: serviceID, Capacity: &c})
+	}
+	return c, nil
+}
+
+func (m *MemoryStore) PlaceHold(hold core.Hold) (core.Hold, error) {
+	hold, err := newHold(hold)
+	if err != nil {
+		return core.Hold{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.archived[hold.OrganizationID] || !m.orgServices[hold.OrganizationID][hold.ServiceID] {
+		return core.Hold{}, ErrNotFound
+	}
+	c, ok := m.capacity[hold.OrganizationID][hold.ServiceID]
+	if !ok {
+		return core.Hold{}, fmt.Errorf("%w: the capacity of the service is not tracked", ErrNoCapacity)
+	}
+	if c.Available < 1 {
+		return core.Hold{}, ErrNoCapacity
+	}
+	c.Available--
+	m.capacity[hold.OrganizationID][hold.ServiceID] = c
+	m.holds[hold.ID] = hold
+	m.publishCapacity(hold.OrganizationID, hold.ServiceID)
+	return hold, nil
+}
+
+func (m *MemoryStore) GetHold(holdID string) (core.Hold, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h, ok := m.holds[holdID]
+	if !ok {
+		return core.Hold{}, ErrNotFound
+	}
+	return h, nil
+}
+
+func (m *MemoryStore) ListHolds(orgID string, status core.HoldStatus) ([]core.Hold, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	holds := []core.Hold{}
+	for _, h := range m.holds {
+		if h.OrganizationID == orgID && (status == "" || h.Status == status) {
+			holds = append(holds, h)
+		}
+	}
+	sort.Slice(holds, func(i, j int) bool {
+		if !holds[i].CreatedAt.Equal(holds[j].CreatedAt) {
+			return holds[i].CreatedAt.After(holds[j].CreatedAt)
+		}
+		return holds[i].ID > holds[j].ID
+	})
+	return holds, nil
+}
+
+func (m *MemoryStore) ConfirmHold(holdID string) (core.Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.holds[holdID]
+	if !ok {
+		return core.Hold{}, ErrNotFound
+	}
+	now := time.Now().UTC()
+	if h.Status != core.HoldHeld || !h.ExpiresAt.After(now) {
+		return core.Hold{}, fmt.Errorf("%w: it is %s", ErrHoldNotActive, h.Status)
+	}
+	h.Status = core.HoldConfirmed
+	h.UpdatedAt = now
+	m.holds[holdID] = h
+	return h, nil
+}
+
+func (m *MemoryStore) ReleaseHold(holdID string) (core.Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.holds[holdID]
+	if !ok {
+		return core.Hold{}, ErrNotFound
+	}
+	if h.Status != core.HoldHeld {
+		return core.Hold{}, fmt.Errorf("%w: it is %s", ErrHoldNotActive, h.Status)
+	}
+	h = m.endHold(h, core.HoldReleased, time.Now())
+	m.publishCapacity(h.OrganizationID, h.ServiceID)
+	return h, nil
+}
+
+func (m *MemoryStore) ExpireHolds(now time.Time) ([]core.Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := []core.Hold{}
+	for _, h := range m.holds {
+		if h.Status == core.HoldHeld && !h.ExpiresAt.After(now) {
+			h = m.endHold(h, core.HoldExpired, now)
+			m.publishCapacity(h.OrganizationID, h.ServiceID)
+			expired = append(expired, h)
+		}
+	}
+	return expired, nil
+}
+
+// endHold moves a held hold to status and gives its unit back. The caller
+// must hold mu.
+func (m *MemoryStore) endHold(h core.Hold, status core.HoldStatus, now time.Time) core.Hold {
+	h.Status = status
+	h.UpdatedAt = now.UTC()
+	m.holds[h.ID] = h
+	if c, ok := m.capacity[h.OrganizationID][h.ServiceID]; ok && c.Available < c.Total {
+		c.Available++
+		m.capacity[h.OrganizationID][h.ServiceID] = c
+	}
+	return h
+}
+
+// publishCapacity publishes the current capacity of a service at an
+// organization after a hold changed it. The caller must hold mu.
+func (m *MemoryStore) publishCapacity(orgID, serviceID string) {
+	if !m.events.hasSubscribers() {
+		return
+	}
+	if org, ok := m.snapshot(orgID); ok {
+		publishCapacity(m.events, org, serviceID)
+	}
+}
+
+func (m *MemoryStore) CreateReferral(r core.Referral) (core.Referral, error) {
+	r, err := newReferral(r)
+	if err != nil {
+		return core.Referral{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgs[r.FromOrganizationID]; !ok || m.archived[r.FromOrganizationID] {
+		return core.Referral{}, ErrNotFound
+	}
+	if m.archived[r.ToOrganizationID] || !m.orgServices[r.ToOrganizationID][r.ServiceID] {
+		return core.Referral{}, fmt.Errorf("%w: the receiving organization does not offer the service", ErrInvalidReferral)
+	}
+	m.referrals[r.ID] = r
+	return r, nil
+}
+
+func (m *MemoryStore) GetReferral(referralID string) (core.Referral, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r, ok := m.referrals[referralID]
+	if !ok {
+		return core.Referral{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *MemoryStore) ListReferrals(filter ReferralFilter) ([]core.Referral, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	referrals := []core.Referral{}
+	for _, r := range m.referrals {
+		sent := r.FromOrganizationID == filter.OrganizationID
+		received := r.ToOrganizationID == filter.OrganizationID
+		switch filter.Direction {
+		case ReferralsSent:
+			received = false
+		case ReferralsReceived:
+			sent = false
+		}
+		if (sent || received) && (filter.Status == "" || r.Status == filter.Status) {
+			referrals = append(referrals, r)
+		}
+	}
+	sort.Slice(referrals, func(i, j int) bool {
+		if !referrals[i].CreatedAt.Equal(referrals[j].CreatedAt) {
+			return referrals[i].CreatedAt.After(referrals[j].CreatedAt)
+		}
+		return referrals[i].ID > referrals[j].ID
+	})
+	return referrals, nil
+}
+
+func (m *MemoryStore) UpdateReferral(orgID, referralID string, u ReferralUpdate) (core.Referral, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.referrals[referralID]
+	if !ok || (orgID != r.FromOrganizationID && orgID != r.ToOrganizationID) {
+		return core.Referral{}, ErrNotFound
+	}
+	r, err := applyReferralUpdate(r, orgID, u, time.Now())
+	if err != nil {
+		return core.Referral{}, err
+	}
+	m.referrals[r.ID] = r
+	return r, nil
+}
+
+func (m *MemoryStore) SetServiceTranslation(serviceID, lang, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.services[serviceID]; !ok {
+		return ErrNotFound
+	}
+	if m.serviceNames[serviceID] == nil {
+		m.serviceNames[serviceID] = make(map[string]string)
+	}
+	m.serviceNames[serviceID][lang] = name
+	return nil
+}
+
+func (m *MemoryStore) DeleteServiceTranslation(serviceID, lang string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.serviceNames[serviceID][lang]; !ok {
+		return ErrNotFound
+	}
+	delete(m.serviceNames[serviceID], lang)
+	return nil
+}
+
+func (m *MemoryStore) GetServiceTranslations() (map[string]map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	translations := make(map[string]map[string]string, len(m.serviceNames))
+	for serviceID, names := range m.serviceNames {
+		if len(names) == 0 {
+			continue
+		}
+		translations[serviceID] = make(map[string]string, len(names))
+		for lang, name := range names {
+			translations[serviceID][lang] = name
+		}
+	}
+	return translations, nil
+}
+
+func (m *MemoryStore) SetOrganizationTranslation(orgID, lang string, t core.OrganizationTranslation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgs[orgID]; !ok || m.archived[orgID] {
+		return ErrNotFound
+	}
+	if m.orgTranslations[orgID] == nil {
+		m.orgTranslations[orgID] = make(map[string]core.OrganizationTranslation)
+	}
+	m.orgTranslations[orgID][lang] = t
+	return nil
+}
+
+func (m *MemoryStore) DeleteOrganizationTranslation(orgID, lang string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgTranslations[orgID][lang]; !ok {
+		return ErrNotFound
+	}
+	delete(m.orgTranslations[orgID], lang)
+	return nil
+}
+
+func (m *MemoryStore) GetOrganizationTranslations(orgID string) (map[string]core.OrganizationTranslation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	translations := make(map[string]core.OrganizationTranslation, len(m.orgTranslations[orgID]))
+	for lang, t := range m.orgTranslations[orgID] {
+		translations[lang] = t
+	}
+	return translations, nil
+}
+
+func (m *MemoryStore) GetOrganizationTranslationsByIDs(orgIDs []string) (map[string]map[string]core.OrganizationTranslation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	translations := make(map[string]map[string]core.OrganizationTranslation)
+	for _, orgID := range orgIDs {
+		if len(m.orgTranslations[orgID]) == 0 {
+			continue
+		}
+		translations[orgID] = make(map[string]core.OrganizationTranslation, len(m.orgTranslations[orgID]))
+		for lang, t := range m.orgTranslations[orgID] {
+			translations[orgID][lang] = t
+		}
+	}
+	return translations, nil
+}
+
+func (m *MemoryStore) SetOpeningHours(orgID, serviceID string, hours core.OpeningHours) error {
+	if err := validateOpeningHours(hours); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orgs[orgID]; !ok || m.archived[orgID] {
+		return ErrNotFound
+	}
+	if serviceID != "" && !m.orgServices[orgID][serviceID] {
+		return ErrNotFound
+	}
+	if m.hours[orgID] == nil {
+		m.hours[orgID] = make(map[string]core.OpeningHours)
+	}
+	m.hours[orgID][serviceID] = hours
+	return nil
+}
+
+func (m *MemoryStore) DeleteOpeningHours(orgID, serviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.hours[orgID][serviceID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.hours[orgID], serviceID)
+	return nil
+}
+
+func (m *MemoryStore) GetOpeningHours(orgID string) (map[string]core.OpeningHours, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hours := make(map[string]core.OpeningHours, len(m.hours[orgID]))
+	for serviceID, h := range m.hours[orgID] {
+		hours[serviceID] = h
+	}
+	return hours, nil
+}
+
+// deleteStaleServiceHours drops the hours of services the organization no
+// longer offers. The caller must hold mu.
+func (m *MemoryStore) deleteStaleServiceHours(orgID string) {
+	for serviceID := range m.hours[orgID] {
+		if serviceID != "" && !m.orgServices[orgID][serviceID] {
+			delete(m.hours[orgID], serviceID)
+		}
+	}
+}
+
+// sortedOrganizations returns all unarchived organizations ordered by ID.
+// The caller must hold mu.
+func (m *MemoryStore) sortedOrganizations() []core.Organization {
+	orgs := make([]core.Organization, 0, len(m.orgs))
+	for _, org := range m.orgs {
+		if !m.archived[org.ID] {
+			orgs = append(orgs, org)
+		}
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].ID < orgs[j].ID })
+	return orgs
+}
+
+// sortedServices returns the catalog services accepted by keep, ordered by ID.
+// The caller must hold mu.
+func (m *MemoryStore) sortedServices(keep func(core.Service) bool) []core.Service {
+	var services []core.Service
+	for _, svc := range m.services {
+		if keep(svc) {
+			services = append(services, svc)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is a single schema version. Its statements are applied in order
+// inside one transaction, and the version is recorded in schema_migrations
+// once they all succeed.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// migrations must be kept in ascending version order. Never edit a migration
+// that has shipped; append a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE organizations (id TEXT PRIMARY KEY, name TEXT, phone TEXT, latitude REAL, longitude REAL)`,
+			`CREATE TABLE services (id TEXT PRIMARY KEY, name TEXT)`,
+			`CREATE TABLE organization_services (organization_id TEXT, service_id TEXT, PRIMARY KEY (organization_id, service_id), FOREIGN KEY (organization_id) REFERENCES organizations(id), FOREIGN KEY (service_id) REFERENCES services(id))`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`CREATE INDEX organization_services_service_id ON organization_services (service_id)`,
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			`CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				key_hash TEXT NOT NULL UNIQUE,
+				owner_id TEXT NOT NULL,
+				owner_email TEXT NOT NULL,
+				owner_verified_email INTEGER NOT NULL DEFAULT 0,
+				owner_service TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				revoked INTEGER NOT NULL DEFAULT 0,
+				last_used_at TIMESTAMP
+			)`,
+			`CREATE INDEX api_keys_owner_id ON api_keys (owner_id)`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			`ALTER TABLE api_keys ADD COLUMN monthly_cap INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE api_key_usage (
+				key_id TEXT NOT NULL,
+				day TEXT NOT NULL,
+				endpoint TEXT NOT NULL,
+				count INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (key_id, day, endpoint),
+				FOREIGN KEY (key_id) REFERENCES api_keys(id)
+			)`,
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			`ALTER TABLE api_keys ADD COLUMN tier TEXT NOT NULL DEFAULT 'standard'`,
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			// Space separated, like OAuth scopes
+			`ALTER TABLE api_keys ADD COLUMN scopes TEXT NOT NULL DEFAULT 'orgs:read'`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			// Fixed-width UTC text (createdAtLayout) so it sorts and compares as a string
+			`ALTER TABLE organizations ADD COLUMN created_at TEXT NOT NULL DEFAULT ''`,
+			`UPDATE organizations SET created_at = strftime('%Y-%m-%dT%H:%M:%f000000Z', 'now')`,
+			`CREATE INDEX organizations_name ON organizations (name, id)`,
+			`CREATE INDEX organizations_created_at ON organizations (created_at, id)`,
+		},
+	},
+	{
+		version: 8,
+		statements: []string{
+			// SQLite cannot alter foreign keys, so rebuild organization_services
+			// with cascading deletes, dropping rows orphaned before they existed.
+			`CREATE TABLE organization_services_new (
+				organization_id TEXT NOT NULL,
+				service_id TEXT NOT NULL,
+				PRIMARY KEY (organization_id, service_id),
+				FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+				FOREIGN KEY (service_id) REFERENCES services(id)
+			)`,
+			`INSERT INTO organization_services_new (organization_id, service_id)
+				SELECT organization_id, service_id FROM organization_services
+				WHERE organization_id IN (SELECT id FROM organizations)
+				AND service_id IN (SELECT id FROM services)`,
+			`DROP TABLE organization_services`,
+			`ALTER TABLE organization_services_new RENAME TO organization_services`,
+			`CREATE INDEX organization_services_service_id ON organization_services (service_id)`,
+			`ALTER TABLE organizations ADD COLUMN archived_at TEXT`,
+		},
+	},
+	{
+		version: 9,
+		statements: []string{
+			`ALTER TABLE services ADD COLUMN deprecated INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 10,
+		statements: []string{
+			`ALTER TABLE services ADD COLUMN parent_id TEXT REFERENCES services(id)`,
+			`CREATE INDEX services_parent_id ON services(parent_id)`,
+		},
+	},
+	{
+		version: 11,
+		statements: []string{
+			`ALTER TABLE organizations ADD COLUMN description TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE service_translations (
+				service_id TEXT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+				lang TEXT NOT NULL,
+				name TEXT NOT NULL,
+				PRIMARY KEY (service_id, lang)
+			)`,
+			`CREATE TABLE organization_translations (
+				organization_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				lang TEXT NOT NULL,
+				name TEXT NOT NULL DEFAULT '',
+				description TEXT NOT NULL DEFAULT '',
+				PRIMARY KEY (organization_id, lang)
+			)`,
+		},
+	},
+	{
+		// Spatial index of organization locations. R*Tree entries are keyed
+		// by integer, so organization_geo gives each organization a stable
+		// one; plain rowids may change on VACUUM.
+		version: 12,
+		statements: []string{
+			`CREATE TABLE organization_geo (
+				geo_id INTEGER PRIMARY KEY,
+				organization_id TEXT NOT NULL UNIQUE
+			)`,
+			`CREATE VIRTUAL TABLE organizations_rtree USING rtree(id, min_lat, max_lat, min_lon, max_lon)`,
+			`INSERT INTO organization_geo (organization_id) SELECT id FROM organizations`,
+			`INSERT INTO organizations_rtree
+				SELECT m.geo_id, o.latitude, o.latitude, o.longitude, o.longitude
+				FROM organizations o JOIN organization_geo m ON m.organization_id = o.id`,
+			`CREATE TRIGGER organizations_rtree_insert AFTER INSERT ON organizations BEGIN
+				INSERT INTO organization_geo (organization_id) VALUES (new.id);
+				INSERT INTO organizations_rtree
+					SELECT geo_id, new.latitude, new.latitude, new.longitude, new.longitude
+					FROM organization_geo WHERE organization_id = new.id;
+			END`,
+			`CREATE TRIGGER organizations_rtree_update AFTER UPDATE OF latitude, longitude ON organizations BEGIN
+				UPDATE organizations_rtree
+				SET min_lat = new.latitude, max_lat = new.latitude, min_lon = new.longitude, max_lon = new.longitude
+				WHERE id = (SELECT geo_id FROM organization_geo WHERE organization_id = new.id);
+			END`,
+			`CREATE TRIGGER organizations_rtree_delete AFTER DELETE ON organizations BEGIN
+				DELETE FROM organizations_rtree WHERE id = (SELECT geo_id FROM organization_geo WHERE organization_id = old.id);
+				DELETE FROM organization_geo WHERE organization_id = old.id;
+			END`,
+		},
+	},
+	{
+		// Opening hours are JSON documents as they are always read and
+		// written whole. An empty service_id holds the organization's hours.
+		version: 13,
+		statements: []string{
+			`CREATE TABLE opening_hours (
+				organization_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				service_id TEXT NOT NULL DEFAULT '',
+				hours TEXT NOT NULL,
+				PRIMARY KEY (organization_id, service_id)
+			)`,
+		},
+	},
+	{
+		// Capacity of the services an organization offers; NULL when it
+		// does not track it.
+		version: 14,
+		statements: []string{
+			`ALTER TABLE organization_services ADD COLUMN capacity_total INTEGER`,
+			`ALTER TABLE organization_services ADD COLUMN capacity_available INTEGER`,
+			`ALTER TABLE organization_services ADD COLUMN capacity_updated_at TIMESTAMP`,
+		},
+	},
+	{
+		// Outbound webhooks owned by API keys, and the log of their deliveries
+		version: 15,
+		statements: []string{
+			`CREATE TABLE webhooks (
+				id TEXT PRIMARY KEY,
+				key_id TEXT NOT NULL REFERENCES api_keys(id),
+				url TEXT NOT NULL,
+				event_types TEXT NOT NULL DEFAULT '',
+				secret TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX webhooks_key_id ON webhooks (key_id)`,
+			`CREATE TABLE webhook_deliveries (
+				id TEXT PRIMARY KEY,
+				webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+				event_type TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				status TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_status_code INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				next_attempt_at TIMESTAMP
+			)`,
+			`CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, created_at)`,
+			`CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+		},
+	},
+	{
+		// Time-limited holds on one unit of a service's capacity
+		version: 16,
+		statements: []string{
+			`CREATE TABLE holds (
+				id TEXT PRIMARY KEY,
+				organization_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				service_id TEXT NOT NULL REFERENCES services(id),
+				status TEXT NOT NULL,
+				reference TEXT NOT NULL DEFAULT '',
+				created_at TEXT NOT NULL,
+				expires_at TEXT NOT NULL,
+				updated_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX holds_organization_id ON holds (organization_id, created_at)`,
+			`CREATE INDEX holds_expiry ON holds (status, expires_at)`,
+		},
+	},
+	{
+		// Referrals of clients between organizations
+		version: 17,
+		statements: []string{
+			`CREATE TABLE referrals (
+				id TEXT PRIMARY KEY,
+				from_organization_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				to_organization_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				service_id TEXT NOT NULL REFERENCES services(id),
+				status TEXT NOT NULL,
+				notes TEXT NOT NULL DEFAULT '',
+				response_notes TEXT NOT NULL DEFAULT '',
+				created_at TEXT NOT NULL,
+				updated_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX referrals_from ON referrals (from_organization_id, created_at)`,
+			`CREATE INDEX referrals_to ON referrals (to_organization_id, created_at)`,
+		},
+	},
+	{
+		// Monthly request counters per key owner, which monthly caps are
+		// enforced against, seeded from the per-key counters
+		version: 18,
+		statements: []string{
+			`CREATE TABLE api_owner_usage (
+				owner_id TEXT NOT NULL,
+				month TEXT NOT NULL,
+				used INTEGER NOT NULL,
+				PRIMARY KEY (owner_id, month)
+			)`,
+			`INSERT INTO api_owner_usage (owner_id, month, used)
+				SELECT k.owner_id, substr(u.day, 1, 7), SUM(u.count)
+				FROM api_key_usage u
+				JOIN api_keys k ON k.id = u.key_id
+				GROUP BY k.owner_id, substr(u.day, 1, 7)`,
+		},
+	},
+	{
+		// Organizations sort by name ignoring case
+		version: 19,
+		statements: []string{
+			`DROP INDEX organizations_name`,
+			`CREATE INDEX organizations_name ON organizations (name COLLATE NOCASE, id)`,
+		},
+	},
+	{
+		// API keys of organization staff are bound to their organization
+		version: 20,
+		statements: []string{
+			`ALTER TABLE api_keys ADD COLUMN organization_id TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// Holds remember the key that placed them, which may look them up
+		// and release them
+		version: 21,
+		statements: []string{
+			`ALTER TABLE holds ADD COLUMN placed_by TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// Migrate brings the schema up to the latest version, applying every
+// migration that has not been recorded in schema_migrations yet.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %v", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 for an
+// empty database.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", m.version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMigrateIsIdempotent tests that re-running migrations on a migrated database is a no-op
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	version, err := SchemaVersion(db)
+	require.NoError(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].version, version)
+
+	assert.NoError(t, Migrate(db))
+
+	var applied int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied))
+	assert.Equal(t, len(migrations), applied)
+}
+
+// TestOpenPersistsData tests that data written through Open survives reopening the file
+func TestOpenPersistsData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khair.db")
+
+	db, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, InsertPredefinedServices(db, []core.Service{{ID: "1", Name: "Bed"}}))
+	require.NoError(t, CreateOrganization(db, core.Organization{ID: "org1", Name: "Org One"}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Seeding again on restart must not fail on the existing rows
+	assert.NoError(t, InsertPredefinedServices(db, []core.Service{{ID: "1", Name: "Bed"}}))
+
+	org, err := GetOrganizationByID(db, "org1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Org One", org.Name)
+}
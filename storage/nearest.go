@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+const (
+	earthRadiusKm = 6371
+	// initialSearchRadiusKm is the first radius tried by NearestOrganizations
+	// before widening the search.
+	initialSearchRadiusKm = 5
+	// MaxOpenSearchRadiusKm is as far as a search filtered by opening hours
+	// reaches, since it reads the hours of every candidate on the way.
+	MaxOpenSearchRadiusKm = 1000
+)
+
+// haversine returns the great-circle distance in kilometers between two coordinates.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1Rad, lon1Rad := lat1*math.Pi/180, lon1*math.Pi/180
+	lat2Rad, lon2Rad := lat2*math.Pi/180, lon2*math.Pi/180
+
+	dlat := lat2Rad - lat1Rad
+	dlon := lon2Rad - lon1Rad
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1Rad)*math.Cos(lat2Rad)*
+			math.Sin(dlon/2)*math.Sin(dlon/2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+
+	return earthRadiusKm * c
+}
+
+// BoundingBox is the area between two latitudes and two longitudes, in
+// degrees. A box crossing the antimeridian has MinLongitude > MaxLongitude.
+type BoundingBox struct {
+	MinLatitude  float64 `json:"min_latitude"`
+	MaxLatitude  float64 `json:"max_latitude"`
+	MinLongitude float64 `json:"min_longitude"`
+	MaxLongitude float64 `json:"max_longitude"`
+}
+
+// crossesAntimeridian reports whether the box wraps around longitude ±180.
+func (b BoundingBox) crossesAntimeridian() bool {
+	return b.MinLongitude > b.MaxLongitude
+}
+
+func (b BoundingBox) Contains(loc core.Location) bool {
+	if loc.Latitude < b.MinLatitude || loc.Latitude > b.MaxLatitude {
+		return false
+	}
+	if b.crossesAntimeridian() {
+		return loc.Longitude >= b.MinLongitude || loc.Longitude <= b.MaxLongitude
+	}
+	return loc.Longitude >= b.MinLongitude && loc.Longitude <= b.MaxLongitude
+}
+
+// boundingBoxAround returns the smallest box containing every point within
+// radiusKm of (lat, lon). It returns false when that is the whole globe, so
+// the caller should not filter by location at all.
+func boundingBoxAround(lat, lon, radiusKm float64) (BoundingBox, bool) {
+	// Angular radius, see http://janmatuschek.de/LatitudeLongitudeBoundingCoordinates
+	angle := radiusKm / earthRadiusKm * 180 / math.Pi
+	if angle >= 180 {
+		return BoundingBox{}, false
+	}
+
+	box := BoundingBox{MinLatitude: lat - angle, MaxLatitude: lat + angle}
+	if box.MinLatitude <= -90 || box.MaxLatitude >= 90 {
+		// A pole is inside the circle, so every longitude is
+		box.MinLatitude = math.Max(box.MinLatitude, -90)
+		box.MaxLatitude = math.Min(box.MaxLatitude, 90)
+		box.MinLongitude, box.MaxLongitude = -180, 180
+		return box, true
+	}
+
+	ratio := math.Sin(radiusKm/earthRadiusKm) / math.Cos(lat*math.Pi/180)
+	if ratio >= 1 || radiusKm/earthRadiusKm >= math.Pi/2 {
+		box.MinLongitude, box.MaxLongitude = -180, 180
+		return box, true
+	}
+	deltaLon := math.Asin(ratio) * 180 / math.Pi
+	box.MinLongitude, box.MaxLongitude = lon-deltaLon, lon+deltaLon
+	if box.MinLongitude < -180 {
+		box.MinLongitude += 360
+	}
+	if box.MaxLongitude > 180 {
+		box.MaxLongitude -= 360
+	}
+	return box, true
+}
+
+// NearestPosition is a point in the order of NearestOrganizations results:
+// by distance, then ID.
+type NearestPosition struct {
+	DistanceKm float64
+	ID         string
+}
+
+// before reports whether p comes before other in result order.
+func (p NearestPosition) before(other NearestPosition) bool {
+	if p.DistanceKm != other.DistanceKm {
+		return p.DistanceKm < other.DistanceKm
+	}
+	return p.ID < other.ID
+}
+
+// NearestQuery selects the organizations closest to a location.
+type NearestQuery struct {
+	Latitude  float64
+	Longitude float64
+	Match     ServiceMatch
+	// Limit is the maximum number of results.
+	Limit int
+	// RadiusKm drops organizations further away; zero means no limit.
+	RadiusKm float64
+	// After skips the results up to and including this position, to page
+	// through the results.
+	After *NearestPosition
+	// OpenAt, when set, keeps the organizations open at that time for enough
+	// of the matched services. Such searches reach no further than
+	// MaxOpenSearchRadiusKm.
+	OpenAt *time.Time
+}
+
+// maxRadiusKm is the distance beyond which q drops organizations, or zero for
+// no limit.
+func (q NearestQuery) maxRadiusKm() float64 {
+	if q.OpenAt != nil && (q.RadiusKm <= 0 || q.RadiusKm > MaxOpenSearchRadiusKm) {
+		return MaxOpenSearchRadiusKm
+	}
+	return q.RadiusKm
+}
+
+// NearbyOrganization is a result of NearestOrganizations.
+type NearbyOrganization struct {
+	OrganizationMatch
+	DistanceKm float64
+}
+
+func (n NearbyOrganization) position() NearestPosition {
+	return NearestPosition{DistanceKm: n.DistanceKm, ID: n.Organization.ID}
+}
+
+// rankNearby computes the distance of each match from the query location,
+// drops those beyond withinKm or before q.After and returns the rest closest
+// first, at most q.Limit of them.
+func rankNearby(matches []OrganizationMatch, q NearestQuery, withinKm float64) []NearbyOrganization {
+	var nearby []NearbyOrganization
+	for _, m := range matches {
+		n := NearbyOrganization{
+			OrganizationMatch: m,
+			DistanceKm:        haversine(q.Latitude, q.Longitude, m.Organization.Location.Latitude, m.Organization.Location.Longitude),
+		}
+		if withinKm > 0 && n.DistanceKm > withinKm {
+			continue
+		}
+		if q.After != nil && !q.After.before(n.position()) {
+			continue
+		}
+		nearby = append(nearby, n)
+	}
+	sort.Slice(nearby, func(i, j int) bool { return nearby[i].position().before(nearby[j].position()) })
+
+	if len(nearby) > q.Limit {
+		nearby = nearby[:q.Limit]
+	}
+	return nearby
+}
+
+// matchQuery builds the query behind MatchOrganizationsByServices, limited to
+// the organizations inside box when it is not nil.
+func matchQuery(match ServiceMatch, box *BoundingBox) (string, []interface{}) {
+	// Create placeholders for the IN clause
+	placeholders := make([]string, len(match.ServiceIDs))
+	args := make([]interface{}, len(match.ServiceIDs))
+	for i, id := range match.ServiceIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	// requested maps every matching service to the requested ID it satisfies
+	requested := fmt.Sprintf("SELECT id, id FROM services WHERE id IN (%s)", strings.Join(placeholders, ","))
+	if match.IncludeDescendants {
+		requested += " UNION SELECT r.root, s.id FROM services s JOIN requested r ON s.parent_id = r.id"
+	}
+
+	from := "organizations o JOIN organization_services os ON o.id = os.organization_id JOIN requested r ON r.id = os.service_id"
+	where := "o.archived_at IS NULL"
+	if match.Available {
+		where += " AND os.capacity_available > 0"
+		if !match.UpdatedSince.IsZero() {
+			where += " AND os.capacity_updated_at >= ?"
+			args = append(args, match.UpdatedSince.UTC().Format(createdAtLayout))
+		}
+	}
+	if box != nil {
+		// CROSS JOIN keeps this join order, so the query starts from the few
+		// index entries in the box rather than every offering organization
+		boxWhere, boxArgs := boxCondition(*box)
+		from = `organizations_rtree g
+			CROSS JOIN organization_geo m ON m.geo_id = g.id
+			CROSS JOIN organizations o ON o.id = m.organization_id
+			CROSS JOIN organization_services os ON o.id = os.organization_id
+			CROSS JOIN requested r ON r.id = os.service_id`
+		where += " AND " + boxWhere
+		args = append(args, boxArgs...)
+	}
+
+	// Query to find organizations that offer enough of the specified services
+	query := fmt.Sprintf(`
+		WITH RECURSIVE requested(root, id) AS (%s)
+		SELECT o.id, o.name, o.description, o.phone, o.latitude, o.longitude, json_group_array(DISTINCT r.root)
+		FROM %s
+		WHERE %s
+		GROUP BY o.id
+		HAVING COUNT(DISTINCT r.root) >= ?
+		ORDER BY o.id
+	`, requested, from, where)
+
+	// Add the number of services to cover to the arguments list
+	args = append(args, match.minMatches())
+	return query, args
+}
+
+// boxCondition restricts organizations_rtree g to box. The R*Tree stores
+// coordinates as 32-bit floats rounded outwards, so the condition tests for
+// overlap rather than containment to never miss a point on the edge.
+func boxCondition(box BoundingBox) (string, []interface{}) {
+	where := "g.max_lat >= ? AND g.min_lat <= ?"
+	args := []interface{}{box.MinLatitude, box.MaxLatitude}
+	if box.crossesAntimeridian() {
+		where += " AND (g.max_lon >= ? OR g.min_lon <= ?)"
+	} else {
+		where += " AND g.max_lon >= ? AND g.min_lon <= ?"
+	}
+	args = append(args, box.MinLongitude, box.MaxLongitude)
+	return where, args
+}
+
+// NearestOrganizations returns the organizations closest to q's location
+// that match q.Match. It searches the R*Tree index in growing bounding boxes
+// until the box holds enough results, so only nearby rows are read.
+func NearestOrganizations(db *sql.DB, q NearestQuery) ([]NearbyOrganization, error) {
+	if q.Limit <= 0 {
+		return nil, nil
+	}
+
+	radius := float64(initialSearchRadiusKm)
+	if q.After != nil && q.After.DistanceKm > radius {
+		radius = q.After.DistanceKm
+	}
+	maxRadius := q.maxRadiusKm()
+	// hours caches the opening hours of the candidates of earlier passes
+	hours := make(map[string]map[string]core.OpeningHours)
+	for {
+		if maxRadius > 0 && radius > maxRadius {
+			radius = maxRadius
+		}
+
+		box, ok := boundingBoxAround(q.Latitude, q.Longitude, radius)
+		var query string
+		var args []interface{}
+		if ok {
+			query, args = matchQuery(q.Match, &box)
+		} else {
+			query, args = matchQuery(q.Match, nil)
+		}
+		matches, err := scanOrganizationMatches(db, q.Match, query, args)
+		if err != nil {
+			return nil, err
+		}
+		if q.OpenAt != nil {
+			var missing []string
+			for _, m := range matches {
+				if _, ok := hours[m.Organization.ID]; !ok {
+					missing = append(missing, m.Organization.ID)
+				}
+			}
+			if err := getOpeningHoursOf(db, missing, hours); err != nil {
+				return nil, err
+			}
+			matches = filterOpen(matches, q.Match, *q.OpenAt, hours)
+		}
+
+		// Every organization within radius is in the box, so these are exact
+		nearby := rankNearby(matches, q, radius)
+		if len(nearby) >= q.Limit || !ok || maxRadius > 0 && radius >= maxRadius {
+			return nearby, nil
+		}
+		radius *= 4
+	}
+}
+
+// GetOrganizationsInBox returns the unarchived organizations located inside
+// box, ordered by ID, using the R*Tree index.
+func GetOrganizationsInBox(db *sql.DB, box BoundingBox) ([]core.Organization, error) {
+	where, args := boxCondition(box)
+	rows, err := db.Query(`
+		SELECT o.id, o.name, o.description, o.phone, o.latitude, o.longitude
+		FROM organizations_rtree g
+		JOIN organization_geo m ON m.geo_id = g.id
+		JOIN organizations o ON o.id = m.organization_id
+		WHERE o.archived_at IS NULL AND `+where+`
+		ORDER BY o.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var organizations []core.Organization
+	for rows.Next() {
+		var org core.Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.Description, &org.Phone, &org.Location.Latitude, &org.Location.Longitude); err != nil {
+			return nil, err
+		}
+		// The index is only as precise as a 32-bit float
+		if box.Contains(org.Location) {
+			organizations = append(organizations, org)
+		}
+	}
+	return organizations, rows.Err()
+}
+
+func (s *SQLStore) NearestOrganizations(q NearestQuery) ([]NearbyOrganization, error) {
+	return NearestOrganizations(s.db, q)
+}
+
+func (s *SQLStore) GetOrganizationsInBox(box BoundingBox) ([]core.Organization, error) {
+	return GetOrganizationsInBox(s.db, box)
+}
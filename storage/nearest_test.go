@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seedRandomOrganizations creates n organizations spread over the globe, each
+// offering service 1 and every third one service 2 too.
+func seedRandomOrganizations(tb testing.TB, s Store, n int) {
+	require.NoError(tb, s.InsertPredefinedServices([]core.Service{
+		{ID: "1", Name: "Bed"},
+		{ID: "2", Name: "Food"},
+	}))
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("org%05d", i)
+		require.NoError(tb, s.CreateOrganization(core.Organization{
+			ID:       id,
+			Location: core.Location{Latitude: rng.Float64()*180 - 90, Longitude: rng.Float64()*360 - 180},
+		}))
+		services := []string{"1"}
+		if i%3 == 0 {
+			services = append(services, "2")
+		}
+		require.NoError(tb, s.AddServicesToOrganization(id, services))
+	}
+}
+
+// scanNearest is the nearest search without an index: compute the distance
+// to every matching organization.
+func scanNearest(s Store, q NearestQuery) ([]NearbyOrganization, error) {
+	matches, err := s.MatchOrganizationsByServices(q.Match)
+	if err != nil {
+		return nil, err
+	}
+	return rankNearby(matches, q, q.RadiusKm), nil
+}
+
+func nearbyIDs(nearby []NearbyOrganization) []string {
+	ids := []string{}
+	for _, n := range nearby {
+		ids = append(ids, n.Organization.ID)
+	}
+	return ids
+}
+
+func TestNearestOrganizationsMatchesScan(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedRandomOrganizations(t, s, 500)
+
+		queries := []NearestQuery{
+			{Latitude: 40.7, Longitude: -74.0, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 5},
+			{Latitude: 40.7, Longitude: -74.0, Match: ServiceMatch{ServiceIDs: []string{"1", "2"}}, Limit: 20},
+			{Latitude: 89.9, Longitude: 10, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 3},
+			{Latitude: 0, Longitude: 179.9, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 10},
+			{Latitude: -33.9, Longitude: 151.2, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 50, RadiusKm: 2000},
+			{Latitude: 10, Longitude: 10, Match: ServiceMatch{ServiceIDs: []string{"2"}}, Limit: 1000},
+		}
+		for _, q := range queries {
+			want, err := scanNearest(s, q)
+			require.NoError(t, err)
+			got, err := s.NearestOrganizations(q)
+			require.NoError(t, err)
+			assert.Equal(t, nearbyIDs(want), nearbyIDs(got), "query %+v", q)
+		}
+
+		// Paging with After continues where the previous page stopped
+		q := NearestQuery{Latitude: 51.5, Longitude: -0.1, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 30}
+		all, err := s.NearestOrganizations(q)
+		require.NoError(t, err)
+		q.Limit = 10
+		q.After = &NearestPosition{DistanceKm: all[9].DistanceKm, ID: all[9].Organization.ID}
+		next, err := s.NearestOrganizations(q)
+		require.NoError(t, err)
+		assert.Equal(t, nearbyIDs(all[10:20]), nearbyIDs(next))
+	})
+}
+
+func TestNearestOrganizationsFollowsWrites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		q := NearestQuery{Latitude: 0, Longitude: 0, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 1}
+
+		nearby, err := s.NearestOrganizations(q)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"org1"}, nearbyIDs(nearby))
+
+		require.NoError(t, s.UpdateOrganization(core.Organization{ID: "org2", Name: "Org Two", Location: core.Location{Latitude: 0.1, Longitude: 0.1}}))
+		nearby, err = s.NearestOrganizations(q)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"org2"}, nearbyIDs(nearby))
+
+		require.NoError(t, s.ArchiveOrganization("org2"))
+		nearby, err = s.NearestOrganizations(q)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"org1"}, nearbyIDs(nearby))
+
+		require.NoError(t, s.DeleteOrganizationByID("org1"))
+		nearby, err = s.NearestOrganizations(q)
+		require.NoError(t, err)
+		assert.Empty(t, nearby)
+	})
+}
+
+func TestGetOrganizationsInBox(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedRandomOrganizations(t, s, 300)
+
+		boxes := []BoundingBox{
+			{MinLatitude: 20, MaxLatitude: 50, MinLongitude: -130, MaxLongitude: -60},
+			// Across the antimeridian
+			{MinLatitude: -40, MaxLatitude: 40, MinLongitude: 150, MaxLongitude: -150},
+		}
+		for _, box := range boxes {
+			var want []string
+			for cursor := ""; ; {
+				page, err := s.ListOrganizations(ListOrganizationsOptions{Limit: MaxListLimit, Cursor: cursor})
+				require.NoError(t, err)
+				for _, org := range page.Organizations {
+					if box.Contains(org.Location) {
+						want = append(want, org.ID)
+					}
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+			sort.Strings(want)
+			require.NotEmpty(t, want)
+
+			orgs, err := s.GetOrganizationsInBox(box)
+			require.NoError(t, err)
+			var got []string
+			for _, org := range orgs {
+				got = append(got, org.ID)
+			}
+			assert.Equal(t, want, got, "box %+v", box)
+		}
+	})
+}
+
+func TestBoundingBoxAround(t *testing.T) {
+	box, ok := boundingBoxAround(0, 179, 500)
+	require.True(t, ok)
+	assert.True(t, box.crossesAntimeridian())
+	assert.True(t, box.Contains(core.Location{Latitude: 0, Longitude: -179}))
+	assert.False(t, box.Contains(core.Location{Latitude: 0, Longitude: 170}))
+
+	box, ok = boundingBoxAround(89, 0, 500)
+	require.True(t, ok)
+	assert.Equal(t, 90.0, box.MaxLatitude)
+	assert.True(t, box.Contains(core.Location{Latitude: 89, Longitude: 180}))
+
+	_, ok = boundingBoxAround(0, 0, 25000)
+	assert.False(t, ok)
+}
+
+// benchmarkDB returns an in-memory database with n random organizations.
+func benchmarkDB(b *testing.B, n int) *sql.DB {
+	db, err := SetupInMemoryDatabase()
+	require.NoError(b, err)
+	b.Cleanup(func() { db.Close() })
+	seedRandomOrganizations(b, NewSQLStore(db), n)
+	return db
+}
+
+// BenchmarkNearest compares the R*Tree search with scanning every matching
+// organization, as the nearest handler used to.
+func BenchmarkNearest(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		db := benchmarkDB(b, n)
+		s := NewSQLStore(db)
+		q := NearestQuery{Latitude: 40.7, Longitude: -74.0, Match: ServiceMatch{ServiceIDs: []string{"1"}}, Limit: 10}
+
+		b.Run(fmt.Sprintf("rtree/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.NearestOrganizations(q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := scanNearest(s, q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+var (
+	// ErrInvalidReferral is returned for a referral to the organization
+	// making it, to one not offering the service, or to an unknown status.
+	ErrInvalidReferral = errors.New("invalid referral")
+	// ErrReferralTransition is returned when a side of a referral makes a
+	// change its status does not allow.
+	ErrReferralTransition = errors.New("referral change not allowed")
+)
+
+// Directions of ReferralFilter.
+const (
+	ReferralsSent     = "sent"
+	ReferralsReceived = "received"
+)
+
+// ReferralFilter selects the referrals of an organization.
+type ReferralFilter struct {
+	OrganizationID string
+	// Direction is ReferralsSent, ReferralsReceived or empty for both.
+	Direction string
+	// Status keeps only the referrals with this status when not empty.
+	Status core.ReferralStatus
+}
+
+// ReferralUpdate is a change made by one side of a referral. Nil fields are
+// left unchanged. The receiving organization accepts or declines a pending
+// referral and writes the response notes. Either side marks an accepted
+// referral completed. The referring organization may edit its notes while
+// the referral is pending, and cancels it while pending or accepted.
+type ReferralUpdate struct {
+	Status *core.ReferralStatus
+	Notes  *string
+}
+
+// newReferral fills in the ID, status and timestamps of a referral being made.
+func newReferral(r core.Referral) (core.Referral, error) {
+	if r.FromOrganizationID == r.ToOrganizationID {
+		return core.Referral{}, fmt.Errorf("%w: an organization cannot refer to itself", ErrInvalidReferral)
+	}
+	id, err := newID("ref_")
+	if err != nil {
+		return core.Referral{}, err
+	}
+	r.ID = id
+	r.Status = core.ReferralPending
+	r.ResponseNotes = ""
+	r.CreatedAt = time.Now().UTC()
+	r.UpdatedAt = r.CreatedAt
+	return r, nil
+}
+
+// applyReferralUpdate applies the change orgID, a side of r, makes to it.
+func applyReferralUpdate(r core.Referral, orgID string, u ReferralUpdate, now time.Time) (core.Referral, error) {
+	receiving := orgID == r.ToOrganizationID
+
+	if u.Status != nil && *u.Status != r.Status {
+		allowed := false
+		switch *u.Status {
+		case core.ReferralAccepted, core.ReferralDeclined:
+			allowed = receiving && r.Status == core.ReferralPending
+		case core.ReferralCompleted:
+			allowed = r.Status == core.ReferralAccepted
+		case core.ReferralCancelled:
+			allowed = !receiving && (r.Status == core.ReferralPending || r.Status == core.ReferralAccepted)
+		case core.ReferralPending:
+		default:
+			return core.Referral{}, fmt.Errorf("%w: status must be pending, accepted, declined, completed or cancelled", ErrInvalidReferral)
+		}
+		if !allowed {
+			return core.Referral{}, fmt.Errorf("%w: %s cannot become %s", ErrReferralTransition, r.Status, *u.Status)
+		}
+		r.Status = *u.Status
+	}
+
+	if u.Notes != nil {
+		switch {
+		case receiving:
+			r.ResponseNotes = *u.Notes
+		case r.Status == core.ReferralPending:
+			r.Notes = *u.Notes
+		default:
+			return core.Referral{}, fmt.Errorf("%w: notes can only be edited while the referral is pending", ErrReferralTransition)
+		}
+	}
+
+	r.UpdatedAt = now.UTC()
+	return r, nil
+}
+
+const referralColumns = "id, from_organization_id, to_organization_id, service_id, status, notes, response_notes, created_at, updated_at"
+
+func scanReferral(row rowScanner) (core.Referral, error) {
+	var r core.Referral
+	var createdAt, updatedAt string
+	err := row.Scan(&r.ID, &r.FromOrganizationID, &r.ToOrganizationID, &r.ServiceID, &r.Status, &r.Notes, &r.ResponseNotes, &createdAt, &updatedAt)
+	if err != nil {
+		return core.Referral{}, err
+	}
+	if r.CreatedAt, err = time.Parse(createdAtLayout, createdAt); err != nil {
+		return core.Referral{}, err
+	}
+	if r.UpdatedAt, err = time.Parse(createdAtLayout, updatedAt); err != nil {
+		return core.Referral{}, err
+	}
+	return r, nil
+}
+
+// CreateReferral records a pending referral. It returns sql.ErrNoRows if
+// the referring organization does not exist or is archived, and
+// ErrInvalidReferral unless the receiving one is another unarchived
+// organization offering the service.
+func CreateReferral(db *sql.DB, r core.Referral) (core.Referral, error) {
+	r, err := newReferral(r)
+	if err != nil {
+		return core.Referral{}, err
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM organizations WHERE id = ? AND archived_at IS NULL)", r.FromOrganizationID).Scan(&exists); err != nil {
+		return core.Referral{}, err
+	}
+	if !exists {
+		return core.Referral{}, sql.ErrNoRows
+	}
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM organization_services os
+			JOIN organizations o ON o.id = os.organization_id
+			WHERE os.organization_id = ? AND os.service_id = ? AND o.archived_at IS NULL
+		)
+	`, r.ToOrganizationID, r.ServiceID).Scan(&exists)
+	if err != nil {
+		return core.Referral{}, err
+	}
+	if !exists {
+		return core.Referral{}, fmt.Errorf("%w: the receiving organization does not offer the service", ErrInvalidReferral)
+	}
+
+	_, err = db.Exec("INSERT INTO referrals ("+referralColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.ID, r.FromOrganizationID, r.ToOrganizationID, r.ServiceID, r.Status, r.Notes, r.ResponseNotes,
+		r.CreatedAt.Format(createdAtLayout), r.UpdatedAt.Format(createdAtLayout))
+	if err != nil {
+		return core.Referral{}, err
+	}
+	return r, nil
+}
+
+func GetReferral(db *sql.DB, referralID string) (core.Referral, error) {
+	return scanReferral(db.QueryRow("SELECT "+referralColumns+" FROM referrals WHERE id = ?", referralID))
+}
+
+// ListReferrals returns the referrals matching filter, newest first.
+func ListReferrals(db *sql.DB, filter ReferralFilter) ([]core.Referral, error) {
+	var where string
+	var args []interface{}
+	switch filter.Direction {
+	case ReferralsSent:
+		where, args = "from_organization_id = ?", []interface{}{filter.OrganizationID}
+	case ReferralsReceived:
+		where, args = "to_organization_id = ?", []interface{}{filter.OrganizationID}
+	default:
+		where, args = "(from_organization_id = ? OR to_organization_id = ?)", []interface{}{filter.OrganizationID, filter.OrganizationID}
+	}
+	if filter.Status != "" {
+		where += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+
+	rows, err := db.Query("SELECT "+referralColumns+" FROM referrals WHERE "+where+" ORDER BY created_at DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrals := []core.Referral{}
+	for rows.Next() {
+		r, err := scanReferral(rows)
+		if err != nil {
+			return nil, err
+		}
+		referrals = append(referrals, r)
+	}
+	return referrals, rows.Err()
+}
+
+// UpdateReferral applies the change orgID makes to a referral it is a side
+// of. It returns sql.ErrNoRows if there is no such referral.
+func UpdateReferral(db *sql.DB, orgID, referralID string, u ReferralUpdate) (core.Referral, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return core.Referral{}, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanReferral(tx.QueryRow("SELECT "+referralColumns+" FROM referrals WHERE id = ?", referralID))
+	if err != nil {
+		return core.Referral{}, err
+	}
+	if orgID != r.FromOrganizationID && orgID != r.ToOrganizationID {
+		return core.Referral{}, sql.ErrNoRows
+	}
+	r, err = applyReferralUpdate(r, orgID, u, time.Now())
+	if err != nil {
+		return core.Referral{}, err
+	}
+
+	_, err = tx.Exec("UPDATE referrals SET status = ?, notes = ?, response_notes = ?, updated_at = ? WHERE id = ?",
+		r.Status, r.Notes, r.ResponseNotes, r.UpdatedAt.Format(createdAtLayout), r.ID)
+	if err != nil {
+		return core.Referral{}, err
+	}
+	return r, tx.Commit()
+}
+
+func (s *SQLStore) CreateReferral(r core.Referral) (core.Referral, error) {
+	r, err := CreateReferral(s.db, r)
+	return r, notFound(err)
+}
+
+func (s *SQLStore) GetReferral(referralID string) (core.Referral, error) {
+	r, err := GetReferral(s.db, referralID)
+	return r, notFound(err)
+}
+
+func (s *SQLStore) ListReferrals(filter ReferralFilter) ([]core.Referral, error) {
+	return ListReferrals(s.db, filter)
+}
+
+func (s *SQLStore) UpdateReferral(orgID, referralID string, u ReferralUpdate) (core.Referral, error) {
+	r, err := UpdateReferral(s.db, orgID, referralID, u)
+	return r, notFound(err)
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreReferrals(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		status := func(st core.ReferralStatus) ReferralUpdate { return ReferralUpdate{Status: &st} }
+		notes := func(n string) ReferralUpdate { return ReferralUpdate{Notes: &n} }
+
+		_, err := s.CreateReferral(core.Referral{FromOrganizationID: "org1", ToOrganizationID: "org1", ServiceID: "1"})
+		assert.ErrorIs(t, err, ErrInvalidReferral)
+		_, err = s.CreateReferral(core.Referral{FromOrganizationID: "org1", ToOrganizationID: "org2", ServiceID: "2"})
+		assert.ErrorIs(t, err, ErrInvalidReferral, "org2 does not offer food")
+		_, err = s.CreateReferral(core.Referral{FromOrganizationID: "missing", ToOrganizationID: "org2", ServiceID: "1"})
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		r, err := s.CreateReferral(core.Referral{FromOrganizationID: "org1", ToOrganizationID: "org2", ServiceID: "1", Notes: "needs a bed tonight"})
+		require.NoError(t, err)
+		assert.Equal(t, core.ReferralPending, r.Status)
+		back, err := s.CreateReferral(core.Referral{FromOrganizationID: "org2", ToOrganizationID: "org1", ServiceID: "2"})
+		require.NoError(t, err)
+
+		got, err := s.GetReferral(r.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "needs a bed tonight", got.Notes)
+		assert.True(t, r.CreatedAt.Equal(got.CreatedAt))
+
+		// Only the receiving side accepts, and a stranger sees nothing
+		_, err = s.UpdateReferral("org1", r.ID, status(core.ReferralAccepted))
+		assert.ErrorIs(t, err, ErrReferralTransition)
+		_, err = s.UpdateReferral("org3", r.ID, status(core.ReferralAccepted))
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = s.UpdateReferral("org2", r.ID, status("lost"))
+		assert.ErrorIs(t, err, ErrInvalidReferral)
+		_, err = s.UpdateReferral("org2", r.ID, status(core.ReferralCompleted))
+		assert.ErrorIs(t, err, ErrReferralTransition, "pending cannot be completed")
+
+		r, err = s.UpdateReferral("org1", r.ID, notes("needs a bed tonight, has a dog"))
+		require.NoError(t, err)
+		assert.Equal(t, "needs a bed tonight, has a dog", r.Notes)
+
+		accepted, response := core.ReferralAccepted, "bed 4 kept"
+		r, err = s.UpdateReferral("org2", r.ID, ReferralUpdate{Status: &accepted, Notes: &response})
+		require.NoError(t, err)
+		assert.Equal(t, core.ReferralAccepted, r.Status)
+		assert.Equal(t, "bed 4 kept", r.ResponseNotes)
+		_, err = s.UpdateReferral("org1", r.ID, notes("too late"))
+		assert.ErrorIs(t, err, ErrReferralTransition)
+
+		r, err = s.UpdateReferral("org1", r.ID, status(core.ReferralCompleted))
+		require.NoError(t, err)
+		assert.Equal(t, core.ReferralCompleted, r.Status)
+		_, err = s.UpdateReferral("org2", r.ID, status(core.ReferralDeclined))
+		assert.ErrorIs(t, err, ErrReferralTransition)
+
+		_, err = s.UpdateReferral("org1", back.ID, status(core.ReferralDeclined))
+		require.NoError(t, err)
+
+		ids := func(filter ReferralFilter) []string {
+			referrals, err := s.ListReferrals(filter)
+			require.NoError(t, err)
+			ids := []string{}
+			for _, r := range referrals {
+				ids = append(ids, r.ID)
+			}
+			return ids
+		}
+		assert.Equal(t, []string{back.ID, r.ID}, ids(ReferralFilter{OrganizationID: "org1"}))
+		assert.Equal(t, []string{r.ID}, ids(ReferralFilter{OrganizationID: "org1", Direction: ReferralsSent}))
+		assert.Equal(t, []string{back.ID}, ids(ReferralFilter{OrganizationID: "org1", Direction: ReferralsReceived}))
+		assert.Equal(t, []string{back.ID}, ids(ReferralFilter{OrganizationID: "org2", Status: core.ReferralDeclined}))
+		assert.Empty(t, ids(ReferralFilter{OrganizationID: "org3"}))
+
+		// Referred services stay in the catalog, and deleting an organization
+		// deletes its referrals
+		require.NoError(t, s.RemoveServiceFromOrganization("org1", "2"))
+		assert.ErrorIs(t, s.DeleteService("2"), ErrServiceInUse)
+		require.NoError(t, s.DeleteOrganizationByID("org2"))
+		assert.Empty(t, ids(ReferralFilter{OrganizationID: "org1"}))
+		_, err = s.GetReferral(r.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestStoreReferralCancellation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		status := func(st core.ReferralStatus) ReferralUpdate { return ReferralUpdate{Status: &st} }
+
+		r, err := s.CreateReferral(core.Referral{FromOrganizationID: "org1", ToOrganizationID: "org2", ServiceID: "1"})
+		require.NoError(t, err)
+
+		// Only the referring side takes a referral back
+		_, err = s.UpdateReferral("org2", r.ID, status(core.ReferralCancelled))
+		assert.ErrorIs(t, err, ErrReferralTransition)
+		r, err = s.UpdateReferral("org1", r.ID, status(core.ReferralCancelled))
+		require.NoError(t, err)
+		assert.Equal(t, core.ReferralCancelled, r.Status)
+		_, err = s.UpdateReferral("org2", r.ID, status(core.ReferralAccepted))
+		assert.ErrorIs(t, err, ErrReferralTransition)
+
+		// Accepted referrals can still be cancelled, completed ones not
+		accepted, err := s.CreateReferral(core.Referral{FromOrganizationID: "org1", ToOrganizationID: "org2", ServiceID: "1"})
+		require.NoError(t, err)
+		_, err = s.UpdateReferral("org2", accepted.ID, status(core.ReferralAccepted))
+		require.NoError(t, err)
+		_, err = s.UpdateReferral("org1", accepted.ID, status(core.ReferralCancelled))
+		require.NoError(t, err)
+
+		completed, err := s.CreateReferral(core.Referral{FromOrganizationID: "org1", ToOrganizationID: "org2", ServiceID: "1"})
+		require.NoError(t, err)
+		_, err = s.UpdateReferral("org2", completed.ID, status(core.ReferralAccepted))
+		require.NoError(t, err)
+		_, err = s.UpdateReferral("org2", completed.ID, status(core.ReferralCompleted))
+		require.NoError(t, err)
+		_, err = s.UpdateReferral("org1", completed.ID, status(core.ReferralCancelled))
+		assert.ErrorIs(t, err, ErrReferralTransition)
+
+		referrals, err := s.ListReferrals(ReferralFilter{OrganizationID: "org1", Status: core.ReferralCancelled})
+		require.NoError(t, err)
+		assert.Len(t, referrals, 2)
+	})
+}
@@ -2,45 +2,70 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/CTRL-Impact-Team4/khair-backend/core"
 	_ "github.com/mattn/go-sqlite3" // Import for SQLite3
 )
 
-func SetupInMemoryDatabase() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", ":memory:")
+// withForeignKeys adds the DSN parameter that makes SQLite enforce foreign
+// keys on every connection; it is off by default.
+func withForeignKeys(dsn string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=on"
+	}
+	return dsn + "?_foreign_keys=on"
+}
+
+// Open opens (creating if needed) the SQLite database file at path and
+// migrates it to the latest schema version.
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", withForeignKeys(path))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	// Execute table creation statements here
-	statements := []string{
-		`CREATE TABLE organizations (id TEXT PRIMARY KEY, name TEXT, phone TEXT, latitude REAL, longitude REAL)`,
-		`CREATE TABLE services (id TEXT PRIMARY KEY, name TEXT)`,
-		`CREATE TABLE organization_services (organization_id TEXT, service_id TEXT, PRIMARY KEY (organization_id, service_id), FOREIGN KEY (organization_id) REFERENCES organizations(id), FOREIGN KEY (service_id) REFERENCES services(id))`,
+	if err := Migrate(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	for _, stmt := range statements {
-		_, err := db.Exec(stmt)
-		if err != nil {
-			return nil, err
-		}
+	return db, nil
+}
+
+func SetupInMemoryDatabase() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", withForeignKeys(":memory:"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	// Every connection to ":memory:" gets its own empty database, so the
+	// pool must never open a second one.
+	db.SetMaxOpenConns(1)
+
+	if err := Migrate(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return db, nil
 }
 
+// InsertPredefinedServices seeds the service catalog. Services that already
+// exist are left untouched, so it is safe to call on every start.
 func InsertPredefinedServices(db *sql.DB, services []core.Service) error {
-	stmt, err := db.Prepare("INSERT INTO services (id, name) VALUES (?, ?)")
+	stmt, err := db.Prepare("INSERT OR IGNORE INTO services (id, name, parent_id) VALUES (?, ?, NULLIF(?, ''))")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
 	for _, service := range services {
-		_, err := stmt.Exec(service.ID, service.Name)
+		_, err := stmt.Exec(service.ID, service.Name, service.ParentID)
 		if err != nil {
 			return err
 		}
@@ -50,12 +75,52 @@ func InsertPredefinedServices(db *sql.DB, services []core.Service) error {
 }
 
 func CreateOrganization(db *sql.DB, org core.Organization) error {
-	_, err := db.Exec("INSERT INTO organizations (id, name, phone, latitude, longitude) VALUES (?, ?, ?, ?, ?)", org.ID, org.Name, org.Phone, org.Location.Latitude, org.Location.Longitude)
+	_, err := db.Exec("INSERT INTO organizations (id, name, description, phone, latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)", org.ID, org.Name, org.Description, org.Phone, org.Location.Latitude, org.Location.Longitude, time.Now().UTC().Format(createdAtLayout))
 	return err
 }
 
+// UpdateOrganization replaces the name, description, phone and location of an existing,
+// unarchived organization. Its service associations are left untouched.
+func UpdateOrganization(db *sql.DB, org core.Organization) error {
+	result, err := db.Exec("UPDATE organizations SET name = ?, description = ?, phone = ?, latitude = ?, longitude = ? WHERE id = ? AND archived_at IS NULL", org.Name, org.Description, org.Phone, org.Location.Latitude, org.Location.Longitude, org.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// expectOneRow returns sql.ErrNoRows if result did not affect any row.
+func expectOneRow(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// AddServicesToOrganization associates the services with the organization.
+// Services it already offers are skipped, so re-adding is not an error.
 func AddServicesToOrganization(db *sql.DB, orgID string, serviceIDs []string) error {
-	stmt, err := db.Prepare("INSERT INTO organization_services (organization_id, service_id) VALUES (?, ?)")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := addServices(tx, orgID, serviceIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func addServices(tx *sql.Tx, orgID string, serviceIDs []string) error {
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO organization_services (organization_id, service_id) VALUES (?, ?)")
 	if err != nil {
 		return err
 	}
@@ -71,80 +136,183 @@ func AddServicesToOrganization(db *sql.DB, orgID string, serviceIDs []string) er
 	return nil
 }
 
-func GetOrganizationsByServices(db *sql.DB, serviceIDs []string) ([]core.Organization, error) {
-	// Create placeholders for the IN clause
+// ReplaceOrganizationServices atomically makes serviceIDs the complete set of
+// services offered by the organization. Services it keeps offering keep their
+// capacity.
+func ReplaceOrganizationServices(db *sql.DB, orgID string, serviceIDs []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	placeholders := make([]string, len(serviceIDs))
-	args := make([]interface{}, len(serviceIDs))
+	args := []interface{}{orgID}
 	for i, id := range serviceIDs {
 		placeholders[i] = "?"
-		args[i] = id
+		args = append(args, id)
+	}
+	query := fmt.Sprintf("DELETE FROM organization_services WHERE organization_id = ? AND service_id NOT IN (%s)", strings.Join(placeholders, ","))
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	if err := addServices(tx, orgID, serviceIDs); err != nil {
+		return err
+	}
+	if err := deleteStaleServiceHours(tx, orgID); err != nil {
+		return err
 	}
 
-	// Query to find organizations that offer all specified services
-	query := fmt.Sprintf(`
-		SELECT o.id, o.name, o.phone, o.latitude, o.longitude
-		FROM organizations o
-		JOIN organization_services os ON o.id = os.organization_id
-		WHERE os.service_id IN (%s)
-		GROUP BY o.id, o.name, o.phone, o.latitude, o.longitude
-		HAVING COUNT(DISTINCT os.service_id) = ?
-	`, strings.Join(placeholders, ","))
+	return tx.Commit()
+}
 
-	// Add the count of service IDs to the arguments list
-	args = append(args, len(serviceIDs))
+// RemoveServiceFromOrganization deletes one association and the hours of the
+// service there. It returns sql.ErrNoRows if the organization does not offer
+// the service.
+func RemoveServiceFromOrganization(db *sql.DB, orgID, serviceID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	result, err := tx.Exec("DELETE FROM organization_services WHERE organization_id = ? AND service_id = ?", orgID, serviceID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+	if err := deleteStaleServiceHours(tx, orgID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetOrganizationsByServices returns the unarchived organizations offering
+// every one of serviceIDs. With includeDescendants, a requested category is
+// also satisfied by any service below it in the catalog tree.
+func GetOrganizationsByServices(db *sql.DB, serviceIDs []string, includeDescendants bool) ([]core.Organization, error) {
+	matches, err := MatchOrganizationsByServices(db, ServiceMatch{ServiceIDs: serviceIDs, IncludeDescendants: includeDescendants})
+	if err != nil {
+		return nil, err
+	}
+
+	var organizations []core.Organization
+	for _, m := range matches {
+		organizations = append(organizations, m.Organization)
+	}
+	return organizations, nil
+}
+
+// MatchOrganizationsByServices returns the unarchived organizations covering
+// at least match.MinMatches of the requested services, with the ones each
+// covers.
+func MatchOrganizationsByServices(db *sql.DB, match ServiceMatch) ([]OrganizationMatch, error) {
+	query, args := matchQuery(match, nil)
+	return scanOrganizationMatches(db, match, query, args)
+}
+
+// scanOrganizationMatches runs a query built by matchQuery.
+func scanOrganizationMatches(db *sql.DB, match ServiceMatch, query string, args []interface{}) ([]OrganizationMatch, error) {
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var organizations []core.Organization
+	var matches []OrganizationMatch
 	for rows.Next() {
-		var org core.Organization
-		if err := rows.Scan(&org.ID, &org.Name, &org.Phone, &org.Location.Latitude, &org.Location.Longitude); err != nil {
+		var m OrganizationMatch
+		var matched string
+		if err := rows.Scan(&m.Organization.ID, &m.Organization.Name, &m.Organization.Description, &m.Organization.Phone, &m.Organization.Location.Latitude, &m.Organization.Location.Longitude, &matched); err != nil {
+			return nil, err
+		}
+		var covered []string
+		if err := json.Unmarshal([]byte(matched), &covered); err != nil {
 			return nil, err
 		}
-		organizations = append(organizations, org)
+		m.MatchedServiceIDs = match.inRequestOrder(covered)
+		matches = append(matches, m)
 	}
 
-	return organizations, nil
+	return matches, rows.Err()
 }
 
 func GetOrganizationByID(db *sql.DB, orgID string) (core.Organization, error) {
 	var org core.Organization
 	err := db.QueryRow(`
-        SELECT id, name, phone, latitude, longitude
+        SELECT id, name, description, phone, latitude, longitude
         FROM organizations
-        WHERE id = ?
-    `, orgID).Scan(&org.ID, &org.Name, &org.Phone, &org.Location.Latitude, &org.Location.Longitude)
+        WHERE id = ? AND archived_at IS NULL
+    `, orgID).Scan(&org.ID, &org.Name, &org.Description, &org.Phone, &org.Location.Latitude, &org.Location.Longitude)
 	if err != nil {
 		return core.Organization{}, err
 	}
 	return org, nil
 }
 
+// DeleteOrganizationByID permanently deletes an organization, archived or
+// not, together with its service associations, translations and opening
+// hours.
 func DeleteOrganizationByID(db *sql.DB, orgID string) error {
-	result, err := db.Exec("DELETE FROM organizations WHERE id = ?", orgID)
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	// The foreign keys cascade too, but only on connections that enable them
+	if _, err := tx.Exec("DELETE FROM organization_services WHERE organization_id = ?", orgID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM organization_translations WHERE organization_id = ?", orgID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM opening_hours WHERE organization_id = ?", orgID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM holds WHERE organization_id = ?", orgID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM referrals WHERE from_organization_id = ? OR to_organization_id = ?", orgID, orgID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM organizations WHERE id = ?", orgID)
 	if err != nil {
 		return err
 	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
 
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	return tx.Commit()
+}
+
+// ArchiveOrganization soft-deletes an organization: it disappears from every
+// lookup but keeps its data until RestoreOrganization is called.
+func ArchiveOrganization(db *sql.DB, orgID string) error {
+	result, err := db.Exec("UPDATE organizations SET archived_at = ? WHERE id = ? AND archived_at IS NULL", time.Now().UTC().Format(createdAtLayout), orgID)
+	if err != nil {
+		return err
 	}
+	return expectOneRow(result)
+}
 
-	return nil
+// RestoreOrganization brings back an archived organization.
+func RestoreOrganization(db *sql.DB, orgID string) error {
+	result, err := db.Exec("UPDATE organizations SET archived_at = NULL WHERE id = ? AND archived_at IS NOT NULL", orgID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
 }
 
 func GetPredefinedServices(db *sql.DB) ([]core.Service, error) {
 	var services []core.Service
-	rows, err := db.Query("SELECT id, name FROM services")
+	rows, err := db.Query("SELECT id, name, deprecated, COALESCE(parent_id, '') FROM services ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -152,7 +320,7 @@ func GetPredefinedServices(db *sql.DB) ([]core.Service, error) {
 
 	for rows.Next() {
 		var svc core.Service
-		if err := rows.Scan(&svc.ID, &svc.Name); err != nil {
+		if err := rows.Scan(&svc.ID, &svc.Name, &svc.Deprecated, &svc.ParentID); err != nil {
 			return nil, err
 		}
 		services = append(services, svc)
@@ -161,12 +329,15 @@ func GetPredefinedServices(db *sql.DB) ([]core.Service, error) {
 	return services, nil
 }
 
+// GetServicesByOrganizationID returns the services offered by an organization
+// with their capacity there.
 func GetServicesByOrganizationID(db *sql.DB, orgID string) ([]core.Service, error) {
 	rows, err := db.Query(`
-		SELECT s.id, s.name
+		SELECT s.id, s.name, s.deprecated, COALESCE(s.parent_id, ''), `+capacityColumns+`
 		FROM services s
 		JOIN organization_services os ON s.id = os.service_id
 		WHERE os.organization_id = ?
+		ORDER BY s.id
 	`, orgID)
 	if err != nil {
 		return nil, err
@@ -176,12 +347,55 @@ func GetServicesByOrganizationID(db *sql.DB, orgID string) ([]core.Service, erro
 	var services []core.Service
 	for rows.Next() {
 		var svc core.Service
-		if err := rows.Scan(&svc.ID, &svc.Name); err != nil {
+		var c nullCapacity
+		if err := rows.Scan(&svc.ID, &svc.Name, &svc.Deprecated, &svc.ParentID, &c.total, &c.available, &c.updatedAt); err != nil {
+			return nil, err
+		}
+		if svc.Capacity, err = c.capacity(); err != nil {
 			return nil, err
 		}
 		services = append(services, svc)
 	}
-	return services, nil
+	return services, rows.Err()
+}
+
+// GetServicesByOrganizationIDs returns the services of the organizations in
+// orgIDs with their capacity, keyed by organization ID, in a single query.
+func GetServicesByOrganizationIDs(db *sql.DB, orgIDs []string) (map[string][]core.Service, error) {
+	services := make(map[string][]core.Service, len(orgIDs))
+	if len(orgIDs) == 0 {
+		return services, nil
+	}
+	ids, err := json.Marshal(orgIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT os.organization_id, s.id, s.name, s.deprecated, COALESCE(s.parent_id, ''), `+capacityColumns+`
+		FROM services s
+		JOIN organization_services os ON s.id = os.service_id
+		WHERE os.organization_id IN (SELECT value FROM json_each(?))
+		ORDER BY os.organization_id, s.id
+	`, string(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID string
+		var svc core.Service
+		var c nullCapacity
+		if err := rows.Scan(&orgID, &svc.ID, &svc.Name, &svc.Deprecated, &svc.ParentID, &c.total, &c.available, &c.updatedAt); err != nil {
+			return nil, err
+		}
+		if svc.Capacity, err = c.capacity(); err != nil {
+			return nil, err
+		}
+		services[orgID] = append(services[orgID], svc)
+	}
+	return services, rows.Err()
 }
 
 func GetServicesByID(db *sql.DB, serviceIDs []string) ([]core.Service, error) {
@@ -192,7 +406,7 @@ func GetServicesByID(db *sql.DB, serviceIDs []string) ([]core.Service, error) {
 		args[i] = id
 	}
 
-	query := fmt.Sprintf("SELECT id, name FROM services WHERE id IN (%s)", strings.Join(placeholders, ","))
+	query := fmt.Sprintf("SELECT id, name, deprecated, COALESCE(parent_id, '') FROM services WHERE id IN (%s) ORDER BY id", strings.Join(placeholders, ","))
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
@@ -202,16 +416,132 @@ func GetServicesByID(db *sql.DB, serviceIDs []string) ([]core.Service, error) {
 	var services []core.Service
 	for rows.Next() {
 		var svc core.Service
-		if err := rows.Scan(&svc.ID, &svc.Name); err != nil {
+		if err := rows.Scan(&svc.ID, &svc.Name, &svc.Deprecated, &svc.ParentID); err != nil {
 			return nil, err
 		}
 		services = append(services, svc)
 	}
 
 	// Check if all service IDs were found
-	if len(services) != len(serviceIDs) {
-		return nil, fmt.Errorf("one or more services do not exist")
+	if len(services) != countUnique(serviceIDs) {
+		return nil, ErrUnknownService
 	}
 
 	return services, nil
 }
+
+func countUnique(ids []string) int {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return len(seen)
+}
+
+// SQLStore implements Store on top of the SQLite schema managed by Migrate.
+type SQLStore struct {
+	db     *sql.DB
+	events *EventBus
+	// changeMu serializes the writes publishing events, see change
+	changeMu sync.Mutex
+}
+
+var _ Store = (*SQLStore)(nil)
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, events: NewEventBus()}
+}
+
+// notFound translates sql.ErrNoRows into ErrNotFound so callers do not need
+// to know about database/sql.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *SQLStore) CreateOrganization(org core.Organization) error {
+	return s.changeOrganization(EventOrganizationCreated, org.ID, func() error {
+		return CreateOrganization(s.db, org)
+	})
+}
+
+func (s *SQLStore) UpdateOrganization(org core.Organization) error {
+	return notFound(s.changeOrganization(EventOrganizationUpdated, org.ID, func() error {
+		return UpdateOrganization(s.db, org)
+	}))
+}
+
+func (s *SQLStore) GetOrganizationByID(orgID string) (core.Organization, error) {
+	org, err := GetOrganizationByID(s.db, orgID)
+	return org, notFound(err)
+}
+
+func (s *SQLStore) DeleteOrganizationByID(orgID string) error {
+	return s.deleteOrganization(orgID, DeleteOrganizationByID)
+}
+
+func (s *SQLStore) ArchiveOrganization(orgID string) error {
+	return s.deleteOrganization(orgID, ArchiveOrganization)
+}
+
+// deleteOrganization runs del, publishing the last state of the organization
+// when it was visible until then.
+func (s *SQLStore) deleteOrganization(orgID string, del func(db *sql.DB, orgID string) error) error {
+	return notFound(s.changeOrganization(EventOrganizationDeleted, orgID, func() error {
+		return del(s.db, orgID)
+	}))
+}
+
+func (s *SQLStore) RestoreOrganization(orgID string) error {
+	return notFound(s.changeOrganization(EventOrganizationCreated, orgID, func() error {
+		return RestoreOrganization(s.db, orgID)
+	}))
+}
+
+func (s *SQLStore) MatchOrganizationsByServices(match ServiceMatch) ([]OrganizationMatch, error) {
+	return MatchOrganizationsByServices(s.db, match)
+}
+
+func (s *SQLStore) GetOrganizationsByServices(serviceIDs []string, includeDescendants bool) ([]core.Organization, error) {
+	return GetOrganizationsByServices(s.db, serviceIDs, includeDescendants)
+}
+
+func (s *SQLStore) InsertPredefinedServices(services []core.Service) error {
+	return InsertPredefinedServices(s.db, services)
+}
+
+func (s *SQLStore) GetPredefinedServices() ([]core.Service, error) {
+	return GetPredefinedServices(s.db)
+}
+
+func (s *SQLStore) GetServicesByID(serviceIDs []string) ([]core.Service, error) {
+	return GetServicesByID(s.db, serviceIDs)
+}
+
+func (s *SQLStore) AddServicesToOrganization(orgID string, serviceIDs []string) error {
+	return s.changeOrganization(EventOrganizationUpdated, orgID, func() error {
+		return AddServicesToOrganization(s.db, orgID, serviceIDs)
+	})
+}
+
+func (s *SQLStore) ReplaceOrganizationServices(orgID string, serviceIDs []string) error {
+	return s.changeOrganization(EventOrganizationUpdated, orgID, func() error {
+		return ReplaceOrganizationServices(s.db, orgID, serviceIDs)
+	})
+}
+
+func (s *SQLStore) RemoveServiceFromOrganization(orgID, serviceID string) error {
+	return notFound(s.changeOrganization(EventOrganizationUpdated, orgID, func() error {
+		return RemoveServiceFromOrganization(s.db, orgID, serviceID)
+	}))
+}
+
+func (s *SQLStore) GetServicesByOrganizationID(orgID string) ([]core.Service, error) {
+	return GetServicesByOrganizationID(s.db, orgID)
+}
+
+func (s *SQLStore) GetServicesByOrganizationIDs(orgIDs []string) (map[string][]core.Service, error) {
+	return GetServicesByOrganizationIDs(s.db, orgIDs)
+}
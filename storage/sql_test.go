@@ -102,10 +102,34 @@ func TestGetOrganizationsByService(t *testing.T) {
 
 	expectedOrgs := []core.Organization{
 		{ID: "org1", Name: "Org One", Phone: "123", Location: core.Location{Latitude: 10.1, Longitude: -20.2}},
-		// {ID: "org2", Name: "Org Two", Phone: "456", Location: core.Location{Latitude: 20.1, Longitude: -30.2}},
+		{ID: "org2", Name: "Org Two", Phone: "456", Location: core.Location{Latitude: 20.1, Longitude: -30.2}},
 	}
-	orgs, err := GetOrganizationsByServices(db, []string{"1"})
+	orgs, err := GetOrganizationsByServices(db, []string{"1"}, false)
 	assert.NoError(t, err)
 
 	assert.Equal(t, expectedOrgs, orgs)
 }
+
+// TestGetOrganizationsByServicesRequiresAll checks that every organization
+// offering a service is returned, and only those offering all of several.
+func TestGetOrganizationsByServicesRequiresAll(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := InsertPredefinedServices(db, []core.Service{{ID: "1", Name: "Service1"}, {ID: "2", Name: "Service2"}})
+	assert.NoError(t, err)
+	orgOne := core.Organization{ID: "org1", Name: "Org One", Phone: "123", Location: core.Location{Latitude: 10.1, Longitude: -20.2}}
+	orgTwo := core.Organization{ID: "org2", Name: "Org Two", Phone: "456", Location: core.Location{Latitude: 20.1, Longitude: -30.2}}
+	assert.NoError(t, CreateOrganization(db, orgOne))
+	assert.NoError(t, CreateOrganization(db, orgTwo))
+	assert.NoError(t, AddServicesToOrganization(db, "org1", []string{"1", "2"}))
+	assert.NoError(t, AddServicesToOrganization(db, "org2", []string{"1"}))
+
+	orgs, err := GetOrganizationsByServices(db, []string{"1"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []core.Organization{orgOne, orgTwo}, orgs)
+
+	orgs, err = GetOrganizationsByServices(db, []string{"1", "2"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []core.Organization{orgOne}, orgs)
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+var (
+	// ErrNotFound is returned when the requested organization or service does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUnknownService is returned when a request references a service that is not in the catalog.
+	ErrUnknownService = errors.New("one or more services do not exist")
+	// ErrServiceExists is returned when creating a catalog service whose ID is taken.
+	ErrServiceExists = errors.New("service already exists")
+	// ErrServiceInUse is returned when deleting a service that organizations
+	// still offer or that holds or referrals refer to.
+	ErrServiceInUse = errors.New("service is in use by one or more organizations")
+	// ErrServiceHasChildren is returned when deleting a category that still has subcategories.
+	ErrServiceHasChildren = errors.New("service has subcategories")
+	// ErrServiceCycle is returned when a parent change would make a service its own ancestor.
+	ErrServiceCycle = errors.New("service cannot be its own ancestor")
+)
+
+// ServiceMatch selects organizations by the services they offer.
+type ServiceMatch struct {
+	ServiceIDs []string
+	// IncludeDescendants also satisfies a requested category with any
+	// service below it in the catalog tree.
+	IncludeDescendants bool
+	// MinMatches is how many of ServiceIDs an organization must cover; zero
+	// means all of them and 1 any of them.
+	MinMatches int
+	// Available only counts offerings with capacity available, updated at
+	// or after UpdatedSince unless it is zero. Offerings whose capacity is not
+	// tracked never count.
+	Available    bool
+	UpdatedSince time.Time
+}
+
+// minMatches returns the number of distinct requested services to cover.
+func (m ServiceMatch) minMatches() int {
+	if m.MinMatches <= 0 || m.MinMatches > countUnique(m.ServiceIDs) {
+		return countUnique(m.ServiceIDs)
+	}
+	return m.MinMatches
+}
+
+// inRequestOrder returns the covered service IDs in the order they were requested.
+func (m ServiceMatch) inRequestOrder(covered []string) []string {
+	isCovered := make(map[string]bool, len(covered))
+	for _, id := range covered {
+		isCovered[id] = true
+	}
+
+	ordered := []string{}
+	for _, id := range m.ServiceIDs {
+		if isCovered[id] {
+			ordered = append(ordered, id)
+			delete(isCovered, id)
+		}
+	}
+	return ordered
+}
+
+// OrganizationMatch is an organization found by MatchOrganizationsByServices.
+type OrganizationMatch struct {
+	Organization core.Organization
+	// MatchedServiceIDs are the requested services the organization covers.
+	MatchedServiceIDs []string
+}
+
+// Store is the persistence boundary used by the HTTP handlers. SQLStore is the
+// production implementation; MemoryStore is a map-backed fake for tests.
+type Store interface {
+	CreateOrganization(org core.Organization) error
+	GetOrganizationByID(orgID string) (core.Organization, error)
+	// UpdateOrganization replaces the fields of org.ID, keeping its services.
+	UpdateOrganization(org core.Organization) error
+	// DeleteOrganizationByID permanently deletes an organization and its service associations.
+	DeleteOrganizationByID(orgID string) error
+	// ArchiveOrganization hides an organization from every lookup until it is restored.
+	ArchiveOrganization(orgID string) error
+	RestoreOrganization(orgID string) error
+	// ListOrganizations returns a page of organizations with their services.
+	ListOrganizations(opts ListOrganizationsOptions) (OrganizationPage, error)
+	// GetOrganizationsByServices returns the organizations offering all of the
+	// given services. With includeDescendants, a category is also matched by
+	// any of its subcategories.
+	GetOrganizationsByServices(serviceIDs []string, includeDescendants bool) ([]core.Organization, error)
+	// MatchOrganizationsByServices returns the organizations covering enough
+	// of the requested services, ordered by ID.
+	MatchOrganizationsByServices(match ServiceMatch) ([]OrganizationMatch, error)
+	// NearestOrganizations returns the organizations matching q.Match closest
+	// to q's location, nearest first.
+	NearestOrganizations(q NearestQuery) ([]NearbyOrganization, error)
+	// GetOrganizationsInBox returns the organizations located inside box.
+	GetOrganizationsInBox(box BoundingBox) ([]core.Organization, error)
+
+	InsertPredefinedServices(services []core.Service) error
+	GetPredefinedServices() ([]core.Service, error)
+	// GetServicesByID returns ErrUnknownService unless every ID is in the catalog.
+	GetServicesByID(serviceIDs []string) ([]core.Service, error)
+	// CreateService adds a service to the catalog, or returns ErrServiceExists.
+	// Its parent, if any, must exist or ErrUnknownService is returned.
+	CreateService(svc core.Service) error
+	// UpdateService replaces the name, deprecated flag and parent of a
+	// catalog service, returning ErrServiceCycle for a parent below it.
+	UpdateService(svc core.Service) error
+	// DeleteService returns ErrServiceInUse while any organization, archived
+	// or not, offers the service or holds and referrals refer to it, and
+	// ErrServiceHasChildren while it has subcategories.
+	DeleteService(serviceID string) error
+
+	// AddServicesToOrganization associates services; already associated ones are skipped.
+	AddServicesToOrganization(orgID string, serviceIDs []string) error
+	// ReplaceOrganizationServices atomically replaces the whole set of services of an organization.
+	ReplaceOrganizationServices(orgID string, serviceIDs []string) error
+	// RemoveServiceFromOrganization returns ErrNotFound if the service was not associated.
+	RemoveServiceFromOrganization(orgID, serviceID string) error
+	// GetServicesByOrganizationID returns the services of an organization
+	// with their capacity there.
+	GetServicesByOrganizationID(orgID string) ([]core.Service, error)
+	// GetServicesByOrganizationIDs returns the services of several
+	// organizations with their capacity, keyed by organization ID.
+	GetServicesByOrganizationIDs(orgIDs []string) (map[string][]core.Service, error)
+	// UpdateCapacity applies u to the capacity of a service at an unarchived
+	// organization as of now, atomically. It returns ErrNotFound if the
+	// organization does not offer the service, and ErrInvalidCapacity unless
+	// 0 <= available <= total or when the first update has no total.
+	UpdateCapacity(orgID, serviceID string, u CapacityUpdate) (core.Capacity, error)
+
+	// PlaceHold takes one available unit of hold.ServiceID at
+	// hold.OrganizationID until hold.ExpiresAt and returns the hold with its
+	// ID. It returns ErrNotFound if the organization does not offer the
+	// service and ErrNoCapacity if its capacity is not tracked or nothing is
+	// available.
+	PlaceHold(hold core.Hold) (core.Hold, error)
+	GetHold(holdID string) (core.Hold, error)
+	// ListHolds returns the holds at an organization, newest first,
+	// optionally only those with status.
+	ListHolds(orgID string, status core.HoldStatus) ([]core.Hold, error)
+	// ConfirmHold and ReleaseHold return ErrHoldNotActive unless the hold is
+	// held; a hold past its expiry can be released but not confirmed.
+	ConfirmHold(holdID string) (core.Hold, error)
+	// ReleaseHold gives the unit of the hold back to the capacity.
+	ReleaseHold(holdID string) (core.Hold, error)
+	// ExpireHolds expires the holds past their expiry at now, giving their
+	// units back, and returns them.
+	ExpireHolds(now time.Time) ([]core.Hold, error)
+
+	// CreateReferral records a pending referral and returns it with its ID.
+	// It returns ErrNotFound if the referring organization does not exist
+	// and ErrInvalidReferral unless the receiving one is another
+	// organization offering the service.
+	CreateReferral(r core.Referral) (core.Referral, error)
+	GetReferral(referralID string) (core.Referral, error)
+	// ListReferrals returns the referrals matching filter, newest first.
+	ListReferrals(filter ReferralFilter) ([]core.Referral, error)
+	// UpdateReferral applies the change orgID makes to a referral it sends or
+	// receives, see ReferralUpdate. It returns ErrNotFound if orgID is
+	// neither side and ErrReferralTransition for a change its side or the
+	// referral's status does not allow.
+	UpdateReferral(orgID, referralID string, u ReferralUpdate) (core.Referral, error)
+
+	// SetServiceTranslation stores a service name in a language, or returns
+	// ErrNotFound if the service does not exist.
+	SetServiceTranslation(serviceID, lang, name string) error
+	DeleteServiceTranslation(serviceID, lang string) error
+	// GetServiceTranslations returns all translated service names keyed by
+	// service ID and then language tag.
+	GetServiceTranslations() (map[string]map[string]string, error)
+	// SetOrganizationTranslation stores an organization's name and description
+	// in a language, or returns ErrNotFound if it does not exist or is archived.
+	SetOrganizationTranslation(orgID, lang string, t core.OrganizationTranslation) error
+	DeleteOrganizationTranslation(orgID, lang string) error
+	GetOrganizationTranslations(orgID string) (map[string]core.OrganizationTranslation, error)
+	// GetOrganizationTranslationsByIDs returns the translations of several
+	// organizations keyed by organization ID and then language tag.
+	GetOrganizationTranslationsByIDs(orgIDs []string) (map[string]map[string]core.OrganizationTranslation, error)
+
+	// SetOpeningHours stores the hours of an unarchived organization, or of
+	// one of its services when serviceID is not empty. It returns ErrNotFound
+	// if the organization does not offer the service and
+	// ErrInvalidOpeningHours for a malformed schedule.
+	SetOpeningHours(orgID, serviceID string, hours core.OpeningHours) error
+	DeleteOpeningHours(orgID, serviceID string) error
+	// GetOpeningHours returns the hours of an organization keyed by service
+	// ID, with its own hours under the empty ID.
+	GetOpeningHours(orgID string) (map[string]core.OpeningHours, error)
+
+	// Events is the bus the write paths above publish organization and
+	// capacity changes to.
+	Events() *EventBus
+}
@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forEachStore runs fn against every Store implementation so that MemoryStore
+// stays a faithful fake of SQLStore.
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Run("sql", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+		fn(t, NewSQLStore(db))
+	})
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+}
+
+// seedStore inserts two services and two organizations; org1 offers both services, org2 only the first
+func seedStore(t *testing.T, s Store) {
+	require.NoError(t, s.InsertPredefinedServices([]core.Service{
+		{ID: "1", Name: "Bed"},
+		{ID: "2", Name: "Food"},
+	}))
+	require.NoError(t, s.CreateOrganization(core.Organization{
+		ID: "org1", Name: "Org One", Phone: "123",
+		Location: core.Location{Latitude: 10.1, Longitude: -20.2},
+	}))
+	require.NoError(t, s.CreateOrganization(core.Organization{
+		ID: "org2", Name: "Org Two", Phone: "456",
+		Location: core.Location{Latitude: 20.1, Longitude: -30.2},
+	}))
+	require.NoError(t, s.AddServicesToOrganization("org1", []string{"1", "2"}))
+	require.NoError(t, s.AddServicesToOrganization("org2", []string{"1"}))
+}
+
+func TestStoreOrganizations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		org, err := s.GetOrganizationByID("org1")
+		assert.NoError(t, err)
+		assert.Equal(t, "Org One", org.Name)
+
+		_, err = s.GetOrganizationByID("missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		updated := core.Organization{ID: "org1", Name: "Renamed", Phone: "999", Location: core.Location{Latitude: 1, Longitude: 2}}
+		assert.NoError(t, s.UpdateOrganization(updated))
+		org, err = s.GetOrganizationByID("org1")
+		assert.NoError(t, err)
+		assert.Equal(t, updated, org)
+		assert.ErrorIs(t, s.UpdateOrganization(core.Organization{ID: "missing"}), ErrNotFound)
+
+		assert.NoError(t, s.DeleteOrganizationByID("org2"))
+		assert.ErrorIs(t, s.DeleteOrganizationByID("org2"), ErrNotFound)
+	})
+}
+
+func TestStoreServices(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		services, err := s.GetPredefinedServices()
+		assert.NoError(t, err)
+		assert.Len(t, services, 2)
+
+		_, err = s.GetServicesByID([]string{"1", "3"})
+		assert.ErrorIs(t, err, ErrUnknownService)
+
+		services, err = s.GetServicesByOrganizationID("org2")
+		assert.NoError(t, err)
+		assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}}, services)
+
+		byOrg, err := s.GetServicesByOrganizationIDs([]string{"org1", "org2", "missing"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]core.Service{
+			"org1": {{ID: "1", Name: "Bed"}, {ID: "2", Name: "Food"}},
+			"org2": {{ID: "1", Name: "Bed"}},
+		}, byOrg)
+	})
+}
+
+func TestStoreGetOrganizationsByServices(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		orgs, err := s.GetOrganizationsByServices([]string{"1", "2"}, false)
+		assert.NoError(t, err)
+		require.Len(t, orgs, 1)
+		assert.Equal(t, "org1", orgs[0].ID)
+
+		orgs, err = s.GetOrganizationsByServices([]string{"1"}, false)
+		assert.NoError(t, err)
+		assert.Len(t, orgs, 2)
+	})
+}
+
+func TestStoreListOrganizations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		require.NoError(t, s.CreateOrganization(core.Organization{ID: "org3", Name: "Another Org"}))
+
+		var seen []string
+		opts := ListOrganizationsOptions{SortBy: SortByCreatedAt, Limit: 2}
+		for {
+			page, err := s.ListOrganizations(opts)
+			require.NoError(t, err)
+			for _, org := range page.Organizations {
+				seen = append(seen, org.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		assert.Equal(t, []string{"org1", "org2", "org3"}, seen)
+
+		page, err := s.ListOrganizations(ListOrganizationsOptions{NameContains: "org t"})
+		require.NoError(t, err)
+		require.Len(t, page.Organizations, 1)
+		assert.Equal(t, []core.Service{{ID: "1", Name: "Bed"}}, page.Organizations[0].Services)
+
+		_, err = s.ListOrganizations(ListOrganizationsOptions{SortBy: SortByName, Cursor: opts.Cursor})
+		assert.ErrorIs(t, err, ErrInvalidCursor)
+	})
+}
+
+func TestStoreListOrganizationsIgnoresCase(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		require.NoError(t, s.CreateOrganization(core.Organization{ID: "org3", Name: "another Org"}))
+		require.NoError(t, s.CreateOrganization(core.Organization{ID: "org4", Name: "Another Org"}))
+
+		var seen []string
+		opts := ListOrganizationsOptions{SortBy: SortByName, Limit: 1}
+		for {
+			page, err := s.ListOrganizations(opts)
+			require.NoError(t, err)
+			for _, org := range page.Organizations {
+				seen = append(seen, org.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		assert.Equal(t, []string{"org3", "org4", "org1", "org2"}, seen)
+
+		page, err := s.ListOrganizations(ListOrganizationsOptions{NameContains: "ANOTHER", Descending: true})
+		require.NoError(t, err)
+		require.Len(t, page.Organizations, 2)
+		assert.Equal(t, "org4", page.Organizations[0].ID)
+	})
+}
+
+func TestStoreArchiveOrganization(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		require.NoError(t, s.ArchiveOrganization("org1"))
+		assert.ErrorIs(t, s.ArchiveOrganization("org1"), ErrNotFound)
+
+		_, err := s.GetOrganizationByID("org1")
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, s.UpdateOrganization(core.Organization{ID: "org1"}), ErrNotFound)
+		orgs, err := s.GetOrganizationsByServices([]string{"1"}, false)
+		require.NoError(t, err)
+		require.Len(t, orgs, 1)
+		assert.Equal(t, "org2", orgs[0].ID)
+
+		page, err := s.ListOrganizations(ListOrganizationsOptions{Archived: true})
+		require.NoError(t, err)
+		require.Len(t, page.Organizations, 1)
+		assert.Equal(t, "org1", page.Organizations[0].ID)
+
+		require.NoError(t, s.RestoreOrganization("org1"))
+		assert.ErrorIs(t, s.RestoreOrganization("org1"), ErrNotFound)
+		services, err := s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		assert.Len(t, services, 2, "archiving keeps the service associations")
+	})
+}
+
+// TestDeleteOrganizationCascades tests that no organization_services rows are left behind
+func TestDeleteOrganizationCascades(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	seedStore(t, NewSQLStore(db))
+
+	require.NoError(t, DeleteOrganizationByID(db, "org1"))
+
+	var orphans int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM organization_services WHERE organization_id = ?", "org1").Scan(&orphans))
+	assert.Zero(t, orphans)
+
+	// Foreign keys are enforced, so associations with unknown organizations are rejected
+	assert.Error(t, AddServicesToOrganization(db, "org1", []string{"1"}))
+}
+
+func TestStoreReplaceOrganizationServices(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		assert.NoError(t, s.AddServicesToOrganization("org1", []string{"1", "2"}), "re-adding is idempotent")
+
+		// Unknown services make the whole replacement fail
+		assert.Error(t, s.ReplaceOrganizationServices("org1", []string{"2", "9"}))
+		services, err := s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		assert.Len(t, services, 2)
+
+		require.NoError(t, s.ReplaceOrganizationServices("org1", []string{"2"}))
+		services, err = s.GetServicesByOrganizationID("org1")
+		require.NoError(t, err)
+		assert.Equal(t, []core.Service{{ID: "2", Name: "Food"}}, services)
+
+		require.NoError(t, s.RemoveServiceFromOrganization("org1", "2"))
+		assert.ErrorIs(t, s.RemoveServiceFromOrganization("org1", "2"), ErrNotFound)
+	})
+}
+
+func TestStoreServiceCatalog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		require.NoError(t, s.CreateService(core.Service{ID: "3", Name: "Shower"}))
+		assert.ErrorIs(t, s.CreateService(core.Service{ID: "3", Name: "Legal Aid"}), ErrServiceExists)
+
+		require.NoError(t, s.UpdateService(core.Service{ID: "3", Name: "Showers", Deprecated: true}))
+		assert.ErrorIs(t, s.UpdateService(core.Service{ID: "9", Name: "Nope"}), ErrNotFound)
+		services, err := s.GetServicesByID([]string{"3"})
+		require.NoError(t, err)
+		assert.Equal(t, []core.Service{{ID: "3", Name: "Showers", Deprecated: true}}, services)
+
+		assert.ErrorIs(t, s.DeleteService("1"), ErrServiceInUse)
+		require.NoError(t, s.DeleteService("3"))
+		assert.ErrorIs(t, s.DeleteService("3"), ErrNotFound)
+
+		// Archived organizations still hold on to their services
+		require.NoError(t, s.ArchiveOrganization("org1"))
+		assert.ErrorIs(t, s.DeleteService("2"), ErrServiceInUse)
+	})
+}
+
+func TestStoreServiceCategories(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		require.NoError(t, s.CreateService(core.Service{ID: "10", Name: "Shelter"}))
+		require.NoError(t, s.CreateService(core.Service{ID: "11", Name: "Family beds", ParentID: "10"}))
+		require.NoError(t, s.CreateService(core.Service{ID: "12", Name: "Emergency cots", ParentID: "11"}))
+		assert.ErrorIs(t, s.CreateService(core.Service{ID: "13", Name: "Orphan", ParentID: "99"}), ErrUnknownService)
+		assert.ErrorIs(t, s.UpdateService(core.Service{ID: "10", Name: "Shelter", ParentID: "12"}), ErrServiceCycle)
+		assert.ErrorIs(t, s.UpdateService(core.Service{ID: "10", Name: "Shelter", ParentID: "10"}), ErrServiceCycle)
+		assert.ErrorIs(t, s.DeleteService("11"), ErrServiceHasChildren)
+
+		require.NoError(t, s.AddServicesToOrganization("org2", []string{"12"}))
+
+		orgs, err := s.GetOrganizationsByServices([]string{"10"}, false)
+		require.NoError(t, err)
+		assert.Empty(t, orgs)
+
+		orgs, err = s.GetOrganizationsByServices([]string{"10"}, true)
+		require.NoError(t, err)
+		require.Len(t, orgs, 1)
+		assert.Equal(t, "org2", orgs[0].ID)
+
+		orgs, err = s.GetOrganizationsByServices([]string{"2", "10"}, true)
+		require.NoError(t, err)
+		assert.Empty(t, orgs)
+	})
+}
+
+func TestStoreTranslations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+
+		require.NoError(t, s.SetServiceTranslation("1", "fr", "Lit"))
+		require.NoError(t, s.SetServiceTranslation("1", "fr", "Lit de camp"))
+		require.NoError(t, s.SetServiceTranslation("2", "ar", "طعام"))
+		assert.ErrorIs(t, s.SetServiceTranslation("9", "fr", "Rien"), ErrNotFound)
+
+		names, err := s.GetServiceTranslations()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]map[string]string{"1": {"fr": "Lit de camp"}, "2": {"ar": "طعام"}}, names)
+
+		fr := core.OrganizationTranslation{Name: "Organisation un", Description: "Des lits"}
+		require.NoError(t, s.SetOrganizationTranslation("org1", "fr", fr))
+		assert.ErrorIs(t, s.SetOrganizationTranslation("missing", "fr", fr), ErrNotFound)
+		translations, err := s.GetOrganizationTranslations("org1")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]core.OrganizationTranslation{"fr": fr}, translations)
+		byOrg, err := s.GetOrganizationTranslationsByIDs([]string{"org1", "org2"})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]map[string]core.OrganizationTranslation{"org1": {"fr": fr}}, byOrg)
+
+		require.NoError(t, s.DeleteOrganizationTranslation("org1", "fr"))
+		assert.ErrorIs(t, s.DeleteOrganizationTranslation("org1", "fr"), ErrNotFound)
+
+		// Translations go away with their service
+		require.NoError(t, s.ReplaceOrganizationServices("org1", []string{"1"}))
+		require.NoError(t, s.DeleteService("2"))
+		names, err = s.GetServiceTranslations()
+		require.NoError(t, err)
+		assert.NotContains(t, names, "2")
+	})
+}
+
+func TestStoreMatchOrganizationsByServices(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seedStore(t, s)
+		require.NoError(t, s.CreateService(core.Service{ID: "3", Name: "Shower"}))
+
+		matches, err := s.MatchOrganizationsByServices(ServiceMatch{ServiceIDs: []string{"3", "2", "1"}, MinMatches: 1})
+		require.NoError(t, err)
+		require.Len(t, matches, 2)
+		assert.Equal(t, "org1", matches[0].Organization.ID)
+		assert.Equal(t, []string{"2", "1"}, matches[0].MatchedServiceIDs)
+		assert.Equal(t, []string{"1"}, matches[1].MatchedServiceIDs)
+
+		matches, err = s.MatchOrganizationsByServices(ServiceMatch{ServiceIDs: []string{"3", "2", "1"}, MinMatches: 2})
+		require.NoError(t, err)
+		require.Len(t, matches, 1)
+		assert.Equal(t, "org1", matches[0].Organization.ID)
+
+		matches, err = s.MatchOrganizationsByServices(ServiceMatch{ServiceIDs: []string{"3", "2", "1"}})
+		require.NoError(t, err)
+		assert.Empty(t, matches)
+	})
+}
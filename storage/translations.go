@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/CTRL-Impact-Team4/khair-backend/core"
+)
+
+// SetServiceTranslation stores the name of a catalog service in lang,
+// replacing any previous translation. It returns sql.ErrNoRows if the service
+// does not exist.
+func SetServiceTranslation(db *sql.DB, serviceID, lang, name string) error {
+	result, err := db.Exec(`
+		INSERT INTO service_translations (service_id, lang, name)
+		SELECT id, ?, ? FROM services WHERE id = ?
+		ON CONFLICT (service_id, lang) DO UPDATE SET name = excluded.name
+	`, lang, name, serviceID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func DeleteServiceTranslation(db *sql.DB, serviceID, lang string) error {
+	result, err := db.Exec("DELETE FROM service_translations WHERE service_id = ? AND lang = ?", serviceID, lang)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// GetServiceTranslations returns the translated names of every catalog
+// service, keyed by service ID and then language tag.
+func GetServiceTranslations(db *sql.DB) (map[string]map[string]string, error) {
+	rows, err := db.Query("SELECT service_id, lang, name FROM service_translations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := make(map[string]map[string]string)
+	for rows.Next() {
+		var serviceID, lang, name string
+		if err := rows.Scan(&serviceID, &lang, &name); err != nil {
+			return nil, err
+		}
+		if translations[serviceID] == nil {
+			translations[serviceID] = make(map[string]string)
+		}
+		translations[serviceID][lang] = name
+	}
+	return translations, rows.Err()
+}
+
+// SetOrganizationTranslation stores the name and description of an
+// unarchived organization in lang, replacing any previous translation.
+func SetOrganizationTranslation(db *sql.DB, orgID, lang string, t core.OrganizationTranslation) error {
+	result, err := db.Exec(`
+		INSERT INTO organization_translations (organization_id, lang, name, description)
+		SELECT id, ?, ?, ? FROM organizations WHERE id = ? AND archived_at IS NULL
+		ON CONFLICT (organization_id, lang) DO UPDATE SET name = excluded.name, description = excluded.description
+	`, lang, t.Name, t.Description, orgID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func DeleteOrganizationTranslation(db *sql.DB, orgID, lang string) error {
+	result, err := db.Exec("DELETE FROM organization_translations WHERE organization_id = ? AND lang = ?", orgID, lang)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// GetOrganizationTranslations returns the translations of an organization
+// keyed by language tag.
+func GetOrganizationTranslations(db *sql.DB, orgID string) (map[string]core.OrganizationTranslation, error) {
+	rows, err := db.Query("SELECT lang, name, description FROM organization_translations WHERE organization_id = ?", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := make(map[string]core.OrganizationTranslation)
+	for rows.Next() {
+		var lang string
+		var t core.OrganizationTranslation
+		if err := rows.Scan(&lang, &t.Name, &t.Description); err != nil {
+			return nil, err
+		}
+		translations[lang] = t
+	}
+	return translations, rows.Err()
+}
+
+// GetOrganizationTranslationsByIDs returns the translations of the
+// organizations in orgIDs keyed by organization ID and then language tag, in
+// a single query. Organizations without translations are left out.
+func GetOrganizationTranslationsByIDs(db *sql.DB, orgIDs []string) (map[string]map[string]core.OrganizationTranslation, error) {
+	translations := make(map[string]map[string]core.OrganizationTranslation)
+	if len(orgIDs) == 0 {
+		return translations, nil
+	}
+	ids, err := json.Marshal(orgIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT organization_id, lang, name, description
+		FROM organization_translations
+		WHERE organization_id IN (SELECT value FROM json_each(?))
+	`, string(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID, lang string
+		var t core.OrganizationTranslation
+		if err := rows.Scan(&orgID, &lang, &t.Name, &t.Description); err != nil {
+			return nil, err
+		}
+		if translations[orgID] == nil {
+			translations[orgID] = make(map[string]core.OrganizationTranslation)
+		}
+		translations[orgID][lang] = t
+	}
+	return translations, rows.Err()
+}
+
+func (s *SQLStore) SetServiceTranslation(serviceID, lang, name string) error {
+	return notFound(SetServiceTranslation(s.db, serviceID, lang, name))
+}
+
+func (s *SQLStore) DeleteServiceTranslation(serviceID, lang string) error {
+	return notFound(DeleteServiceTranslation(s.db, serviceID, lang))
+}
+
+func (s *SQLStore) GetServiceTranslations() (map[string]map[string]string, error) {
+	return GetServiceTranslations(s.db)
+}
+
+func (s *SQLStore) SetOrganizationTranslation(orgID, lang string, t core.OrganizationTranslation) error {
+	return notFound(SetOrganizationTranslation(s.db, orgID, lang, t))
+}
+
+func (s *SQLStore) DeleteOrganizationTranslation(orgID, lang string) error {
+	return notFound(DeleteOrganizationTranslation(s.db, orgID, lang))
+}
+
+func (s *SQLStore) GetOrganizationTranslations(orgID string) (map[string]core.OrganizationTranslation, error) {
+	return GetOrganizationTranslations(s.db, orgID)
+}
+
+func (s *SQLStore) GetOrganizationTranslationsByIDs(orgIDs []string) (map[string]map[string]core.OrganizationTranslation, error) {
+	return GetOrganizationTranslationsByIDs(s.db, orgIDs)
+}